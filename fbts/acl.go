@@ -16,7 +16,8 @@
 package main
 
 import (
-	"github.com/maufl/go-fosp/fosp"
+	"github.com/maufl/go-fosp/fosp/fospclient"
+	"net/url"
 )
 
 func testAcl() (success bool) {
@@ -30,33 +31,32 @@ func testAcl() (success bool) {
 		}
 	}()
 
-	userOne := "alice"
+	userOne := "alice@" + host
 	passwordOne := "password"
-	clientOne := &fosp.Client{}
-	err := clientOne.OpenConnection(host)
+	clientOne, err := fospclient.Dial(host)
 	if err != nil {
 		panic("Failed to open connection for client one.")
 	}
-	expectE(clientOne.Connect())
-	expectE(clientOne.Register(userOne, passwordOne))
-	expectE(clientOne.Authenticate(userOne, passwordOne))
+	defer clientOne.Close()
+	expectOK(clientOne.Register(userOne, passwordOne))
+	expectOK(clientOne.Authenticate(userOne, passwordOne))
 
-	userTwo := "bob"
+	userTwo := "bob@" + host
 	passwordTwo := "password"
-	clientTwo := &fosp.Client{}
-	err = clientTwo.OpenConnection(host)
+	clientTwo, err := fospclient.Dial(host)
 	if err != nil {
 		panic("Falied to open connection for client two.")
 	}
-	expectE(clientTwo.Connect())
-	expectE(clientTwo.Register(userTwo, passwordTwo))
-	expectE(clientTwo.Authenticate(userTwo, passwordTwo))
+	defer clientTwo.Close()
+	expectOK(clientTwo.Register(userTwo, passwordTwo))
+	expectOK(clientTwo.Authenticate(userTwo, passwordTwo))
 
-	rootOne, err := fosp.ParseURL(userOne + "@" + host)
+	rootOne, err := url.Parse("fosp://" + userOne + "/")
 	if err != nil {
 		panic("Error when parsing root URL of user one")
 	}
 
-	expect(E{Failed: true})(clientTwo.Select(rootOne))
+	_, err = clientTwo.Get(rootOne)
+	expectForbidden(err)
 	return true
 }
@@ -16,40 +16,28 @@
 package main
 
 import (
-	"github.com/maufl/go-fosp/fosp"
+	"fmt"
+	"github.com/maufl/go-fosp/fosp/fospclient"
 )
 
-// E represents the result that is expected of a Response-error pair
-type E struct {
-	Error    bool
-	Failed   bool
-	Code     uint
-	Body     string
-	JSONBody string
+// expectOK panics if the request failed.
+func expectOK(err error) {
+	if err != nil {
+		panic("Expected the request to succeed but it failed: " + err.Error())
+	}
 }
 
-var expectE = expect(E{})
-var expectFailed = expect(E{Failed: true})
-
-func expect(e E) func(*fosp.Response, error) (*fosp.Response, error) {
-	return func(resp *fosp.Response, err error) (*fosp.Response, error) {
-		if !e.Error && err != nil {
-			panic("Expected error to be nil but was not")
-		}
-		if e.Error && err == nil {
-			panic("Expected error to not be nil but was nil")
+// expectStatus returns a function that panics unless the request failed with the status code.
+func expectStatus(code uint) func(error) {
+	return func(err error) {
+		if err == nil {
+			panic(fmt.Sprintf("Expected the request to fail with status %d but it succeeded", code))
 		}
-		if !e.Failed && resp.ResponseType() == fosp.Failed {
-			panic("Expected the request to succeed but response is Failed: " + resp.BodyString())
+		if actual := fospclient.StatusCode(err); actual != code {
+			panic(fmt.Sprintf("Expected the request to fail with status %d but got %s", code, err))
 		}
-		if e.Failed && resp.ResponseType() == fosp.Succeeded {
-			panic("Expected the request to fail but response is Succeeded")
-		}
-		// TODO: Add check for Code, requires change to Response struct
-		if e.Body != "" && e.Body != resp.BodyString() {
-			panic("Expected the body to be " + e.Body + " but is " + resp.BodyString())
-		}
-		// TODO: Add check for body content by comparing JSON data
-		return resp, err
 	}
 }
+
+var expectForbidden = expectStatus(403)
+var expectNotFound = expectStatus(404)
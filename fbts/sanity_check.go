@@ -16,7 +16,10 @@
 package main
 
 import (
+	"bytes"
 	"github.com/maufl/go-fosp/fosp"
+	"github.com/maufl/go-fosp/fosp/fospclient"
+	"net/url"
 )
 
 func testSanityCheck() (success bool) {
@@ -29,37 +32,55 @@ func testSanityCheck() (success bool) {
 			success = false
 		}
 	}()
-	user := "test"
+	user := "test@" + host
 	password := "password"
-	url, _ := fosp.ParseURL(user + "@" + host + "/")
-	child, _ := fosp.ParseURL(user + "@" + host + "/foo")
-	obj1, _ := fosp.UnmarshalObject(`{"data": "foo"}`)
-	obj2, _ := fosp.UnmarshalObject(`{"data": "bar"}`)
-	objNoWrite, _ := fosp.UnmarshalObject(`{ "acl": { "owner": ["not-data-write"], "users": { "` + user + "@" + host + `" : [ "not-data-write" ] } } }`)
+	root, _ := url.Parse("fosp://" + user + "/")
+	child, _ := url.Parse("fosp://" + user + "/foo")
+	obj := fosp.NewObject()
+	obj.Data = "foo"
+	update := fosp.PatchObject{"data": "bar"}
+	noWrite := fosp.PatchObject{"acl": map[string]interface{}{"owner": map[string]interface{}{"data": []interface{}{"not-write"}}}}
 	attachment := []byte("Hello World!")
 
-	client := &fosp.Client{}
-	err := client.OpenConnection(host)
+	client, err := fospclient.Dial(host)
 	if err != nil {
 		println("Failed to open connection")
-		success = false
-		return
+		return false
 	}
-	expectE(client.Connect())
-	expectE(client.Register(user, password))
-	expectE(client.Authenticate(user, password))
-	expectE(client.Select(url))
-	expectE(client.List(url))
-	expectE(client.Create(child, obj1))
-	expectE(client.List(url))
-	expectE(client.Update(child, obj2))
-	expectE(client.Delete(child))
-	expectFailed(client.Delete(child))
-	expectE(client.Create(child, obj1))
-	expectE(client.Update(child, objNoWrite))
-	expectFailed(client.Update(child, obj2))
-	expectE(client.Write(child, attachment))
-	expect(E{Body: string(attachment)})(client.Read(child))
-	success = true
-	return
+	defer client.Close()
+	expectOK(client.Register(user, password))
+	expectOK(client.Authenticate(user, password))
+	_, err = client.Get(root)
+	expectOK(err)
+	_, err = client.List(root)
+	expectOK(err)
+	created, err := client.Create(child, obj)
+	expectOK(err)
+	if created.Data != "foo" {
+		panic("Expected the created object to be returned")
+	}
+	if names, err := client.List(root); err != nil || len(names) != 1 || names[0] != "foo" {
+		panic("Expected the new object to be listed")
+	}
+	updated, err := client.Patch(child, update)
+	expectOK(err)
+	if updated.Data != "bar" {
+		panic("Expected the patched object to be returned")
+	}
+	if updated, err := client.Get(child); err != nil || updated.Data != "bar" {
+		panic("Expected the data of the object to be updated")
+	}
+	expectOK(client.Delete(child))
+	expectNotFound(client.Delete(child))
+	_, err = client.Create(child, obj)
+	expectOK(err)
+	expectOK(client.Write(child, bytes.NewBuffer(attachment)))
+	if data, err := client.Read(child); err != nil || !bytes.Equal(data, attachment) {
+		panic("Expected to read the attachment that was written")
+	}
+	_, err = client.Patch(child, noWrite)
+	expectOK(err)
+	_, err = client.Patch(child, update)
+	expectForbidden(err)
+	return true
 }
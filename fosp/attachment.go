@@ -20,6 +20,11 @@ type Attachment struct {
 	Name string `json:"name,omitempty"`
 	Size uint   `json:"size,omitempty"`
 	Type string `json:"type,omitempty"`
+	// Digest is the digest of the content of the attachment, see DigestPrefix.
+	// It is maintained by the server and can be used to verify the data of a READ.
+	Digest string `json:"digest,omitempty"`
+	// Upload is the identifier of the resumable upload that last wrote the attachment.
+	Upload string `json:"upload,omitempty"`
 }
 
 // NewAttachment creates a new Attachment struct and returns it.
@@ -0,0 +1,60 @@
+// Copyright (C) 2015 Felix Maurer
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package fosp
+
+// ProtocolVersion is the version of the FOSP protocol implemented by this package.
+const ProtocolVersion = "0.1"
+
+// Capabilities represents the body of a response to an OPTIONS request.
+// It describes which features a server supports, so that clients can negotiate them before authenticating.
+type Capabilities struct {
+	Version           string   `json:"version"`
+	Methods           []string `json:"methods"`
+	SaslMechanisms    []string `json:"sasl-mechanisms"`
+	MaxMessageSize    int64    `json:"max-message-size,omitempty"`
+	MaxAttachmentSize int64    `json:"max-attachment-size,omitempty"`
+	Extensions        []string `json:"extensions"`
+}
+
+// NewCapabilities creates a new Capabilities struct for the current protocol version and initializes fields to non-nil values.
+func NewCapabilities() *Capabilities {
+	return &Capabilities{
+		Version:        ProtocolVersion,
+		Methods:        []string{OPTIONS, AUTH, GET, LIST, CREATE, PATCH, DELETE, READ, WRITE, SUBSCRIBE, UNSUBSCRIBE, CHANGES},
+		SaslMechanisms: []string{},
+		Extensions:     []string{},
+	}
+}
+
+// Supports returns whether the extension is contained in the list of supported extensions.
+func (c *Capabilities) Supports(extension string) bool {
+	for _, ext := range c.Extensions {
+		if ext == extension {
+			return true
+		}
+	}
+	return false
+}
+
+// SupportsSaslMechanism returns whether the SASL mechanism is contained in the list of offered mechanisms.
+func (c *Capabilities) SupportsSaslMechanism(mechanism string) bool {
+	for _, m := range c.SaslMechanisms {
+		if m == mechanism {
+			return true
+		}
+	}
+	return false
+}
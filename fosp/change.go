@@ -0,0 +1,38 @@
+// Copyright (C) 2015 Felix Maurer
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package fosp
+
+import (
+	"time"
+)
+
+// Change is an entry of the change log of a user, it records that the object at URL was created, updated or deleted.
+// Change IDs increase with every change of the objects of a user.
+type Change struct {
+	ID    uint64    `json:"id"`
+	Event string    `json:"event"`
+	URL   string    `json:"url"`
+	ETag  string    `json:"etag,omitempty"`
+	Time  time.Time `json:"time"`
+}
+
+// ChangeList is the response to a CHANGES request.
+// Cursor is the change ID to send in the Since header of the next request, if More is set there are further changes.
+type ChangeList struct {
+	Changes []*Change `json:"changes"`
+	Cursor  uint64    `json:"cursor"`
+	More    bool      `json:"more"`
+}
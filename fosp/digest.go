@@ -0,0 +1,60 @@
+// Copyright (C) 2015 Felix Maurer
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package fosp
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+)
+
+const (
+	// DigestPrefix is the prefix of attachment digests, which are the hex encoded SHA-256 sums of the content.
+	DigestPrefix = "sha256:"
+	// DigestHeader carries the digest of the whole attachment in responses to READ requests.
+	DigestHeader = "Digest"
+)
+
+// Digester computes the digest of everything that is written to it.
+type Digester struct {
+	hash hash.Hash
+}
+
+// NewDigester creates a new Digester.
+func NewDigester() *Digester {
+	return &Digester{hash: sha256.New()}
+}
+
+func (d *Digester) Write(p []byte) (int, error) {
+	return d.hash.Write(p)
+}
+
+// Digest returns the digest of the data written so far.
+func (d *Digester) Digest() string {
+	return DigestPrefix + hex.EncodeToString(d.hash.Sum(nil))
+}
+
+// Digest returns the digest of data.
+func Digest(data []byte) string {
+	sum := sha256.Sum256(data)
+	return DigestPrefix + hex.EncodeToString(sum[:])
+}
+
+// MatchDigest reports whether digest is contained in the comma separated list of an If-Match or If-None-Match header.
+// The value "*" matches every digest. An empty digest, i.e. a missing attachment, matches nothing.
+func MatchDigest(list, digest string) bool {
+	return digest != "" && (ListContains(list, "*") || ListContains(list, digest))
+}
@@ -0,0 +1,63 @@
+// Copyright (C) 2015 Felix Maurer
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package fosp
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+)
+
+const (
+	// ETagHeader carries the entity tag of an object in responses to GET, CREATE, PATCH and WRITE requests.
+	// The entity tag changes whenever the object or its attachment is modified.
+	ETagHeader = "ETag"
+	// IfMatchHeader makes PATCH, WRITE and DELETE requests conditional. It contains a comma separated list of
+	// entity tags and the request fails with StatusPreconditionFailed if the object has none of them.
+	// WRITE requests also accept the digest of the current attachment.
+	IfMatchHeader = "If-Match"
+	// IfNoneMatchHeader is the opposite of IfMatchHeader, the request fails if the object has one of the entity tags.
+	// GET requests are answered with StatusNotModified instead. For WRITE requests, the list may contain
+	// digests of the attachment and "*" only matches if the object already has an attachment.
+	IfNoneMatchHeader = "If-None-Match"
+)
+
+// ComputeETag computes the entity tag of the object from its encoded form.
+func ComputeETag(o *Object) (string, error) {
+	encoded, err := json.Marshal(o)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(encoded)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`, nil
+}
+
+// MatchETag reports whether etag is contained in the comma separated list of an If-Match or If-None-Match header.
+// The value "*" matches every existing object.
+func MatchETag(list, etag string) bool {
+	return etag != "" && (ListContains(list, "*") || ListContains(list, etag))
+}
+
+// ListContains reports whether the comma separated list contains value.
+func ListContains(list, value string) bool {
+	for _, candidate := range strings.Split(list, ",") {
+		if strings.TrimSpace(candidate) == value {
+			return true
+		}
+	}
+	return false
+}
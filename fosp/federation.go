@@ -0,0 +1,76 @@
+// Copyright (C) 2015 Felix Maurer
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package fosp
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"strings"
+)
+
+// ServerMechanism is the name of the SASL mechanism servers use to prove their domain to each other.
+//
+// Both servers sign their domains and two fresh nonces with the Ed25519 key of their domain:
+//
+//	client:  initial-response  "d=<client domain>,r=<client nonce>"
+//	server:  challenge         "d=<server domain>,r=<server nonce>"
+//	client:  response          "s=<signature of the client>"
+//	server:  additional-data   "s=<signature of the server>"
+//
+// Each side verifies the signature of the other side with the public key it trusts for the claimed domain.
+const ServerMechanism = "FOSP-SERVER"
+
+// ServerAuthentication holds the parameters of one ServerMechanism exchange.
+type ServerAuthentication struct {
+	ClientDomain string
+	ServerDomain string
+	ClientNonce  string
+	ServerNonce  string
+}
+
+// signedData returns the data that is signed by one side of the exchange.
+// The role is part of the data so that the signature of one side can not be replayed as the signature of the other.
+func (a ServerAuthentication) signedData(role string) []byte {
+	return []byte(strings.Join([]string{ServerMechanism, role, a.ClientDomain, a.ServerDomain, a.ClientNonce, a.ServerNonce}, ","))
+}
+
+// SignClient returns the base64 encoded signature of the client side of the exchange.
+func (a ServerAuthentication) SignClient(key ed25519.PrivateKey) string {
+	return base64.StdEncoding.EncodeToString(ed25519.Sign(key, a.signedData("client")))
+}
+
+// SignServer returns the base64 encoded signature of the server side of the exchange.
+func (a ServerAuthentication) SignServer(key ed25519.PrivateKey) string {
+	return base64.StdEncoding.EncodeToString(ed25519.Sign(key, a.signedData("server")))
+}
+
+// VerifyClient checks the base64 encoded signature of the client side of the exchange.
+func (a ServerAuthentication) VerifyClient(key ed25519.PublicKey, signature string) bool {
+	return verifyServerSignature(key, a.signedData("client"), signature)
+}
+
+// VerifyServer checks the base64 encoded signature of the server side of the exchange.
+func (a ServerAuthentication) VerifyServer(key ed25519.PublicKey, signature string) bool {
+	return verifyServerSignature(key, a.signedData("server"), signature)
+}
+
+func verifyServerSignature(key ed25519.PublicKey, data []byte, signature string) bool {
+	raw, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return false
+	}
+	return ed25519.Verify(key, data, raw)
+}
@@ -0,0 +1,42 @@
+// Copyright (C) 2015 Felix Maurer
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package fospclient
+
+import (
+	"encoding/json"
+	"github.com/maufl/go-fosp/fosp"
+	"net/url"
+	"strconv"
+)
+
+// Changes returns the changes of the object at u and its descendants after the change ID since.
+// The Cursor of the result is passed as since to the next call, while More is set the remaining changes can be
+// fetched right away.
+func (c *Client) Changes(u *url.URL, since uint64) (*fosp.ChangeList, error) {
+	req := fosp.NewRequest(fosp.CHANGES, u)
+	if since > 0 {
+		req.Header.Set(fosp.SinceHeader, strconv.FormatUint(since, 10))
+	}
+	resp, err := c.sendRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	list := &fosp.ChangeList{}
+	if err := json.NewDecoder(resp.Body).Decode(list); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
@@ -0,0 +1,277 @@
+// Copyright (C) 2015 Felix Maurer
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+// Package fospclient provides a typed Go API for talking to a FOSP server.
+//
+// A Client wraps a fospws.Connection, sends requests for the FOSP methods and decodes their responses
+// into fosp.Objects. FAILED responses are returned as *StatusError values that carry the status code.
+package fospclient
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/maufl/go-fosp/fosp"
+	"github.com/maufl/go-fosp/fosp/fospws"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"strconv"
+)
+
+// Client offers the FOSP methods on top of a fospws.Connection.
+type Client struct {
+	connection *fospws.Connection
+	// AllowPlain lets Authenticate send the password with PLAIN when the server does not offer SCRAM-SHA-256.
+	// PLAIN hands the password to the server and, without TLS, to everyone on the path.
+	AllowPlain bool
+}
+
+// New creates a Client that sends its requests on connection.
+func New(connection *fospws.Connection) *Client {
+	return &Client{connection: connection}
+}
+
+// Dial opens a connection to the FOSP server of remote and returns a Client for it.
+// The endpoint of remote is found like in fospws.OpenConnection.
+func Dial(remote string) (*Client, error) {
+	connection, err := fospws.OpenConnection(remote)
+	if err != nil {
+		return nil, err
+	}
+	return New(connection), nil
+}
+
+// Connection returns the underlying connection, e.g. to register a handler for notifications.
+func (c *Client) Connection() *fospws.Connection {
+	return c.connection
+}
+
+// Close closes the underlying connection.
+func (c *Client) Close() {
+	c.connection.Close()
+}
+
+// Options returns the capabilities of the server.
+func (c *Client) Options() (*fosp.Capabilities, error) {
+	return c.connection.Options()
+}
+
+// Register creates a new account for user, e.g. alice@example.com, on the server.
+func (c *Client) Register(user, password string) error {
+	u, err := url.Parse("fosp://" + user + "/")
+	if err != nil {
+		return err
+	}
+	obj := fosp.NewObject()
+	obj.Data = map[string]interface{}{"password": password}
+	body, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+	_, err = c.send(fosp.CREATE, u, bytes.NewBuffer(body))
+	return err
+}
+
+// Authenticate authenticates the connection as user with SCRAM-SHA-256.
+// If the server does not offer it, Authenticate fails with ErrScramUnavailable, or the error of the OPTIONS request,
+// unless AllowPlain is set and the password is sent with PLAIN instead.
+func (c *Client) Authenticate(user, password string) error {
+	caps, err := c.connection.Options()
+	if err == nil && caps.SupportsSaslMechanism(fosp.ScramMechanism) {
+		return c.connection.AuthenticateScram(user, password)
+	}
+	if c.AllowPlain {
+		return c.connection.AuthenticatePlain(user, password)
+	}
+	if err != nil {
+		return err
+	}
+	return ErrScramUnavailable
+}
+
+// Get returns the object at u, its ETag field is set to the entity tag the server sent.
+func (c *Client) Get(u *url.URL) (*fosp.Object, error) {
+	return c.get(fosp.NewRequest(fosp.GET, u))
+}
+
+func (c *Client) get(req *fosp.Request) (*fosp.Object, error) {
+	resp, err := c.sendRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Code == fosp.StatusNotModified {
+		return nil, ErrNotModified
+	}
+	return decodeObject(req.URL, resp)
+}
+
+// object returns the object the server sent in the response to a CREATE or PATCH request.
+// Servers that do not send the object in the response are asked for it with a GET request.
+func (c *Client) object(u *url.URL, resp *fosp.Response) (*fosp.Object, error) {
+	obj, err := decodeObject(u, resp)
+	if err == io.EOF {
+		return c.Get(u)
+	}
+	return obj, err
+}
+
+// decodeObject decodes the object in the body of resp and sets its URL and ETag fields.
+func decodeObject(u *url.URL, resp *fosp.Response) (*fosp.Object, error) {
+	obj := fosp.NewObject()
+	if err := json.NewDecoder(resp.Body).Decode(obj); err != nil {
+		return nil, err
+	}
+	obj.URL = u
+	obj.ETag = resp.Header.Get(fosp.ETagHeader)
+	return obj, nil
+}
+
+// List returns the names of the children of the object at u.
+func (c *Client) List(u *url.URL) ([]string, error) {
+	resp, err := c.send(fosp.LIST, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	if err := json.NewDecoder(resp.Body).Decode(&names); err != nil {
+		return nil, err
+	}
+	return names, nil
+}
+
+// Create stores obj as a new object at u and returns the object as it was stored by the server.
+func (c *Client) Create(u *url.URL, obj *fosp.Object) (*fosp.Object, error) {
+	body, err := json.Marshal(obj)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.send(fosp.CREATE, u, bytes.NewBuffer(body))
+	if err != nil {
+		return nil, err
+	}
+	return c.object(u, resp)
+}
+
+// Patch applies patch to the object at u and returns the updated object.
+func (c *Client) Patch(u *url.URL, patch fosp.PatchObject) (*fosp.Object, error) {
+	body, err := json.Marshal(patch)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.send(fosp.PATCH, u, bytes.NewBuffer(body))
+	if err != nil {
+		return nil, err
+	}
+	return c.object(u, resp)
+}
+
+// Delete removes the object at u and all its children.
+func (c *Client) Delete(u *url.URL) error {
+	_, err := c.send(fosp.DELETE, u, nil)
+	return err
+}
+
+// Read returns the attachment of the object at u.
+func (c *Client) Read(u *url.URL) ([]byte, error) {
+	body, err := c.ReadStream(u)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	return ioutil.ReadAll(body)
+}
+
+// ReadStream returns a reader for the attachment of the object at u while it is transferred.
+// If the server sent the digest of the attachment, the reader returns ErrDigestMismatch instead of io.EOF
+// when the received data does not match it.
+// The reader has to be closed, the chunks of the attachment that were not read yet are buffered until then.
+func (c *Client) ReadStream(u *url.URL) (io.ReadCloser, error) {
+	resp, err := c.send(fosp.READ, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	body, ok := resp.Body.(io.ReadCloser)
+	if !ok {
+		body = ioutil.NopCloser(resp.Body)
+	}
+	if digest := resp.Header.Get(fosp.DigestHeader); digest != "" {
+		return &verifyingReader{ReadCloser: body, digester: fosp.NewDigester(), digest: digest}, nil
+	}
+	return body, nil
+}
+
+// ReadRange returns length bytes of the attachment of the object at u, starting at offset.
+// A negative length reads until the end of the attachment.
+func (c *Client) ReadRange(u *url.URL, offset, length int64) ([]byte, error) {
+	req := fosp.NewRequest(fosp.READ, u)
+	last := int64(-1)
+	if length >= 0 {
+		if length == 0 {
+			return []byte{}, nil
+		}
+		last = offset + length - 1
+	}
+	req.Header.Set(fosp.RangeHeader, fosp.FormatRange(offset, last))
+	resp, err := c.sendRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	if closer, ok := resp.Body.(io.Closer); ok {
+		defer closer.Close()
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// Write stores the content of data as the attachment of the object at u.
+// The data is streamed to the server, if data is an io.Closer it is closed when it was sent.
+func (c *Client) Write(u *url.URL, data io.Reader) error {
+	_, err := c.send(fosp.WRITE, u, data)
+	return err
+}
+
+// WriteAt writes the content of data into the attachment of the object at u, starting at offset.
+// Everything after the written data is cut off, the new size of the attachment is returned.
+func (c *Client) WriteAt(u *url.URL, offset int64, data io.Reader) (int64, error) {
+	req := fosp.NewRequest(fosp.WRITE, u)
+	req.Header.Set(fosp.OffsetHeader, strconv.FormatInt(offset, 10))
+	req.Body = data
+	resp, err := c.sendRequest(req)
+	if err != nil {
+		return -1, err
+	}
+	return strconv.ParseInt(resp.Header.Get(fosp.OffsetHeader), 10, 64)
+}
+
+// send sends a request and converts a FAILED response into a *StatusError.
+func (c *Client) send(method string, u *url.URL, body io.Reader) (*fosp.Response, error) {
+	req := fosp.NewRequest(method, u)
+	req.Body = body
+	return c.sendRequest(req)
+}
+
+// sendRequest sends a prepared request and converts a FAILED response into a *StatusError.
+func (c *Client) sendRequest(req *fosp.Request) (*fosp.Response, error) {
+	resp, err := c.connection.SendRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Status != fosp.SUCCEEDED {
+		return nil, newStatusError(req.Method, req.URL, resp)
+	}
+	if resp.Body == nil {
+		resp.Body = bytes.NewReader(nil)
+	}
+	return resp, nil
+}
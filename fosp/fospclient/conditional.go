@@ -0,0 +1,85 @@
+// Copyright (C) 2015 Felix Maurer
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package fospclient
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/maufl/go-fosp/fosp"
+	"io"
+	"net/url"
+)
+
+// ErrNotModified is returned by GetIfNoneMatch when the object still has the given entity tag.
+var ErrNotModified = errors.New("object not modified")
+
+// GetIfNoneMatch returns the object at u, unless it still has the entity tag etag.
+// In that case ErrNotModified is returned.
+func (c *Client) GetIfNoneMatch(u *url.URL, etag string) (*fosp.Object, error) {
+	req := fosp.NewRequest(fosp.GET, u)
+	req.Header.Set(fosp.IfNoneMatchHeader, etag)
+	return c.get(req)
+}
+
+// PatchIfMatch applies patch to the object at u if the object still has the entity tag etag
+// and returns the new entity tag. Otherwise an error with status fosp.StatusPreconditionFailed is returned.
+func (c *Client) PatchIfMatch(u *url.URL, etag string, patch fosp.PatchObject) (string, error) {
+	body, err := json.Marshal(patch)
+	if err != nil {
+		return "", err
+	}
+	req := fosp.NewRequest(fosp.PATCH, u)
+	req.Header.Set(fosp.IfMatchHeader, etag)
+	req.Body = bytes.NewBuffer(body)
+	resp, err := c.sendRequest(req)
+	if err != nil {
+		return "", err
+	}
+	return resp.Header.Get(fosp.ETagHeader), nil
+}
+
+// DeleteIfMatch removes the object at u and all its children if the object still has the entity tag etag.
+func (c *Client) DeleteIfMatch(u *url.URL, etag string) error {
+	req := fosp.NewRequest(fosp.DELETE, u)
+	req.Header.Set(fosp.IfMatchHeader, etag)
+	_, err := c.sendRequest(req)
+	return err
+}
+
+// WriteIfMatch stores the content of data as the attachment of the object at u if the object still has the
+// entity tag etag, or its attachment has the digest etag. The new entity tag of the object is returned.
+func (c *Client) WriteIfMatch(u *url.URL, etag string, data io.Reader) (string, error) {
+	req := fosp.NewRequest(fosp.WRITE, u)
+	req.Header.Set(fosp.IfMatchHeader, etag)
+	req.Body = data
+	resp, err := c.sendRequest(req)
+	if err != nil {
+		return "", err
+	}
+	return resp.Header.Get(fosp.ETagHeader), nil
+}
+
+// WriteIfNoneMatch stores the content of data as the attachment of the object at u, unless the
+// attachment already has the given digest. In that case an error with status fosp.StatusPreconditionFailed
+// is returned. The digest "*" only writes the attachment if the object does not have one yet.
+func (c *Client) WriteIfNoneMatch(u *url.URL, digest string, data io.Reader) error {
+	req := fosp.NewRequest(fosp.WRITE, u)
+	req.Header.Set(fosp.IfNoneMatchHeader, digest)
+	req.Body = data
+	_, err := c.sendRequest(req)
+	return err
+}
@@ -0,0 +1,84 @@
+// Copyright (C) 2015 Felix Maurer
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package fospclient
+
+import (
+	"errors"
+	"fmt"
+	"github.com/maufl/go-fosp/fosp"
+	"io/ioutil"
+	"net/textproto"
+	"net/url"
+)
+
+// ErrDigestMismatch is returned when the data of an attachment does not match the digest the server sent for it.
+var ErrDigestMismatch = errors.New("attachment does not match its digest")
+
+// ErrScramUnavailable is returned by Authenticate when the server does not offer SCRAM-SHA-256 and PLAIN is not allowed.
+var ErrScramUnavailable = errors.New("server does not offer SCRAM-SHA-256 authentication")
+
+// StatusError is returned when the server answered a request with a FAILED response.
+type StatusError struct {
+	Method string
+	URL    *url.URL
+	// Code is the status code of the response, e.g. fosp.StatusNotFound.
+	Code uint
+	// Message is the body of the response, if the server sent one.
+	Message string
+	// Header contains the headers of the response, e.g. the Offset at which a resumable upload has to continue.
+	Header textproto.MIMEHeader
+}
+
+func newStatusError(method string, u *url.URL, resp *fosp.Response) *StatusError {
+	err := &StatusError{Method: method, URL: u, Code: resp.Code, Header: resp.Header}
+	if resp.Body != nil {
+		if body, readErr := ioutil.ReadAll(resp.Body); readErr == nil {
+			err.Message = string(body)
+		}
+	}
+	return err
+}
+
+func (e *StatusError) Error() string {
+	msg := fmt.Sprintf("%s %s failed with status %d", e.Method, e.URL, e.Code)
+	if e.Message != "" {
+		msg += ": " + e.Message
+	}
+	return msg
+}
+
+// StatusCode returns the status code of a *StatusError and 0 for all other errors.
+func StatusCode(err error) uint {
+	if statusErr, ok := err.(*StatusError); ok {
+		return statusErr.Code
+	}
+	return 0
+}
+
+// IsNotFound reports whether err is a FAILED response with status fosp.StatusNotFound.
+func IsNotFound(err error) bool {
+	return StatusCode(err) == fosp.StatusNotFound
+}
+
+// IsForbidden reports whether err is a FAILED response with status fosp.StatusForbidden.
+func IsForbidden(err error) bool {
+	return StatusCode(err) == fosp.StatusForbidden
+}
+
+// IsPreconditionFailed reports whether err is a FAILED response with status fosp.StatusPreconditionFailed.
+func IsPreconditionFailed(err error) bool {
+	return StatusCode(err) == fosp.StatusPreconditionFailed
+}
@@ -0,0 +1,55 @@
+// Copyright (C) 2015 Felix Maurer
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package fospclient
+
+import (
+	"encoding/json"
+	"github.com/maufl/go-fosp/fosp"
+	"net/url"
+	"strconv"
+)
+
+// Notifications returns the notifications that the server queued for user after the sequence number since.
+// The server replays the queue after authentication, Notifications can be used to catch up at any time.
+func (c *Client) Notifications(user string, since uint64) ([]*fosp.NotificationRecord, error) {
+	u, err := url.Parse("fosp://" + user + "/.notifications")
+	if err != nil {
+		return nil, err
+	}
+	req := fosp.NewRequest(fosp.GET, u)
+	if since > 0 {
+		req.Header.Set(fosp.SinceHeader, strconv.FormatUint(since, 10))
+	}
+	resp, err := c.sendRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	var records []*fosp.NotificationRecord
+	if err := json.NewDecoder(resp.Body).Decode(&records); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// Acknowledge removes the notifications up to and including the sequence number seq from the queue of user.
+func (c *Client) Acknowledge(user string, seq uint64) error {
+	u, err := url.Parse("fosp://" + user + "/.notifications/" + strconv.FormatUint(seq, 10))
+	if err != nil {
+		return err
+	}
+	_, err = c.send(fosp.DELETE, u, nil)
+	return err
+}
@@ -0,0 +1,55 @@
+// Copyright (C) 2015 Felix Maurer
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package fospclient
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/maufl/go-fosp/fosp"
+	"net/url"
+)
+
+// Subscribe asks the server to send notifications about the events on the object at u and, up to depth levels,
+// its descendants to this connection, a depth of -1 includes all descendants. Without events, all events are
+// subscribed. The subscription is not stored in the object and ends when the connection closes.
+// Notifications are delivered to the message handler of the connection.
+func (c *Client) Subscribe(u *url.URL, depth int, events ...string) error {
+	return c.subscribe(u, fosp.SubscriptionEntry{Depth: depth, Events: events})
+}
+
+// SubscribeDeltas subscribes like Subscribe, but asks for UPDATED notifications that carry the applied patch
+// instead of the whole object where possible, see fosp.Notification.IsDelta.
+func (c *Client) SubscribeDeltas(u *url.URL, depth int, events ...string) error {
+	return c.subscribe(u, fosp.SubscriptionEntry{Depth: depth, Events: events, Delta: true})
+}
+
+func (c *Client) subscribe(u *url.URL, entry fosp.SubscriptionEntry) error {
+	if len(entry.Events) == 0 {
+		entry.Events = []string{fosp.CREATED, fosp.UPDATED, fosp.DELETED}
+	}
+	body, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	_, err = c.send(fosp.SUBSCRIBE, u, bytes.NewBuffer(body))
+	return err
+}
+
+// Unsubscribe ends the subscription of this connection to the object at u.
+func (c *Client) Unsubscribe(u *url.URL) error {
+	_, err := c.send(fosp.UNSUBSCRIBE, u, nil)
+	return err
+}
@@ -0,0 +1,79 @@
+// Copyright (C) 2015 Felix Maurer
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package fospclient
+
+import (
+	"github.com/maufl/go-fosp/fosp"
+	"io"
+	"net/url"
+	"strconv"
+)
+
+// Upload is a resumable upload of an attachment.
+// The server remembers how much data it received for the upload, so an interrupted
+// upload can be continued with the same Upload value, e.g. after reconnecting.
+type Upload struct {
+	URL *url.URL
+	// ID identifies the upload on the server.
+	ID string
+	// Offset is the amount of data the server confirmed to have received.
+	Offset int64
+}
+
+// NewUpload starts a new resumable upload for the attachment of the object at u.
+func NewUpload(u *url.URL) (*Upload, error) {
+	id, err := fosp.ScramNonce(18)
+	if err != nil {
+		return nil, err
+	}
+	return &Upload{URL: u, ID: id}, nil
+}
+
+// Upload sends data to the server, continuing the upload at the offset the server knows.
+// If the server received a different amount of data than up.Offset, e.g. because a previous
+// attempt was interrupted after the server stored part of it, the upload is continued once
+// from the offset the server reported.
+func (c *Client) Upload(up *Upload, data io.ReadSeeker) error {
+	err := c.uploadFrom(up, data)
+	if StatusCode(err) != fosp.StatusConflict {
+		return err
+	}
+	offset, parseErr := strconv.ParseInt(err.(*StatusError).Header.Get(fosp.OffsetHeader), 10, 64)
+	if parseErr != nil {
+		return err
+	}
+	up.Offset = offset
+	return c.uploadFrom(up, data)
+}
+
+func (c *Client) uploadFrom(up *Upload, data io.ReadSeeker) error {
+	if _, err := data.Seek(up.Offset, io.SeekStart); err != nil {
+		return err
+	}
+	req := fosp.NewRequest(fosp.WRITE, up.URL)
+	req.Header.Set(fosp.OffsetHeader, strconv.FormatInt(up.Offset, 10))
+	req.Header.Set(fosp.UploadHeader, up.ID)
+	// Hide the Close method of data, the stream would close it after the request was sent.
+	req.Body = struct{ io.Reader }{data}
+	resp, err := c.sendRequest(req)
+	if err != nil {
+		return err
+	}
+	if up.Offset, err = strconv.ParseInt(resp.Header.Get(fosp.OffsetHeader), 10, 64); err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+// Copyright (C) 2015 Felix Maurer
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package fospclient
+
+import (
+	"github.com/maufl/go-fosp/fosp"
+	"io"
+)
+
+// verifyingReader computes the digest of an attachment while it is read and compares it with
+// the digest the server sent when the end of the attachment is reached.
+type verifyingReader struct {
+	io.ReadCloser
+	digester *fosp.Digester
+	digest   string
+}
+
+func (r *verifyingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.digester.Write(p[:n])
+	if err == io.EOF && r.digester.Digest() != r.digest {
+		return n, ErrDigestMismatch
+	}
+	return n, err
+}
@@ -0,0 +1,223 @@
+// Copyright (C) 2015 Felix Maurer
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package fospws
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"github.com/maufl/go-fosp/fosp"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// ErrAuthenticationFailed is returned when the remote side rejected the credentials.
+var ErrAuthenticationFailed = errors.New("authentication failed")
+
+// ErrInvalidServerSignature is returned when the server could not prove that it knows the SCRAM credentials.
+var ErrInvalidServerSignature = errors.New("invalid server signature")
+
+type saslObject struct {
+	Mechanism       string  `json:"mechanism,omitempty"`
+	InitialResponse *string `json:"initial-response,omitempty"`
+	Challenge       string  `json:"challende,omitempty"`
+	Response        string  `json:"response,omitempty"`
+	Outcome         string  `json:"outcome,omitempty"`
+	AdditionalData  *string `json:"additional-data,omitempty"`
+}
+
+type authenticationObject struct {
+	Sasl saslObject `json:"sasl"`
+}
+
+// sendSasl sends an AUTH request with the given SASL content and decodes the SASL content of the response.
+func (c *Connection) sendSasl(sasl saslObject) (*fosp.Response, *saslObject, error) {
+	encoded, err := json.Marshal(authenticationObject{Sasl: sasl})
+	if err != nil {
+		return nil, nil, err
+	}
+	req := fosp.NewRequest(fosp.AUTH, nil)
+	req.Body = bytes.NewBuffer(encoded)
+	resp, err := c.SendRequest(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.Status != fosp.SUCCEEDED {
+		return resp, nil, ErrAuthenticationFailed
+	}
+	result := &authenticationObject{}
+	if resp.Body != nil {
+		if err := json.NewDecoder(resp.Body).Decode(result); err != nil && resp.Code == fosp.StatusAdditionalDataNeeded {
+			return resp, nil, err
+		}
+	}
+	return resp, &result.Sasl, nil
+}
+
+// AuthenticatePlain authenticates the connection using the PLAIN SASL mechanism.
+// The password is sent in cleartext, so this should only be used on encrypted connections.
+func (c *Connection) AuthenticatePlain(user, password string) error {
+	initialResponse := strings.Join([]string{"", user, password}, "\x00")
+	_, _, err := c.sendSasl(saslObject{Mechanism: "PLAIN", InitialResponse: &initialResponse})
+	return err
+}
+
+// AuthenticateScram authenticates the connection using the SCRAM-SHA-256 SASL mechanism.
+// The password never leaves the client and the server has to prove that it knows the credentials of the user.
+func (c *Connection) AuthenticateScram(user, password string) error {
+	clientNonce, err := fosp.ScramNonce(18)
+	if err != nil {
+		return err
+	}
+	gs2Header := "n,,"
+	clientFirstBare := "n=" + fosp.ScramEscapeName(user) + ",r=" + clientNonce
+	clientFirst := gs2Header + clientFirstBare
+	resp, sasl, err := c.sendSasl(saslObject{Mechanism: fosp.ScramMechanism, InitialResponse: &clientFirst})
+	if err != nil {
+		return err
+	}
+	if resp.Code != fosp.StatusAdditionalDataNeeded {
+		return ErrAuthenticationFailed
+	}
+	serverFirst := sasl.Challenge
+	attributes, err := fosp.ParseScramMessage(serverFirst)
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(attributes["r"], clientNonce) {
+		return ErrAuthenticationFailed
+	}
+	salt, err := base64.StdEncoding.DecodeString(attributes["s"])
+	if err != nil {
+		return err
+	}
+	iterations, err := strconv.Atoi(attributes["i"])
+	if err != nil || iterations < 1 {
+		return ErrAuthenticationFailed
+	}
+	saltedPassword := fosp.ScramSaltedPassword(password, salt, iterations)
+	withoutProof := "c=" + base64.StdEncoding.EncodeToString([]byte(gs2Header)) + ",r=" + attributes["r"]
+	authMessage := clientFirstBare + "," + serverFirst + "," + withoutProof
+	proof := base64.StdEncoding.EncodeToString(fosp.ScramClientProof(saltedPassword, authMessage))
+	resp, sasl, err = c.sendSasl(saslObject{Response: withoutProof + ",p=" + proof})
+	if err != nil {
+		return err
+	}
+	if sasl.AdditionalData == nil {
+		return ErrInvalidServerSignature
+	}
+	final, err := fosp.ParseScramMessage(*sasl.AdditionalData)
+	if err != nil {
+		return ErrInvalidServerSignature
+	}
+	signature, err := base64.StdEncoding.DecodeString(final["v"])
+	if err != nil || !hmac.Equal(signature, fosp.ScramServerSignature(saltedPassword, authMessage)) {
+		return ErrInvalidServerSignature
+	}
+	return nil
+}
+
+// AuthenticateToken authenticates the connection with a session token that was issued by RequestToken.
+func (c *Connection) AuthenticateToken(user, token string) error {
+	initialResponse := user + "\x00" + token
+	_, _, err := c.sendSasl(saslObject{Mechanism: "TOKEN", InitialResponse: &initialResponse})
+	return err
+}
+
+// RequestToken asks the server to issue a new session token for the authenticated user.
+// The token can be used with AuthenticateToken instead of the password and revoked by deleting it.
+func (c *Connection) RequestToken(user, label string) (string, error) {
+	u, err := url.Parse("fosp://" + user + "/.tokens")
+	if err != nil {
+		return "", err
+	}
+	body, err := json.Marshal(map[string]string{"label": label})
+	if err != nil {
+		return "", err
+	}
+	req := fosp.NewRequest(fosp.CREATE, u)
+	req.Body = bytes.NewBuffer(body)
+	resp, err := c.SendRequest(req)
+	if err != nil {
+		return "", err
+	}
+	if resp.Status != fosp.SUCCEEDED {
+		return "", ErrRequestFailed
+	}
+	result := struct {
+		Token string `json:"token"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", err
+	}
+	return result.Token, nil
+}
+
+// RevokeToken deletes a session token of user that was issued by RequestToken.
+func (c *Connection) RevokeToken(user, token string) error {
+	id := strings.SplitN(token, ".", 2)[0]
+	u, err := url.Parse("fosp://" + user + "/.tokens/" + id)
+	if err != nil {
+		return err
+	}
+	resp, err := c.SendRequest(fosp.NewRequest(fosp.DELETE, u))
+	if err != nil {
+		return err
+	}
+	if resp.Status != fosp.SUCCEEDED {
+		return ErrRequestFailed
+	}
+	return nil
+}
+
+// AuthenticateServer proves to the remote server that this connection belongs to the server of localDomain.
+// The remote server has to prove in turn that it is responsible for remoteDomain by signing the exchange
+// with the private key matching remoteKey.
+func (c *Connection) AuthenticateServer(localDomain, remoteDomain string, key ed25519.PrivateKey, remoteKey ed25519.PublicKey) error {
+	clientNonce, err := fosp.ScramNonce(18)
+	if err != nil {
+		return err
+	}
+	initialResponse := "d=" + localDomain + ",r=" + clientNonce
+	resp, sasl, err := c.sendSasl(saslObject{Mechanism: fosp.ServerMechanism, InitialResponse: &initialResponse})
+	if err != nil {
+		return err
+	}
+	if resp.Code != fosp.StatusAdditionalDataNeeded {
+		return ErrAuthenticationFailed
+	}
+	challenge, err := fosp.ParseScramMessage(sasl.Challenge)
+	if err != nil || challenge["d"] != remoteDomain || challenge["r"] == "" {
+		return ErrAuthenticationFailed
+	}
+	exchange := fosp.ServerAuthentication{ClientDomain: localDomain, ServerDomain: remoteDomain, ClientNonce: clientNonce, ServerNonce: challenge["r"]}
+	_, sasl, err = c.sendSasl(saslObject{Response: "s=" + exchange.SignClient(key)})
+	if err != nil {
+		return err
+	}
+	if sasl.AdditionalData == nil {
+		return ErrInvalidServerSignature
+	}
+	final, err := fosp.ParseScramMessage(*sasl.AdditionalData)
+	if err != nil || !exchange.VerifyServer(remoteKey, final["s"]) {
+		return ErrInvalidServerSignature
+	}
+	return nil
+}
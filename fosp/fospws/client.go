@@ -0,0 +1,317 @@
+// Copyright (C) 2015 Felix Maurer
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package fospws
+
+import (
+	"context"
+	"errors"
+	"github.com/maufl/go-fosp/fosp"
+	"sync"
+	"time"
+)
+
+// ErrNotConnected is returned for requests that are sent while the Client is not connected.
+var ErrNotConnected = errors.New("not connected")
+
+// ErrClientClosed is returned for requests that are sent after the Client was closed.
+var ErrClientClosed = errors.New("client closed")
+
+// ConnectionState describes the state of the connection of a Client.
+type ConnectionState int
+
+const (
+	// Disconnected means there is no connection and the Client waits before it reconnects.
+	Disconnected ConnectionState = iota
+	// Connecting means the Client is opening a new connection.
+	Connecting
+	// Connected means the connection is open and, if an Authenticator is set, authenticated.
+	Connected
+	// Closed means the Client was closed and will not reconnect anymore.
+	Closed
+)
+
+func (s ConnectionState) String() string {
+	switch s {
+	case Disconnected:
+		return "disconnected"
+	case Connecting:
+		return "connecting"
+	case Connected:
+		return "connected"
+	case Closed:
+		return "closed"
+	default:
+		return "unknown"
+	}
+}
+
+// StateEvent is emitted by a Client whenever the state of its connection changes.
+// Err is the reason for entering the Disconnected state, if there is one.
+type StateEvent struct {
+	State ConnectionState
+	Err   error
+}
+
+// Authenticator authenticates a freshly opened connection, e.g. by calling AuthenticateScram.
+type Authenticator func(*Connection) error
+
+// Client keeps a connection to a FOSP server open.
+// When the connection breaks, requests that wait for a response fail immediately with ErrConnectionClosed,
+// and the Client reconnects with exponential backoff and authenticates the new connection again.
+type Client struct {
+	remote        string
+	resolver      Resolver
+	authenticator Authenticator
+	handler       MessageHandler
+
+	// MinBackoff is the time the Client waits before the first reconnection attempt.
+	MinBackoff time.Duration
+	// MaxBackoff is the maximum time the Client waits between two reconnection attempts.
+	MaxBackoff time.Duration
+
+	lock       sync.RWMutex
+	connection *Connection
+	state      ConnectionState
+	listeners  []chan StateEvent
+	closed     chan struct{}
+}
+
+// NewClient creates a Client for the FOSP server of remote, which is resolved with the DefaultResolver.
+// The Client does not connect before Connect is called.
+func NewClient(remote string) *Client {
+	return &Client{
+		remote:     remote,
+		resolver:   DefaultResolver,
+		MinBackoff: 500 * time.Millisecond,
+		MaxBackoff: time.Minute,
+		state:      Disconnected,
+		closed:     make(chan struct{}),
+	}
+}
+
+// SetResolver sets the Resolver that is used to find the endpoints of the server.
+func (c *Client) SetResolver(resolver Resolver) {
+	c.lock.Lock()
+	c.resolver = resolver
+	c.lock.Unlock()
+}
+
+// SetAuthenticator sets the function that authenticates every new connection.
+// If the Client is connected, the current connection is authenticated right away.
+func (c *Client) SetAuthenticator(authenticator Authenticator) error {
+	c.lock.Lock()
+	c.authenticator = authenticator
+	connection := c.connection
+	c.lock.Unlock()
+	if connection == nil || authenticator == nil {
+		return nil
+	}
+	return authenticator(connection)
+}
+
+// RegisterMessageHandler sets the handler for messages that are not responses, i.e. notifications.
+// The handler is kept when the Client reconnects.
+func (c *Client) RegisterMessageHandler(handler MessageHandler) {
+	c.lock.Lock()
+	c.handler = handler
+	if c.connection != nil {
+		c.connection.RegisterMessageHandler(handler)
+	}
+	c.lock.Unlock()
+}
+
+// Subscribe returns a channel on which all following state changes of the Client are emitted.
+// Events are dropped if the channel is not drained fast enough.
+// The channel is closed when the Client is closed.
+func (c *Client) Subscribe() <-chan StateEvent {
+	events := make(chan StateEvent, 16)
+	c.lock.Lock()
+	if c.state == Closed {
+		close(events)
+	} else {
+		c.listeners = append(c.listeners, events)
+	}
+	c.lock.Unlock()
+	return events
+}
+
+// State returns the current state of the connection.
+func (c *Client) State() ConnectionState {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.state
+}
+
+// Connection returns the current connection or nil if the Client is not connected.
+func (c *Client) Connection() *Connection {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.connection
+}
+
+// Connect opens and authenticates the first connection.
+// If this fails the error is returned and the Client does not retry,
+// once connected the Client reconnects on its own until it is closed.
+func (c *Client) Connect() error {
+	connection, err := c.dial()
+	if err != nil {
+		c.setState(Disconnected, err)
+		return err
+	}
+	go c.supervise(connection)
+	return nil
+}
+
+// SendRequest sends the request on the current connection.
+// It fails immediately with ErrNotConnected if the Client is reconnecting.
+func (c *Client) SendRequest(req *fosp.Request) (*fosp.Response, error) {
+	c.lock.RLock()
+	connection, state := c.connection, c.state
+	c.lock.RUnlock()
+	if state == Closed {
+		return nil, ErrClientClosed
+	}
+	if connection == nil {
+		return nil, ErrNotConnected
+	}
+	return connection.SendRequest(req)
+}
+
+// SendRequestContext sends the request on the current connection and waits until the context is done.
+// It fails immediately with ErrNotConnected if the Client is reconnecting.
+func (c *Client) SendRequestContext(ctx context.Context, req *fosp.Request) (*fosp.Response, error) {
+	c.lock.RLock()
+	connection, state := c.connection, c.state
+	c.lock.RUnlock()
+	if state == Closed {
+		return nil, ErrClientClosed
+	}
+	if connection == nil {
+		return nil, ErrNotConnected
+	}
+	return connection.SendRequestContext(ctx, req)
+}
+
+// Close closes the connection and stops reconnecting.
+func (c *Client) Close() {
+	c.lock.Lock()
+	if c.state == Closed {
+		c.lock.Unlock()
+		return
+	}
+	close(c.closed)
+	connection := c.connection
+	c.connection = nil
+	c.changeState(Closed, nil)
+	c.lock.Unlock()
+	if connection != nil {
+		connection.Close()
+	}
+}
+
+// dial opens a new connection and authenticates it.
+func (c *Client) dial() (*Connection, error) {
+	c.setState(Connecting, nil)
+	c.lock.RLock()
+	resolver, authenticator, handler := c.resolver, c.authenticator, c.handler
+	c.lock.RUnlock()
+	ws, err := DialWebSocket(resolver, c.remote)
+	if err != nil {
+		return nil, err
+	}
+	connection := NewConnection(ws)
+	if handler != nil {
+		connection.RegisterMessageHandler(handler)
+	}
+	if authenticator != nil {
+		if err := authenticator(connection); err != nil {
+			connection.Close()
+			return nil, err
+		}
+	}
+	c.lock.Lock()
+	if c.state == Closed {
+		c.lock.Unlock()
+		connection.Close()
+		return nil, ErrClientClosed
+	}
+	c.connection = connection
+	c.lock.Unlock()
+	c.setState(Connected, nil)
+	return connection, nil
+}
+
+// supervise waits for the connection to break and reconnects until the Client is closed.
+func (c *Client) supervise(connection *Connection) {
+	for {
+		select {
+		case <-connection.Closed():
+		case <-c.closed:
+			return
+		}
+		c.lock.Lock()
+		c.connection = nil
+		c.lock.Unlock()
+		c.setState(Disconnected, ErrConnectionClosed)
+		backoff := c.MinBackoff
+		for {
+			select {
+			case <-time.After(backoff):
+			case <-c.closed:
+				return
+			}
+			var err error
+			if connection, err = c.dial(); err == nil {
+				break
+			} else if err == ErrClientClosed {
+				return
+			}
+			connLog.Warning("Reconnecting to %s failed :: %s", c.remote, err)
+			c.setState(Disconnected, err)
+			if backoff *= 2; backoff > c.MaxBackoff {
+				backoff = c.MaxBackoff
+			}
+		}
+	}
+}
+
+// setState changes the state of the Client and notifies all subscribers.
+// Once the Client is closed the state does not change anymore.
+func (c *Client) setState(state ConnectionState, err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.state != Closed {
+		c.changeState(state, err)
+	}
+}
+
+// changeState must be called with the lock held.
+func (c *Client) changeState(state ConnectionState, err error) {
+	c.state = state
+	event := StateEvent{State: state, Err: err}
+	for _, listener := range c.listeners {
+		select {
+		case listener <- event:
+		default:
+		}
+	}
+	if state == Closed {
+		for _, listener := range c.listeners {
+			close(listener)
+		}
+		c.listeners = nil
+	}
+}
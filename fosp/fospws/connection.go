@@ -17,11 +17,12 @@ package fospws
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"errors"
 	"github.com/gorilla/websocket"
 	"github.com/maufl/go-fosp/fosp"
 	"github.com/op/go-logging"
-	"net/http"
 	"runtime"
 	"sync"
 	"sync/atomic"
@@ -34,6 +35,12 @@ var ErrChanError = errors.New("channel error when recieving response")
 // ErrRequestTimeout is returned when a response should be read from a channel but the timeout is reached.
 var ErrRequestTimeout = errors.New("request timed out")
 
+// ErrRequestFailed is returned when the remote side answered a request with a FAILED response.
+var ErrRequestFailed = errors.New("request failed")
+
+// ErrConnectionClosed is returned for requests that can not be answered because the connection was closed.
+var ErrConnectionClosed = errors.New("connection closed")
+
 // MessageHandler is the interface of objects that know how to process Messages.
 type MessageHandler interface {
 	HandleMessage(*NumberedMessage)
@@ -56,8 +63,16 @@ type Connection struct {
 	pendingRequests     map[uint64]chan *fosp.Response
 	pendingRequestsLock sync.RWMutex
 
-	out            chan *NumberedMessage
-	messageHandler MessageHandler
+	out             chan *NumberedMessage
+	frames          chan []byte
+	outStreams      uint64
+	inStreams       map[uint64]*streamBuffer
+	inStreamsBudget streamBudget
+	messageHandler  MessageHandler
+	handlerLock     sync.RWMutex
+
+	closed    chan struct{}
+	closeOnce sync.Once
 
 	RequestTimeout time.Duration
 }
@@ -67,17 +82,25 @@ func NewConnection(ws *websocket.Conn) *Connection {
 	if ws == nil {
 		panic("Cannot initialize fosp connection without websocket")
 	}
-	con := &Connection{ws: ws, pendingRequests: make(map[uint64]chan *fosp.Response), out: make(chan *NumberedMessage), RequestTimeout: time.Second * 15}
+	con := &Connection{
+		ws:              ws,
+		pendingRequests: make(map[uint64]chan *fosp.Response),
+		out:             make(chan *NumberedMessage),
+		frames:          make(chan []byte),
+		inStreams:       make(map[uint64]*streamBuffer),
+		closed:          make(chan struct{}),
+		RequestTimeout:  time.Second * 15,
+	}
 	go con.listen()
 	go con.talk()
 	return con
 }
 
 // OpenConnection creates a new FOSP connection to the remoteDomain.
+// The endpoint of the remoteDomain is found with the DefaultResolver, remoteDomain may also be a ws:// or wss:// URL.
 // It will open a WebSocket connection to this remoteDomain or return an error.
 func OpenConnection(remoteDomain string) (*Connection, error) {
-	url := "ws://" + remoteDomain + ":1337"
-	ws, _, err := websocket.DefaultDialer.Dial(url, http.Header{})
+	ws, err := DialWebSocket(DefaultResolver, remoteDomain)
 	if err != nil {
 		return nil, err
 	}
@@ -87,7 +110,9 @@ func OpenConnection(remoteDomain string) (*Connection, error) {
 
 // RegisterMessageHandler accepts a function that should be called when a Message is received.
 func (c *Connection) RegisterMessageHandler(handler MessageHandler) {
+	c.handlerLock.Lock()
 	c.messageHandler = handler
+	c.handlerLock.Unlock()
 }
 
 func (c *Connection) panicRecover() {
@@ -101,6 +126,7 @@ func (c *Connection) panicRecover() {
 
 func (c *Connection) listen() {
 	defer c.panicRecover()
+	defer c.closeStreams()
 	for {
 		_, message, err := c.ws.ReadMessage()
 		if err != nil {
@@ -108,19 +134,27 @@ func (c *Connection) listen() {
 			c.Close()
 			break
 		}
-		reader := bytes.NewBuffer(message)
-		if msg, seq, err := parseMessage(reader); err != nil {
+		if c.handleStreamFrame(message) {
+			continue
+		}
+		msg, seq, err := parseMessage(bytes.NewBuffer(message))
+		if err == nil {
+			err = c.openStream(msg)
+		}
+		if err != nil {
 			connLog.Error("Error while parsing message :: %s", err.Error())
 			c.Close()
 			break
+		}
+		connLog.Debug("Received new message")
+		c.handleResponse(msg, seq)
+		c.handlerLock.RLock()
+		handler := c.messageHandler
+		c.handlerLock.RUnlock()
+		if handler != nil {
+			go handler.HandleMessage(&NumberedMessage{Message: msg, Seq: seq})
 		} else {
-			connLog.Debug("Received new message")
-			c.handleResponse(msg, seq)
-			if c.messageHandler != nil {
-				go c.messageHandler.HandleMessage(&NumberedMessage{Message: msg, Seq: seq})
-			} else {
-				connLog.Warning("No message handler registered")
-			}
+			connLog.Warning("No message handler registered")
 		}
 	}
 }
@@ -128,89 +162,200 @@ func (c *Connection) listen() {
 func (c *Connection) talk() {
 	defer c.panicRecover()
 	for {
-		if oMsg, ok := <-c.out; ok {
-			if request, ok := oMsg.Message.(*fosp.Request); ok && request.Method == fosp.WRITE {
-				c.ws.WriteMessage(websocket.BinaryMessage, serializeMessage(request, oMsg.Seq))
+		var err error
+		select {
+		case oMsg := <-c.out:
+			if isStreamed(oMsg) {
+				err = c.sendStreamed(oMsg)
+			} else if request, ok := oMsg.Message.(*fosp.Request); ok && request.Method == fosp.WRITE {
+				err = c.ws.WriteMessage(websocket.BinaryMessage, serializeMessage(request, oMsg.Seq))
 			} else if oMsg.BinaryBody {
-				c.ws.WriteMessage(websocket.BinaryMessage, serializeMessage(oMsg.Message, oMsg.Seq))
+				err = c.ws.WriteMessage(websocket.BinaryMessage, serializeMessage(oMsg.Message, oMsg.Seq))
 			} else {
-				c.ws.WriteMessage(websocket.TextMessage, serializeMessage(oMsg.Message, oMsg.Seq))
+				err = c.ws.WriteMessage(websocket.TextMessage, serializeMessage(oMsg.Message, oMsg.Seq))
 			}
-		} else {
-			connLog.Critical("Output channel of connection broken!")
+		case frame := <-c.frames:
+			err = c.ws.WriteMessage(websocket.BinaryMessage, frame)
+		case <-c.closed:
+			return
+		}
+		if err != nil {
+			connLog.Error("Error while sending WebSocket message :: %s", err)
 			c.Close()
-			break
+			return
 		}
 	}
 }
 
 // Close this connection and clean up.
+// Requests that are still waiting for a response fail with ErrConnectionClosed.
+// Close may be called multiple times.
 // TODO: Websocket should send close message before tearing down the connection
 func (c *Connection) Close() {
-	c.ws.Close()
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.ws.Close()
+	})
+}
+
+// Closed returns a channel that is closed when the connection is closed, either locally or by the remote side.
+func (c *Connection) Closed() <-chan struct{} {
+	return c.closed
 }
 
 // Send queues an Message to be send.
+// The message is dropped if the connection is closed.
 func (c *Connection) Send(msg fosp.Message, seq ...uint64) {
 	oMsg := &NumberedMessage{Message: msg}
 	if len(seq) > 0 {
 		oMsg.Seq = seq[0]
 	}
-	c.out <- oMsg
+	c.SendNumberedMessage(oMsg)
 }
 
 func (c *Connection) SendNumberedMessage(msg *NumberedMessage) {
-	c.out <- msg
+	select {
+	case c.out <- msg:
+	case <-c.closed:
+		connLog.Warning("Dropping message because the connection is closed")
+	}
 }
 
 // SendRequest will send a Request and block until a Response is returned or timedout.
+// It waits at most RequestTimeout, use SendRequestContext to choose the deadline per request.
+// For a request with a streamed body the timeout starts when the body was sent completely,
+// so that sending a large attachment can take longer than RequestTimeout.
 func (c *Connection) SendRequest(req *fosp.Request) (*fosp.Response, error) {
+	resp, err := c.sendRequest(context.Background(), req, c.RequestTimeout)
+	if err == context.DeadlineExceeded {
+		return nil, ErrRequestTimeout
+	}
+	return resp, err
+}
+
+// SendRequestContext will send a Request and block until a Response is returned or the context is done.
+// The deadline of the context is announced to the remote side in the Timeout header.
+// If the context is done first, the error of the context is returned and a late response is discarded.
+// A streamed body that is still being sent is aborted then.
+func (c *Connection) SendRequestContext(ctx context.Context, req *fosp.Request) (*fosp.Response, error) {
+	return c.sendRequest(ctx, req, 0)
+}
+
+// sendRequest sends a Request and waits for the Response until ctx is done.
+// If timeout is not 0, it also gives up with context.DeadlineExceeded when no Response arrived within timeout
+// after the request was sent completely.
+func (c *Connection) sendRequest(ctx context.Context, req *fosp.Request, timeout time.Duration) (*fosp.Response, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if deadline, ok := ctx.Deadline(); ok {
+		req.SetTimeout(time.Until(deadline))
+	}
+	// The timeout starts when the request was sent completely, a streamed body closes sent after its last frame was queued.
+	var sent chan struct{}
+	if req.Method == fosp.WRITE && req.Body != nil {
+		sent = make(chan struct{})
+		req.Body = &requestBody{reader: req.Body, abandoned: ctx.Done(), sent: sent}
+	} else if timeout > 0 {
+		req.SetTimeout(timeout)
+	}
+	var expired <-chan time.Time
+	stopTimeout := func() bool { return false }
+	defer func() { stopTimeout() }()
+	startTimeout := func() {
+		if timeout > 0 {
+			timer := time.NewTimer(timeout)
+			expired, stopTimeout = timer.C, timer.Stop
+		}
+	}
+	if sent == nil {
+		startTimeout()
+	}
+
 	seq := atomic.AddUint64(&c.currentSeq, uint64(1))
+	returnChan := make(chan *fosp.Response, 1)
 
 	c.pendingRequestsLock.Lock()
-	c.pendingRequests[seq] = make(chan *fosp.Response)
+	c.pendingRequests[seq] = returnChan
 	c.pendingRequestsLock.Unlock()
+	defer func() {
+		c.pendingRequestsLock.Lock()
+		delete(c.pendingRequests, seq)
+		c.pendingRequestsLock.Unlock()
+		// A response that arrived after the caller gave up must not block its stream.
+		select {
+		case resp := <-returnChan:
+			closeBody(resp.Body)
+		default:
+		}
+	}()
+
 	connLog.Info("Sending request: %s", req)
-	c.Send(req, seq)
-	var (
-		resp    *fosp.Response
-		ok      = false
-		timeout = false
-	)
-	c.pendingRequestsLock.RLock()
-	returnChan := c.pendingRequests[seq]
-	c.pendingRequestsLock.RUnlock()
 	select {
-	case resp, ok = <-returnChan:
-	case <-time.After(c.RequestTimeout):
-		timeout = true
+	case c.out <- &NumberedMessage{Message: req, Seq: seq}:
+	case <-expired:
+		return nil, context.DeadlineExceeded
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-c.closed:
+		return nil, ErrConnectionClosed
 	}
-	connLog.Debug("Received response or timeout")
-
-	c.pendingRequestsLock.Lock()
-	delete(c.pendingRequests, seq)
-	c.pendingRequestsLock.Unlock()
+	for {
+		select {
+		case resp, ok := <-returnChan:
+			if !ok {
+				connLog.Error("Something went wrong when reading channel")
+				return nil, ErrChanError
+			}
+			connLog.Info("Recieved response: %s", resp)
+			return resp, nil
+		case <-sent:
+			startTimeout()
+			sent = nil
+		case <-expired:
+			connLog.Warning("Request %s timed out", req)
+			return nil, context.DeadlineExceeded
+		case <-ctx.Done():
+			connLog.Warning("Request %s was abandoned :: %s", req, ctx.Err())
+			return nil, ctx.Err()
+		case <-c.closed:
+			connLog.Warning("Connection closed while waiting for response")
+			return nil, ErrConnectionClosed
+		}
+	}
+}
 
-	if !ok {
-		connLog.Error("Something went wrong when reading channel")
-		return nil, ErrChanError
+// Options sends an OPTIONS request and returns the capabilities announced by the remote side.
+// It can be used before authenticating to negotiate the features of the connection.
+func (c *Connection) Options() (*fosp.Capabilities, error) {
+	resp, err := c.SendRequest(fosp.NewRequest(fosp.OPTIONS, nil))
+	if err != nil {
+		return nil, err
 	}
-	if timeout {
-		connLog.Warning("Request timed out")
-		return nil, ErrRequestTimeout
+	if resp.Status != fosp.SUCCEEDED {
+		return nil, ErrRequestFailed
 	}
-	connLog.Info("Recieved response: %s", resp)
-	return resp, nil
+	caps := fosp.NewCapabilities()
+	if err := json.NewDecoder(resp.Body).Decode(caps); err != nil {
+		connLog.Error("Unable to decode capabilities :: %s", err)
+		return nil, err
+	}
+	return caps, nil
 }
 
 func (c *Connection) handleResponse(msg fosp.Message, seq uint64) {
 	if resp, ok := msg.(*fosp.Response); ok {
 		connLog.Info("Received new response: %s", resp)
 		c.pendingRequestsLock.RLock()
+		defer c.pendingRequestsLock.RUnlock()
 		if ch, ok := c.pendingRequests[uint64(seq)]; ok {
 			connLog.Debug("Returning response to caller")
-			ch <- resp
+			select {
+			case ch <- resp:
+				return
+			default:
+				connLog.Warning("Dropping duplicate response for request %d", seq)
+			}
 		}
-		c.pendingRequestsLock.RUnlock()
+		closeBody(resp.Body)
 	}
 }
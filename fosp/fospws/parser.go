@@ -70,7 +70,7 @@ func parseMessage(in io.Reader) (msg fosp.Message, seq uint64, err error) {
 	}
 	identifier := string(fragments[0])
 	switch identifier {
-	case fosp.OPTIONS, fosp.AUTH, fosp.GET, fosp.LIST, fosp.CREATE, fosp.PATCH, fosp.DELETE, fosp.READ, fosp.WRITE:
+	case fosp.OPTIONS, fosp.AUTH, fosp.GET, fosp.LIST, fosp.CREATE, fosp.PATCH, fosp.DELETE, fosp.READ, fosp.WRITE, fosp.SUBSCRIBE, fosp.UNSUBSCRIBE, fosp.CHANGES:
 		if len(fragments) != 3 {
 			err = errors.New("Request line does not consist of 3 parts")
 			return
@@ -0,0 +1,180 @@
+// Copyright (C) 2015 Felix Maurer
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package fospws
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/gorilla/websocket"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrNoEndpoint is returned when no endpoint could be found for a domain.
+var ErrNoEndpoint = errors.New("no endpoint found for domain")
+
+// WellKnownPath is the path below which a domain can publish the endpoints of its FOSP server.
+const WellKnownPath = "/.well-known/fosp"
+
+// Resolver finds the WebSocket endpoints of the FOSP server that is responsible for a domain.
+// The endpoints are URLs like wss://fosp.example.com:443 and are returned in the order they should be tried.
+// A Resolver returns an empty list and no error if it does not know the domain.
+type Resolver interface {
+	Resolve(domain string) ([]string, error)
+}
+
+// StaticResolver maps domains to a fixed list of endpoints, e.g. from a configuration file.
+type StaticResolver map[string][]string
+
+// Resolve returns the configured endpoints of the domain.
+func (r StaticResolver) Resolve(domain string) ([]string, error) {
+	return preferSecure(r[domain]), nil
+}
+
+// SRVResolver looks up the endpoints of a domain in DNS SRV records.
+// Records of the service "fosps" are used for wss:// endpoints and are preferred over records of the service "fosp"
+// which are used for ws:// endpoints, e.g. _fosps._tcp.example.com. 3600 IN SRV 0 0 443 fosp.example.com.
+type SRVResolver struct {
+	// LookupSRV is used to query the DNS, net.LookupSRV is used if it is nil.
+	LookupSRV func(service, proto, name string) (string, []*net.SRV, error)
+}
+
+// Resolve returns an endpoint for every SRV record of the domain.
+func (r SRVResolver) Resolve(domain string) ([]string, error) {
+	lookup := r.LookupSRV
+	if lookup == nil {
+		lookup = net.LookupSRV
+	}
+	endpoints := []string{}
+	for _, service := range []struct{ name, scheme string }{{"fosps", "wss"}, {"fosp", "ws"}} {
+		_, records, err := lookup(service.name, "tcp", domain)
+		if err != nil {
+			continue
+		}
+		for _, record := range records {
+			host := strings.TrimSuffix(record.Target, ".")
+			endpoints = append(endpoints, service.scheme+"://"+net.JoinHostPort(host, strconv.Itoa(int(record.Port))))
+		}
+	}
+	return endpoints, nil
+}
+
+// WellKnownResolver fetches the endpoints of a domain from https://<domain>/.well-known/fosp.
+// The document is a JSON object with a list of endpoints, e.g. {"endpoints": ["wss://fosp.example.com"]}.
+type WellKnownResolver struct {
+	// Client is used for the HTTP request, a client with a short timeout is used if it is nil.
+	Client *http.Client
+}
+
+// Resolve returns the endpoints that are published by the domain.
+func (r WellKnownResolver) Resolve(domain string) ([]string, error) {
+	client := r.Client
+	if client == nil {
+		client = &http.Client{Timeout: 5 * time.Second}
+	}
+	resp, err := client.Get("https://" + domain + WellKnownPath)
+	if err != nil {
+		return []string{}, nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return []string{}, nil
+	}
+	document := struct {
+		Endpoints []string `json:"endpoints"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&document); err != nil {
+		return nil, err
+	}
+	return preferSecure(document.Endpoints), nil
+}
+
+// FallbackResolver guesses the endpoints of a domain when nothing is published for it.
+// It tries wss:// on the default port before the traditional ws://<domain>:1337.
+type FallbackResolver struct{}
+
+// Resolve returns the guessed endpoints of the domain.
+func (FallbackResolver) Resolve(domain string) ([]string, error) {
+	return []string{"wss://" + domain, "ws://" + net.JoinHostPort(domain, "1337")}, nil
+}
+
+// ChainResolver asks multiple resolvers in order and returns the endpoints of the first one that knows the domain.
+type ChainResolver []Resolver
+
+// Resolve returns the endpoints of the first resolver that returns any.
+func (r ChainResolver) Resolve(domain string) ([]string, error) {
+	for _, resolver := range r {
+		endpoints, err := resolver.Resolve(domain)
+		if err != nil {
+			connLog.Warning("Error while resolving %s :: %s", domain, err)
+			continue
+		}
+		if len(endpoints) > 0 {
+			return endpoints, nil
+		}
+	}
+	return nil, ErrNoEndpoint
+}
+
+// DefaultResolver is used by OpenConnection.
+// It tries DNS SRV records, the well-known document and finally guesses the endpoints.
+var DefaultResolver Resolver = ChainResolver{SRVResolver{}, WellKnownResolver{}, FallbackResolver{}}
+
+// DialWebSocket resolves the endpoints of the domain and opens a WebSocket connection to the first one that is reachable.
+// If domain already is a ws:// or wss:// URL it is dialed directly.
+func DialWebSocket(resolver Resolver, domain string) (*websocket.Conn, error) {
+	return DialWebSocketContext(context.Background(), resolver, domain)
+}
+
+// DialWebSocketContext is like DialWebSocket but gives up when ctx ends.
+func DialWebSocketContext(ctx context.Context, resolver Resolver, domain string) (*websocket.Conn, error) {
+	var endpoints []string
+	if strings.HasPrefix(domain, "ws://") || strings.HasPrefix(domain, "wss://") {
+		endpoints = []string{domain}
+	} else {
+		var err error
+		if endpoints, err = resolver.Resolve(domain); err != nil {
+			return nil, err
+		}
+	}
+	err := ErrNoEndpoint
+	for _, endpoint := range endpoints {
+		var ws *websocket.Conn
+		connLog.Info("Opening WebSocket connection to %s", endpoint)
+		if ws, _, err = websocket.DefaultDialer.DialContext(ctx, endpoint, http.Header{}); err == nil {
+			return ws, nil
+		}
+		connLog.Warning("Could not connect to %s :: %s", endpoint, err)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+	}
+	return nil, err
+}
+
+// preferSecure orders wss:// endpoints before all others while keeping the order within each group.
+func preferSecure(endpoints []string) []string {
+	sorted := append([]string{}, endpoints...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return strings.HasPrefix(sorted[i], "wss://") && !strings.HasPrefix(sorted[j], "wss://")
+	})
+	return sorted
+}
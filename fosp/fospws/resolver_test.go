@@ -0,0 +1,65 @@
+// Copyright (C) 2015 Felix Maurer
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package fospws
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestStaticResolverPrefersSecureEndpoints(t *testing.T) {
+	resolver := StaticResolver{"example.com": {"ws://example.com:1337", "wss://fosp.example.com"}}
+	endpoints, _ := resolver.Resolve("example.com")
+	expected := []string{"wss://fosp.example.com", "ws://example.com:1337"}
+	if !reflect.DeepEqual(endpoints, expected) {
+		t.Errorf("Expected %v but got %v", expected, endpoints)
+	}
+	if endpoints, _ := resolver.Resolve("other.net"); len(endpoints) != 0 {
+		t.Errorf("Expected no endpoints for unknown domain but got %v", endpoints)
+	}
+}
+
+func TestSRVResolver(t *testing.T) {
+	resolver := SRVResolver{LookupSRV: func(service, proto, name string) (string, []*net.SRV, error) {
+		switch service {
+		case "fosps":
+			return "", []*net.SRV{{Target: "lb.example.com.", Port: 443}}, nil
+		case "fosp":
+			return "", []*net.SRV{{Target: "fosp.example.com.", Port: 1337}}, nil
+		}
+		return "", nil, errors.New("no such service")
+	}}
+	endpoints, err := resolver.Resolve("example.com")
+	expected := []string{"wss://lb.example.com:443", "ws://fosp.example.com:1337"}
+	if err != nil || !reflect.DeepEqual(endpoints, expected) {
+		t.Errorf("Expected %v but got %v, %v", expected, endpoints, err)
+	}
+}
+
+func TestChainResolver(t *testing.T) {
+	resolver := ChainResolver{StaticResolver{"example.com": {"wss://fosp.example.com"}}, FallbackResolver{}}
+	if endpoints, _ := resolver.Resolve("example.com"); !reflect.DeepEqual(endpoints, []string{"wss://fosp.example.com"}) {
+		t.Errorf("Expected configured endpoint but got %v", endpoints)
+	}
+	if endpoints, _ := resolver.Resolve("other.net"); !reflect.DeepEqual(endpoints, []string{"wss://other.net", "ws://other.net:1337"}) {
+		t.Errorf("Expected fallback endpoints but got %v", endpoints)
+	}
+	if _, err := (ChainResolver{}).Resolve("other.net"); err != ErrNoEndpoint {
+		t.Errorf("Expected ErrNoEndpoint but got %v", err)
+	}
+}
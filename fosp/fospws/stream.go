@@ -0,0 +1,362 @@
+// Copyright (C) 2015 Felix Maurer
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package fospws
+
+import (
+	"bytes"
+	"errors"
+	"github.com/gorilla/websocket"
+	"github.com/maufl/go-fosp/fosp"
+	"io"
+	"net/textproto"
+	"strconv"
+	"sync"
+)
+
+// StreamHeader is the header of a message whose body follows in separate chunk frames.
+// Its value identifies the stream among all streams the sender has open on the connection.
+//
+// Attachment bodies, i.e. the bodies of WRITE requests and of responses to READ requests, are never sent
+// in the frame of the message itself. Instead they are split into binary frames of at most StreamChunkSize bytes:
+//
+//	CHUNK <stream>\r\n<data>
+//	END <stream>\r\n
+//	ABORT <stream>\r\n
+//
+// END finishes the body, ABORT signals that the sender could not read the body to the end.
+// The receiver gets the message as soon as its first frame arrives and can read the body while it is transferred.
+// Chunks that were not read yet are buffered, so a slow receiver does not hold up the other messages on the connection.
+const StreamHeader = "Stream"
+
+// StreamChunkSize is the maximum number of body bytes that are sent in one chunk frame.
+const StreamChunkSize = 32 * 1024
+
+// StreamBufferSize is the maximum number of received body bytes a connection buffers for receivers that did not read
+// them yet. The stream whose chunk exceeds it fails with ErrStreamOverflow, so the peer can not make the connection
+// hold more data than that.
+const StreamBufferSize = 4 * 1024 * 1024
+
+// ErrStreamAborted is returned when reading a body whose sender aborted the transfer.
+var ErrStreamAborted = errors.New("stream aborted by sender")
+
+// ErrStreamOverflow is returned when reading a body whose chunks were discarded because the receiver did not keep up.
+var ErrStreamOverflow = errors.New("stream buffer overflow")
+
+var (
+	chunkFrame = []byte("CHUNK ")
+	endFrame   = []byte("END ")
+	abortFrame = []byte("ABORT ")
+)
+
+// isStreamed returns whether the body of the message is sent in chunk frames.
+func isStreamed(oMsg *NumberedMessage) bool {
+	switch msg := oMsg.Message.(type) {
+	case *fosp.Request:
+		return msg.Method == fosp.WRITE && msg.Body != nil
+	case *fosp.Response:
+		return oMsg.BinaryBody && msg.Body != nil
+	}
+	return false
+}
+
+// messageHeader returns the header and the body of a message.
+func messageHeader(msg fosp.Message) (textproto.MIMEHeader, io.Reader) {
+	switch msg := msg.(type) {
+	case *fosp.Request:
+		return msg.Header, msg.Body
+	case *fosp.Response:
+		return msg.Header, msg.Body
+	case *fosp.Notification:
+		return msg.Header, msg.Body
+	}
+	return nil, nil
+}
+
+// setMessageBody replaces the body of a message.
+func setMessageBody(msg fosp.Message, body io.Reader) {
+	switch msg := msg.(type) {
+	case *fosp.Request:
+		msg.Body = body
+	case *fosp.Response:
+		msg.Body = body
+	case *fosp.Notification:
+		msg.Body = body
+	}
+}
+
+// sendStreamed writes the first frame of a message with a streamed body and starts to send the body in the background.
+// It must only be called from the talk goroutine.
+func (c *Connection) sendStreamed(oMsg *NumberedMessage) error {
+	header, body := messageHeader(oMsg.Message)
+	c.outStreams++
+	id := c.outStreams
+	header.Set(StreamHeader, strconv.FormatUint(id, 10))
+	setMessageBody(oMsg.Message, nil)
+	head := serializeMessage(oMsg.Message, oMsg.Seq)
+	header.Del(StreamHeader)
+	if err := c.ws.WriteMessage(websocket.BinaryMessage, head); err != nil {
+		closeBody(body)
+		return err
+	}
+	go c.streamBody(id, body)
+	return nil
+}
+
+// streamBody reads the body in chunks and queues a frame for every chunk.
+func (c *Connection) streamBody(id uint64, body io.Reader) {
+	defer closeBody(body)
+	if request, ok := body.(*requestBody); ok {
+		defer close(request.sent)
+	}
+	prefix := strconv.FormatUint(id, 10) + "\r\n"
+	for {
+		buffer := make([]byte, len(chunkFrame)+len(prefix)+StreamChunkSize)
+		n := copy(buffer, chunkFrame)
+		n += copy(buffer[n:], prefix)
+		read, err := io.ReadFull(body, buffer[n:])
+		if read > 0 && !c.queueFrame(buffer[:n+read]) {
+			return
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			c.queueFrame(append(append([]byte{}, endFrame...), prefix...))
+			return
+		} else if err != nil {
+			connLog.Error("Error while reading streamed body :: %s", err)
+			c.queueFrame(append(append([]byte{}, abortFrame...), prefix...))
+			return
+		}
+	}
+}
+
+// errRequestAbandoned is returned by the body of a request whose sender stopped waiting for the response.
+var errRequestAbandoned = errors.New("request abandoned")
+
+// requestBody is the streamed body of a request that is sent with SendRequest or SendRequestContext.
+// It stops the stream when the sender gives up and tells the sender when the last frame was queued.
+type requestBody struct {
+	reader    io.Reader
+	abandoned <-chan struct{}
+	sent      chan struct{}
+}
+
+func (b *requestBody) Read(p []byte) (int, error) {
+	select {
+	case <-b.abandoned:
+		return 0, errRequestAbandoned
+	default:
+	}
+	return b.reader.Read(p)
+}
+
+func (b *requestBody) Close() error {
+	closeBody(b.reader)
+	return nil
+}
+
+// queueFrame hands a frame to the talk goroutine, it returns false if the connection is closed.
+func (c *Connection) queueFrame(frame []byte) bool {
+	select {
+	case c.frames <- frame:
+		return true
+	case <-c.closed:
+		return false
+	}
+}
+
+// openStream replaces the body of a received message by a buffer that is fed by the following chunk frames.
+// It must only be called from the listen goroutine.
+func (c *Connection) openStream(msg fosp.Message) error {
+	header, _ := messageHeader(msg)
+	if header == nil || header.Get(StreamHeader) == "" {
+		return nil
+	}
+	id, err := strconv.ParseUint(header.Get(StreamHeader), 10, 64)
+	if err != nil {
+		return newNestedError("Invalid stream identifier", err)
+	}
+	header.Del(StreamHeader)
+	body := newStreamBuffer(&c.inStreamsBudget)
+	c.inStreams[id] = body
+	setMessageBody(msg, body)
+	return nil
+}
+
+// handleStreamFrame feeds a chunk frame into the buffer of its stream.
+// It returns false if the frame is not a chunk frame.
+// Receivers that are not interested in a body have to close it so that the remaining chunks are discarded.
+func (c *Connection) handleStreamFrame(frame []byte) bool {
+	var kind []byte
+	for _, k := range [][]byte{chunkFrame, endFrame, abortFrame} {
+		if bytes.HasPrefix(frame, k) {
+			kind = k
+		}
+	}
+	if kind == nil {
+		return false
+	}
+	end := bytes.Index(frame, []byte("\r\n"))
+	if end < 0 {
+		connLog.Warning("Dropping malformed stream frame")
+		return true
+	}
+	id, err := strconv.ParseUint(string(frame[len(kind):end]), 10, 64)
+	body, ok := c.inStreams[id]
+	if err != nil || !ok {
+		connLog.Warning("Dropping frame of unknown stream %s", frame[len(kind):end])
+		return true
+	}
+	switch {
+	case bytes.Equal(kind, chunkFrame):
+		if !body.write(frame[end+2:]) {
+			connLog.Debug("Receiver of stream %d is gone or overflowed, discarding chunk", id)
+		}
+	case bytes.Equal(kind, endFrame):
+		body.finish(io.EOF)
+		delete(c.inStreams, id)
+	default:
+		body.finish(ErrStreamAborted)
+		delete(c.inStreams, id)
+	}
+	return true
+}
+
+// closeStreams aborts all incoming streams, it is called when the connection is closed.
+func (c *Connection) closeStreams() {
+	for id, body := range c.inStreams {
+		body.finish(ErrConnectionClosed)
+		delete(c.inStreams, id)
+	}
+}
+
+// streamBudget counts the bytes that are buffered for all received streams of a connection.
+type streamBudget struct {
+	lock     sync.Mutex
+	buffered int64
+}
+
+// take reserves n bytes, it returns false if they would exceed StreamBufferSize.
+func (b *streamBudget) take(n int64) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.buffered+n > StreamBufferSize {
+		return false
+	}
+	b.buffered += n
+	return true
+}
+
+// release returns n bytes that were read or discarded.
+func (b *streamBudget) release(n int64) {
+	b.lock.Lock()
+	b.buffered -= n
+	b.lock.Unlock()
+}
+
+// streamBuffer is the body of a received message whose body is streamed.
+// Chunks are added without blocking and kept until the receiver reads them or closes the body.
+// If the chunks of the connection exceed the budget, the stream fails with ErrStreamOverflow.
+type streamBuffer struct {
+	lock     sync.Mutex
+	readable *sync.Cond
+	chunks   [][]byte
+	size     int64
+	budget   *streamBudget
+	err      error
+	closed   bool
+}
+
+func newStreamBuffer(budget *streamBudget) *streamBuffer {
+	b := &streamBuffer{budget: budget}
+	b.readable = sync.NewCond(&b.lock)
+	return b
+}
+
+// write adds a chunk to the buffer, it returns false if the receiver closed the body or the buffer overflowed.
+func (b *streamBuffer) write(chunk []byte) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.closed || b.err == ErrStreamOverflow {
+		return false
+	}
+	if len(chunk) > 0 && b.err == nil {
+		if !b.budget.take(int64(len(chunk))) {
+			connLog.Warning("Receiver does not keep up with stream, discarding %d buffered bytes", b.size)
+			b.discard()
+			b.err = ErrStreamOverflow
+			b.readable.Broadcast()
+			return false
+		}
+		b.chunks = append(b.chunks, chunk)
+		b.size += int64(len(chunk))
+		b.readable.Signal()
+	}
+	return true
+}
+
+// finish ends the stream, Read returns err after the buffered chunks were read.
+func (b *streamBuffer) finish(err error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.err == nil {
+		b.err = err
+	}
+	b.readable.Broadcast()
+}
+
+// Read blocks until a chunk is available or the stream ended.
+func (b *streamBuffer) Read(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for len(b.chunks) == 0 && b.err == nil && !b.closed {
+		b.readable.Wait()
+	}
+	if b.closed {
+		return 0, io.ErrClosedPipe
+	}
+	if len(b.chunks) == 0 {
+		return 0, b.err
+	}
+	n := copy(p, b.chunks[0])
+	if b.chunks[0] = b.chunks[0][n:]; len(b.chunks[0]) == 0 {
+		b.chunks = b.chunks[1:]
+	}
+	b.size -= int64(n)
+	b.budget.release(int64(n))
+	return n, nil
+}
+
+// discard drops the buffered chunks, the caller has to hold the lock.
+func (b *streamBuffer) discard() {
+	b.budget.release(b.size)
+	b.chunks, b.size = nil, 0
+}
+
+// Close discards the buffered chunks and all chunks that are still received.
+func (b *streamBuffer) Close() error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.closed = true
+	b.discard()
+	b.readable.Broadcast()
+	return nil
+}
+
+// closeBody closes the body if it is closable.
+func closeBody(body io.Reader) {
+	if closer, ok := body.(io.Closer); ok {
+		closer.Close()
+	}
+}
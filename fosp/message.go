@@ -25,6 +25,11 @@ const (
 	DELETE         = "DELETE"
 	READ           = "READ"
 	WRITE          = "WRITE"
+	// SUBSCRIBE and UNSUBSCRIBE manage subscriptions that only exist as long as the connection they were sent on.
+	SUBSCRIBE   = "SUBSCRIBE"
+	UNSUBSCRIBE = "UNSUBSCRIBE"
+	// CHANGES returns the change log of an object and its descendants since the change ID in the Since header.
+	CHANGES = "CHANGES"
 
 	SUCCEEDED = "SUCCEEDED"
 	FAILED    = "FAILED"
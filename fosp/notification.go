@@ -16,12 +16,28 @@
 package fosp
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
 	"net/textproto"
 	"net/url"
+	"strconv"
+	"time"
 )
 
+// SequenceHeader carries the number of a notification in the notification queue of the receiving user.
+// The numbers of the notifications of a user increase, a client can acknowledge all notifications up to a number.
+const SequenceHeader = "Sequence"
+
+// SinceHeader selects the entries after the given number, the queued notifications after a sequence number
+// in a GET request for the notification queue and the changes after a change ID in a CHANGES request.
+const SinceHeader = "Since"
+
+// BaseETagHeader marks an UPDATED notification whose body is the applied PatchObject instead of the object.
+// It carries the entity tag of the object the patch was applied to, the ETag header the one of the result.
+const BaseETagHeader = "Base-ETag"
+
 // Notification is an object that represents a FOSP notification message.
 type Notification struct {
 	Event  string
@@ -40,4 +56,53 @@ func (n *Notification) String() string {
 	return fmt.Sprintf("%s %s", n.Event, n.URL)
 }
 
+// Sequence returns the number of the notification in the notification queue, if the server queued it.
+func (n *Notification) Sequence() (uint64, bool) {
+	seq, err := strconv.ParseUint(n.Header.Get(SequenceHeader), 10, 64)
+	if err != nil || seq == 0 {
+		return 0, false
+	}
+	return seq, true
+}
+
+// IsDelta returns whether the body of the notification is a patch that turns the object with the entity tag
+// in the Base-ETag header into the object with the entity tag in the ETag header.
+func (n *Notification) IsDelta() bool {
+	return n.Header.Get(BaseETagHeader) != ""
+}
+
 func (n *Notification) nop() {}
+
+// NotificationRecord is a notification that is kept in the notification queue of a user.
+// Object is the body of the notification, for a delta it is the patch.
+type NotificationRecord struct {
+	Seq      uint64          `json:"seq"`
+	Event    string          `json:"event"`
+	URL      string          `json:"url"`
+	ETag     string          `json:"etag,omitempty"`
+	BaseETag string          `json:"base_etag,omitempty"`
+	Object   json.RawMessage `json:"object,omitempty"`
+	Time     time.Time       `json:"time"`
+}
+
+// Notification converts the record back into a notification that carries the sequence number in its header.
+func (r *NotificationRecord) Notification() (*Notification, error) {
+	u, err := url.Parse(r.URL)
+	if err != nil {
+		return nil, err
+	}
+	n := NewNotification(r.Event, u)
+	if r.Seq > 0 {
+		n.Header.Set(SequenceHeader, strconv.FormatUint(r.Seq, 10))
+	}
+	if r.ETag != "" {
+		n.Header.Set(ETagHeader, r.ETag)
+	}
+	if r.BaseETag != "" {
+		n.Header.Set(BaseETagHeader, r.BaseETag)
+	}
+	if r.Object != nil {
+		n.Body = bytes.NewReader(r.Object)
+	}
+	return n, nil
+}
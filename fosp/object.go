@@ -33,6 +33,8 @@ type Object struct {
 	Attachment    *Attachment                   `json:"attachment,omitempty"`
 	Type          interface{}                   `json:"type,omitempty"`
 	Data          interface{}                   `json:"data,omitempty"`
+	// ETag is the entity tag of the object, it is sent in the ETag header and not part of the object itself.
+	ETag string `json:"-"`
 }
 
 func NewObject() *Object {
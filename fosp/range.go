@@ -0,0 +1,88 @@
+// Copyright (C) 2015 Felix Maurer
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package fosp
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+const (
+	// RangeHeader selects a part of an attachment in a READ request, e.g. "bytes=0-1023", "bytes=1024-" or "bytes=-512".
+	RangeHeader = "Range"
+	// ContentRangeHeader describes the part of the attachment that is sent in the response to a ranged READ,
+	// e.g. "bytes 0-1023/4096".
+	ContentRangeHeader = "Content-Range"
+	// OffsetHeader is the position at which a WRITE request starts to write into the attachment.
+	// Everything after the written data is cut off. Responses to WRITE requests with an offset carry the new size.
+	OffsetHeader = "Offset"
+	// UploadHeader identifies a resumable upload. Writes of an upload have to continue at the end of the
+	// data the server already received for it, otherwise they fail with StatusConflict and the Offset header
+	// tells the client where to continue.
+	UploadHeader = "Upload"
+)
+
+// ErrInvalidRange is returned when a range can not be parsed or does not overlap with the attachment.
+var ErrInvalidRange = errors.New("invalid range")
+
+// ParseRange parses the value of a Range header for an attachment of the given size.
+// It returns the first and the last byte of the range.
+func ParseRange(value string, size int64) (first, last int64, err error) {
+	if !strings.HasPrefix(value, "bytes=") {
+		return 0, 0, ErrInvalidRange
+	}
+	parts := strings.SplitN(strings.TrimPrefix(value, "bytes="), "-", 2)
+	if len(parts) != 2 || (parts[0] == "" && parts[1] == "") {
+		return 0, 0, ErrInvalidRange
+	}
+	if parts[0] == "" {
+		suffix, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil || suffix <= 0 || size == 0 {
+			return 0, 0, ErrInvalidRange
+		}
+		if suffix > size {
+			suffix = size
+		}
+		return size - suffix, size - 1, nil
+	}
+	if first, err = strconv.ParseInt(parts[0], 10, 64); err != nil || first < 0 || first >= size {
+		return 0, 0, ErrInvalidRange
+	}
+	last = size - 1
+	if parts[1] != "" {
+		if last, err = strconv.ParseInt(parts[1], 10, 64); err != nil || last < first {
+			return 0, 0, ErrInvalidRange
+		}
+		if last >= size {
+			last = size - 1
+		}
+	}
+	return first, last, nil
+}
+
+// FormatRange formats a range for the Range header, a negative last byte means until the end of the attachment.
+func FormatRange(first, last int64) string {
+	if last < 0 {
+		return "bytes=" + strconv.FormatInt(first, 10) + "-"
+	}
+	return "bytes=" + strconv.FormatInt(first, 10) + "-" + strconv.FormatInt(last, 10)
+}
+
+// FormatContentRange formats the value of the Content-Range header.
+func FormatContentRange(first, last, size int64) string {
+	return "bytes " + strconv.FormatInt(first, 10) + "-" + strconv.FormatInt(last, 10) + "/" + strconv.FormatInt(size, 10)
+}
@@ -20,8 +20,13 @@ import (
 	"io"
 	"net/textproto"
 	"net/url"
+	"strconv"
+	"time"
 )
 
+// TimeoutHeader is the header in which the sender of a request announces how many milliseconds it waits for the response.
+const TimeoutHeader = "Timeout"
+
 // Request represents a FOSP request message.
 type Request struct {
 	Method string
@@ -40,4 +45,18 @@ func (r *Request) String() string {
 	return fmt.Sprintf("%s %s", r.Method, r.URL)
 }
 
+// SetTimeout announces how long the sender waits for the response.
+func (r *Request) SetTimeout(timeout time.Duration) {
+	r.Header.Set(TimeoutHeader, strconv.FormatInt(int64(timeout/time.Millisecond), 10))
+}
+
+// Timeout returns how long the sender waits for the response, if it announced it.
+func (r *Request) Timeout() (time.Duration, bool) {
+	milliseconds, err := strconv.ParseInt(r.Header.Get(TimeoutHeader), 10, 64)
+	if err != nil || milliseconds < 0 {
+		return 0, false
+	}
+	return time.Duration(milliseconds) * time.Millisecond, true
+}
+
 func (r *Request) nop() {}
@@ -22,9 +22,10 @@ import (
 )
 
 const (
-	StatusOK        uint = 200
-	StatusCreated        = 201
-	StatusNoContent      = 204
+	StatusOK             uint = 200
+	StatusCreated             = 201
+	StatusNoContent           = 204
+	StatusPartialContent      = 206
 
 	StatusMovedPermanently     = 301
 	StatusNotModified          = 304
@@ -38,6 +39,7 @@ const (
 	StatusConflict              = 409
 	StatusPreconditionFailed    = 412
 	StatusRequestEntityTooLarge = 413
+	StatusRangeNotSatisfiable   = 416
 
 	StatusInternalServerError = 500
 	StatusNotImplemented      = 501
@@ -0,0 +1,164 @@
+// Copyright (C) 2015 Felix Maurer
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package fosp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strings"
+)
+
+// ScramMechanism is the name of the SCRAM-SHA-256 SASL mechanism.
+const ScramMechanism = "SCRAM-SHA-256"
+
+// ScramIterations is the iteration count used when deriving new SCRAM credentials.
+const ScramIterations = 4096
+
+// ScramCredentials is the salted verifier of a password as defined by SCRAM (RFC 5802).
+// It can be stored by a server instead of the password and is sufficient to verify a client proof.
+type ScramCredentials struct {
+	Salt       []byte `json:"salt"`
+	Iterations int    `json:"iterations"`
+	StoredKey  []byte `json:"stored-key"`
+	ServerKey  []byte `json:"server-key"`
+}
+
+// NewScramCredentials derives SCRAM credentials for password using a new random salt.
+func NewScramCredentials(password string) (*ScramCredentials, error) {
+	salt, err := ScramNonce(16)
+	if err != nil {
+		return nil, err
+	}
+	salted := ScramSaltedPassword(password, []byte(salt), ScramIterations)
+	return &ScramCredentials{
+		Salt:       []byte(salt),
+		Iterations: ScramIterations,
+		StoredKey:  scramHash(ScramHMAC(salted, "Client Key")),
+		ServerKey:  ScramHMAC(salted, "Server Key"),
+	}, nil
+}
+
+// ScramDummyCredentials returns made up credentials for a user that has none.
+// They are derived from secret and user without running the password derivation,
+// so the salt is the same on every attempt just like the salt of a real user.
+func ScramDummyCredentials(secret []byte, user string) *ScramCredentials {
+	salt := base64.StdEncoding.EncodeToString(ScramHMAC(secret, "Salt "+user)[:16])
+	return &ScramCredentials{
+		Salt:       []byte(salt),
+		Iterations: ScramIterations,
+		StoredKey:  ScramHMAC(secret, "Stored Key "+user),
+		ServerKey:  ScramHMAC(secret, "Server Key "+user),
+	}
+}
+
+// VerifyProof checks whether the client proof was computed from the password these credentials were derived from.
+func (c *ScramCredentials) VerifyProof(authMessage string, proof []byte) bool {
+	clientSignature := ScramHMAC(c.StoredKey, authMessage)
+	if len(proof) != len(clientSignature) {
+		return false
+	}
+	clientKey := scramXOR(proof, clientSignature)
+	return hmac.Equal(scramHash(clientKey), c.StoredKey)
+}
+
+// ServerSignature returns the signature a server sends to prove that it knows the credentials.
+func (c *ScramCredentials) ServerSignature(authMessage string) []byte {
+	return ScramHMAC(c.ServerKey, authMessage)
+}
+
+// ScramClientProof computes the proof a client sends for the given salted password.
+func ScramClientProof(saltedPassword []byte, authMessage string) []byte {
+	clientKey := ScramHMAC(saltedPassword, "Client Key")
+	clientSignature := ScramHMAC(scramHash(clientKey), authMessage)
+	return scramXOR(clientKey, clientSignature)
+}
+
+// ScramServerSignature computes the signature a client expects from the server for the given salted password.
+func ScramServerSignature(saltedPassword []byte, authMessage string) []byte {
+	return ScramHMAC(ScramHMAC(saltedPassword, "Server Key"), authMessage)
+}
+
+// ScramSaltedPassword implements the Hi function of RFC 5802, which is PBKDF2 with HMAC-SHA-256 and a single block.
+func ScramSaltedPassword(password string, salt []byte, iterations int) []byte {
+	mac := hmac.New(sha256.New, []byte(password))
+	mac.Write(salt)
+	mac.Write([]byte{0, 0, 0, 1})
+	u := mac.Sum(nil)
+	result := append([]byte{}, u...)
+	for i := 1; i < iterations; i++ {
+		mac.Reset()
+		mac.Write(u)
+		u = mac.Sum(nil)
+		for j := range result {
+			result[j] ^= u[j]
+		}
+	}
+	return result
+}
+
+// ScramHMAC computes HMAC-SHA-256 of message with key.
+func ScramHMAC(key []byte, message string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(message))
+	return mac.Sum(nil)
+}
+
+// ScramNonce returns a random printable nonce that is derived from length random bytes.
+func ScramNonce(length int) (string, error) {
+	raw := make([]byte, length)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(raw), nil
+}
+
+// ParseScramMessage splits a SCRAM message into its attributes, e.g. "r=abc,s=def" into {"r": "abc", "s": "def"}.
+func ParseScramMessage(message string) (map[string]string, error) {
+	attributes := make(map[string]string)
+	for _, part := range strings.Split(message, ",") {
+		if len(part) < 2 || part[1] != '=' {
+			return nil, errors.New("Invalid SCRAM attribute " + part)
+		}
+		attributes[part[:1]] = part[2:]
+	}
+	return attributes, nil
+}
+
+// ScramEscapeName escapes a user name for use in the n attribute of a SCRAM message.
+func ScramEscapeName(name string) string {
+	return strings.Replace(strings.Replace(name, "=", "=3D", -1), ",", "=2C", -1)
+}
+
+// ScramUnescapeName reverses ScramEscapeName.
+func ScramUnescapeName(name string) string {
+	return strings.Replace(strings.Replace(name, "=2C", ",", -1), "=3D", "=", -1)
+}
+
+func scramHash(data []byte) []byte {
+	sum := sha256.Sum256(data)
+	return sum[:]
+}
+
+func scramXOR(a, b []byte) []byte {
+	result := make([]byte, len(a))
+	for i := range a {
+		result[i] = a[i] ^ b[i]
+	}
+	return result
+}
@@ -15,10 +15,16 @@
 
 package fosp
 
+import (
+	"strings"
+)
+
 // SubscriptionEntry represents an entry in the subscriptions list of an object.
 type SubscriptionEntry struct {
 	Depth  int      `json:"depth,omitempty"`
 	Events []string `json:"events,omitempty"`
+	// Delta asks for UPDATED notifications that carry the applied patch instead of the whole object, if available.
+	Delta bool `json:"delta,omitempty"`
 }
 
 func NewSubscriptionEntry() *SubscriptionEntry {
@@ -27,6 +33,20 @@ func NewSubscriptionEntry() *SubscriptionEntry {
 	}
 }
 
+// Matches returns whether an event on an object that is depth levels below the subscribed object is subscribed.
+// A depth of -1 subscribes the whole subtree.
+func (sub *SubscriptionEntry) Matches(event string, depth int) bool {
+	if sub.Depth != -1 && sub.Depth < depth {
+		return false
+	}
+	for _, ev := range sub.Events {
+		if strings.EqualFold(ev, event) {
+			return true
+		}
+	}
+	return false
+}
+
 func (sub *SubscriptionEntry) Patch(patch PatchObject) {
 	if tmp, ok := patch["depth"]; ok {
 		if num, ok := tmp.(int); ok {
@@ -44,4 +64,9 @@ func (sub *SubscriptionEntry) Patch(patch PatchObject) {
 			sub.Events = events
 		}
 	}
+	if tmp, ok := patch["delta"]; ok {
+		if delta, ok := tmp.(bool); ok {
+			sub.Delta = delta
+		}
+	}
 }
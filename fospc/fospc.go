@@ -16,28 +16,28 @@
 package main
 
 import (
-	"bytes"
 	"encoding/json"
 	"flag"
 	"github.com/maufl/go-fosp/fosp"
+	"github.com/maufl/go-fosp/fosp/fospclient"
 	"github.com/maufl/go-fosp/fosp/fospws"
 	"github.com/op/go-logging"
 	"github.com/shavac/readline"
 	"io"
-	"io/ioutil"
 	"net/url"
 	"os"
 	"strings"
 )
 
 var state struct {
-	Remote   string
-	User     string
-	Password string
-	Cwd      string
+	Remote     string
+	User       string
+	Token      string
+	Cwd        string
+	AllowPlain bool
 }
 var prompt = state.User + " :: " + state.Cwd + " >"
-var connection *fospws.Connection
+var client *fospclient.Client
 
 type emptyMessageHandler struct{}
 
@@ -52,20 +52,22 @@ func main() {
 	logging.SetBackend(logBackend)
 	logging.SetLevel(logging.NOTICE, "")
 
+	var password string
 	flag.StringVar(&state.Remote, "h", "localhost", "The host to which to connect on startup.")
 	flag.StringVar(&state.User, "u", "alice@localhost.localdomain", "The user which to use.")
-	flag.StringVar(&state.Password, "p", "test1234", "The passwort of the user.")
+	flag.StringVar(&password, "p", "test1234", "The passwort of the user.")
+	flag.BoolVar(&state.AllowPlain, "allow-plain", false, "Send the password in cleartext if the server does not offer SCRAM-SHA-256.")
 	flag.Parse()
 
 	if state.Remote != "" {
 		open(state.Remote)
-		if state.User != "" && state.Password != "" {
-			auth(state.User + " " + state.Password)
+		if state.User != "" && password != "" {
+			auth(state.User + " " + password)
 		}
 	}
 
 	loop()
-	return
+	quit("")
 }
 
 func loop() {
@@ -109,6 +111,8 @@ func parseCommand(input string) {
 		quit(args)
 	case "open":
 		open(args)
+	case "options":
+		options(args)
 	case "auth":
 		auth(args)
 	case "get":
@@ -132,46 +136,67 @@ func parseCommand(input string) {
 
 func open(args string) {
 	var err error
-	if connection, err = fospws.OpenConnection(args); err != nil {
+	if client, err = fospclient.Dial(args); err != nil {
 		println(err.Error())
 	} else {
 		state.Remote = args
-		connection.RegisterMessageHandler(e)
+		client.AllowPlain = state.AllowPlain
+		client.Connection().RegisterMessageHandler(e)
+		if state.User != "" && state.Token != "" {
+			if err := client.Connection().AuthenticateToken(state.User, state.Token); err == nil {
+				println("Resumed session of " + state.User)
+			} else {
+				println("Resuming session failed: " + err.Error())
+				state.Token = ""
+			}
+		}
 	}
 }
 
 func quit(args string) {
+	if client != nil && state.Token != "" {
+		client.Connection().RevokeToken(state.User, state.Token)
+	}
 	os.Exit(0)
 }
 
+func options(args string) {
+	if caps, err := client.Options(); err == nil {
+		encoded, _ := json.Marshal(caps)
+		println(prettyJSON(encoded))
+	} else {
+		println("Options failed: " + err.Error())
+	}
+}
+
 func auth(args string) {
 	parts := strings.Split(args, " ")
 	if len(parts) != 2 {
 		println("Not enough arguments for authenticate")
+		return
 	}
 	authenticationId := parts[0]
 	password := parts[1]
-	content := map[string]map[string]string{
-		"sasl": map[string]string{
-			"mechanism":        "PLAIN",
-			"initial-response": strings.Join([]string{"", authenticationId, password}, "\x00"),
-		},
-	}
-	encoded, err := json.Marshal(content)
-	if err != nil {
-		println("Error while building request " + err.Error())
-		return
+	if state.Token != "" && state.User != authenticationId {
+		// The session of the previous user ends here, its token would never be used again.
+		if err := client.Connection().RevokeToken(state.User, state.Token); err != nil {
+			println("Could not revoke session token: " + err.Error())
+		}
+		state.Token = ""
 	}
-	req := fosp.NewRequest(fosp.AUTH, nil)
-	req.Body = bytes.NewBuffer(encoded)
-	if resp, err := connection.SendRequest(req); err == nil && resp.Status == fosp.SUCCEEDED {
+	err := client.Authenticate(authenticationId, password)
+	if err == nil {
 		state.User = parts[0]
-		state.Password = parts[0]
 		state.Cwd = state.User
+		if state.Token == "" {
+			if state.Token, err = client.Connection().RequestToken(state.User, "fospc"); err != nil {
+				println("Could not obtain session token: " + err.Error())
+			}
+		}
 		buildPrompt()
 		println("Authentication succeeded")
 	} else {
-		println("Authentication failed")
+		println("Authentication failed: " + err.Error())
 	}
 }
 
@@ -181,11 +206,9 @@ func get(args string) {
 		println(args + " is not a valid path")
 		return
 	}
-	req := fosp.NewRequest(fosp.GET, url)
-	if resp, err := connection.SendRequest(req); err == nil {
-		bytes, _ := ioutil.ReadAll(resp.Body)
-		println(resp.String())
-		println(prettyJSON(bytes))
+	if obj, err := client.Get(url); err == nil {
+		encoded, _ := json.MarshalIndent(obj, "", "  ")
+		println(string(encoded))
 	} else {
 		println("Get failed: " + err.Error())
 	}
@@ -197,12 +220,10 @@ func list(args string) {
 		println(args + " is not a valid path")
 		return
 	}
-	req := fosp.NewRequest(fosp.LIST, url)
-	if resp, err := connection.SendRequest(req); err == nil {
-		bytes, _ := ioutil.ReadAll(resp.Body)
-		println(prettyJSON(bytes))
+	if names, err := client.List(url); err == nil {
+		println(strings.Join(names, "\n"))
 	} else {
-		println("Select failed: " + err.Error())
+		println("List failed: " + err.Error())
 	}
 }
 
@@ -218,12 +239,16 @@ func create(args string) {
 		println(path + " is not a valid path")
 		return
 	}
-	req := fosp.NewRequest(fosp.CREATE, url)
+	obj := fosp.NewObject()
 	if content != "" {
-		req.Body = bytes.NewBufferString(content)
+		if err := json.Unmarshal([]byte(content), obj); err != nil {
+			println("Invalid object: " + err.Error())
+			return
+		}
 	}
-	if _, err := connection.SendRequest(req); err == nil {
-		println("Create succeeded")
+	if created, err := client.Create(url, obj); err == nil {
+		encoded, _ := json.MarshalIndent(created, "", "  ")
+		println(string(encoded))
 	} else {
 		println("Create failed: " + err.Error())
 	}
@@ -241,12 +266,16 @@ func patch(args string) {
 		println(path + " is not a valid path")
 		return
 	}
-	req := fosp.NewRequest(fosp.PATCH, url)
+	patch := fosp.PatchObject{}
 	if content != "" {
-		req.Body = bytes.NewBufferString(content)
+		if err := json.Unmarshal([]byte(content), &patch); err != nil {
+			println("Invalid patch: " + err.Error())
+			return
+		}
 	}
-	if _, err := connection.SendRequest(req); err == nil {
-		println("Patch succeeded")
+	if updated, err := client.Patch(url, patch); err == nil {
+		encoded, _ := json.MarshalIndent(updated, "", "  ")
+		println(string(encoded))
 	} else {
 		println("Patch failed: " + err.Error())
 	}
@@ -258,8 +287,7 @@ func del(args string) {
 		println(args + " is not a valid path")
 		return
 	}
-	req := fosp.NewRequest(fosp.DELETE, url)
-	if _, err := connection.SendRequest(req); err == nil {
+	if err := client.Delete(url); err == nil {
 		println("Delete succeeded")
 	} else {
 		println("Delete failed: " + err.Error())
@@ -284,19 +312,15 @@ func read(args string) {
 		println(path + " is not a valid path")
 		return
 	}
-	req := fosp.NewRequest(fosp.READ, url)
-	if resp, err := connection.SendRequest(req); err == nil && resp.Status == fosp.SUCCEEDED {
-		if _, err = io.Copy(file, resp.Body); err == nil {
+	if attachment, err := client.ReadStream(url); err == nil {
+		defer attachment.Close()
+		if _, err = io.Copy(file, attachment); err == nil {
 			println("Read succeeded")
 		} else {
 			println("Error when saving file " + err.Error())
 		}
 	} else {
-		if err != nil {
-			println("Read failed: " + err.Error())
-		} else {
-			println("Read failed, received FAILED response")
-		}
+		println("Read failed: " + err.Error())
 	}
 }
 
@@ -318,9 +342,8 @@ func write(args string) {
 		println(path + " is not a valid path")
 		return
 	}
-	req := fosp.NewRequest(fosp.WRITE, url)
-	req.Body = file
-	if _, err := connection.SendRequest(req); err == nil {
+	defer file.Close()
+	if err := client.Write(url, file); err == nil {
 		println("Write succeeded")
 	} else {
 		println("Write failed: " + err.Error())
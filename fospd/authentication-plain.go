@@ -0,0 +1,63 @@
+// Copyright (C) 2015 Felix Maurer
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"github.com/maufl/go-fosp/fosp"
+	"strings"
+)
+
+func init() {
+	RegisterSaslMechanism(plainMechanism{})
+}
+
+// plainMechanism implements the PLAIN SASL mechanism (RFC 4616).
+// The password is transmitted in cleartext, so it should only be enabled for TLS connections.
+type plainMechanism struct{}
+
+func (plainMechanism) Name() string {
+	return "PLAIN"
+}
+
+func (plainMechanism) NewSession(db *Database) SaslSession {
+	return &plainSession{database: db}
+}
+
+type plainSession struct {
+	database *Database
+}
+
+func (s *plainSession) Step(response *string) SaslResult {
+	if response == nil {
+		return SaslContinue("Please provide your user name and password")
+	}
+	parts := strings.Split(*response, "\x00")
+	if len(parts) != 3 {
+		return SaslFailure(fosp.StatusBadRequest, "")
+	}
+	authorizationId := parts[0]
+	authenticationId := parts[1]
+	password := parts[2]
+
+	if authorizationId != "" && authorizationId != authenticationId {
+		return SaslFailure(fosp.StatusUnauthorized, "Authorization ID and authentication ID must be the same")
+	}
+	servConnLog.Debug("Authenticating user %s", authenticationId)
+	if s.database.Authenticate(authenticationId, password) {
+		return SaslSuccess(authenticationId, nil)
+	}
+	return SaslFailure(fosp.StatusUnauthorized, "")
+}
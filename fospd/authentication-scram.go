@@ -0,0 +1,124 @@
+// Copyright (C) 2015 Felix Maurer
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"encoding/base64"
+	"github.com/maufl/go-fosp/fosp"
+	"strconv"
+	"strings"
+)
+
+func init() {
+	RegisterSaslMechanism(scramMechanism{})
+}
+
+// scramMechanism implements the SCRAM-SHA-256 SASL mechanism (RFC 5802, RFC 7677) without channel binding.
+type scramMechanism struct{}
+
+func (scramMechanism) Name() string {
+	return fosp.ScramMechanism
+}
+
+func (scramMechanism) NewSession(db *Database) SaslSession {
+	return &scramSession{database: db}
+}
+
+// scramSession holds the state of a SCRAM-SHA-256 authentication between the first and the final client message.
+type scramSession struct {
+	database *Database
+
+	user            string
+	credentials     *fosp.ScramCredentials
+	gs2Header       string
+	clientFirstBare string
+	serverFirst     string
+	nonce           string
+}
+
+func (s *scramSession) Step(response *string) SaslResult {
+	if response == nil {
+		return SaslContinue("")
+	}
+	if s.credentials == nil {
+		return s.clientFirst(*response)
+	}
+	return s.clientFinal(*response)
+}
+
+// clientFirst processes the client-first-message and answers with the server-first-message as challenge.
+func (s *scramSession) clientFirst(message string) SaslResult {
+	parts := strings.SplitN(message, ",", 3)
+	if len(parts) != 3 {
+		return SaslFailure(fosp.StatusBadRequest, "")
+	}
+	// Channel binding is not supported, the client must not require it.
+	if parts[0] != "n" && parts[0] != "y" {
+		return SaslFailure(fosp.StatusBadRequest, "Channel binding is not supported")
+	}
+	attributes, err := fosp.ParseScramMessage(parts[2])
+	if err != nil || attributes["n"] == "" || attributes["r"] == "" {
+		return SaslFailure(fosp.StatusBadRequest, "")
+	}
+	user := fosp.ScramUnescapeName(attributes["n"])
+	if authzid := parts[1]; authzid != "" && fosp.ScramUnescapeName(strings.TrimPrefix(authzid, "a=")) != user {
+		return SaslFailure(fosp.StatusUnauthorized, "Authorization ID and authentication ID must be the same")
+	}
+	credentials, err := s.database.ScramCredentials(user)
+	if err != nil || credentials == nil {
+		// Continue with made up credentials so that the client cannot probe which users exist.
+		servConnLog.Info("No SCRAM credentials for user %s", user)
+		credentials = fosp.ScramDummyCredentials(s.database.server.scramSecret, user)
+		user = ""
+	}
+	serverNonce, err := fosp.ScramNonce(18)
+	if err != nil {
+		return SaslFailure(fosp.StatusInternalServerError, "")
+	}
+	s.user = user
+	s.credentials = credentials
+	s.gs2Header = parts[0] + "," + parts[1] + ","
+	s.clientFirstBare = parts[2]
+	s.nonce = attributes["r"] + serverNonce
+	s.serverFirst = "r=" + s.nonce + ",s=" + base64.StdEncoding.EncodeToString(credentials.Salt) + ",i=" + strconv.Itoa(credentials.Iterations)
+	return SaslContinue(s.serverFirst)
+}
+
+// clientFinal verifies the client-final-message and returns the server signature on success.
+func (s *scramSession) clientFinal(message string) SaslResult {
+	index := strings.LastIndex(message, ",p=")
+	if index == -1 {
+		return SaslFailure(fosp.StatusBadRequest, "")
+	}
+	withoutProof := message[:index]
+	attributes, err := fosp.ParseScramMessage(message)
+	if err != nil {
+		return SaslFailure(fosp.StatusBadRequest, "")
+	}
+	if attributes["c"] != base64.StdEncoding.EncodeToString([]byte(s.gs2Header)) || attributes["r"] != s.nonce {
+		return SaslFailure(fosp.StatusBadRequest, "")
+	}
+	proof, err := base64.StdEncoding.DecodeString(attributes["p"])
+	if err != nil {
+		return SaslFailure(fosp.StatusBadRequest, "")
+	}
+	authMessage := s.clientFirstBare + "," + s.serverFirst + "," + withoutProof
+	if s.user == "" || !s.credentials.VerifyProof(authMessage, proof) {
+		return SaslFailure(fosp.StatusUnauthorized, "")
+	}
+	signature := "v=" + base64.StdEncoding.EncodeToString(s.credentials.ServerSignature(authMessage))
+	return SaslSuccess(s.user, &signature)
+}
@@ -18,10 +18,104 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"github.com/maufl/go-fosp/fosp"
-	"strings"
+	"sync"
 )
 
+// SaslMechanism is the interface of SASL mechanisms that can be used to authenticate a ServerConnection.
+// A mechanism is registered once with RegisterSaslMechanism and creates a new SaslSession for every exchange.
+type SaslMechanism interface {
+	// Name returns the name of the mechanism as used in the mechanism field of an AUTH request.
+	Name() string
+	// NewSession creates the state machine for a single authentication exchange on one connection.
+	NewSession(db *Database) SaslSession
+}
+
+// SaslSession is the per connection state machine of a SASL exchange.
+// Step is called with the initial response of the client, which is nil if the client did not send one,
+// and then with every following response until the returned SaslResult finishes the exchange.
+type SaslSession interface {
+	Step(response *string) SaslResult
+}
+
+// SaslResult is the outcome of a single step of a SASL exchange.
+type SaslResult struct {
+	// Challenge is sent to the client if the exchange needs another response.
+	Challenge *string
+	// User is the authenticated user if the exchange finished successfully.
+	User string
+	// Domain is the authenticated remote server if the exchange finished successfully.
+	Domain string
+	// AdditionalData is sent to the client with the successful outcome.
+	AdditionalData *string
+	// Code is the status code of the response if the exchange failed.
+	Code uint
+	// Outcome is a human readable explanation of a failed exchange.
+	Outcome string
+}
+
+// SaslContinue creates a SaslResult that sends challenge to the client and waits for another response.
+func SaslContinue(challenge string) SaslResult {
+	return SaslResult{Challenge: &challenge}
+}
+
+// SaslSuccess creates a SaslResult that authenticates user and finishes the exchange.
+func SaslSuccess(user string, additionalData *string) SaslResult {
+	return SaslResult{User: user, AdditionalData: additionalData}
+}
+
+// SaslFailure creates a SaslResult that finishes the exchange without authenticating anybody.
+func SaslFailure(code uint, outcome string) SaslResult {
+	return SaslResult{Code: code, Outcome: outcome}
+}
+
+var (
+	saslRegistry     = make(map[string]SaslMechanism)
+	saslRegistryLock sync.RWMutex
+)
+
+// defaultSaslMechanisms are the mechanisms that are enabled when the configuration does not list any.
+var defaultSaslMechanisms = []string{fosp.ScramMechanism, TokenMechanism, "PLAIN", fosp.ServerMechanism}
+
+// RegisterSaslMechanism makes a SASL mechanism available so that it can be enabled in the configuration.
+// It is meant to be called from init functions and panics if a mechanism with the same name is registered twice.
+func RegisterSaslMechanism(mechanism SaslMechanism) {
+	saslRegistryLock.Lock()
+	defer saslRegistryLock.Unlock()
+	if _, ok := saslRegistry[mechanism.Name()]; ok {
+		panic("SASL mechanism " + mechanism.Name() + " registered twice")
+	}
+	saslRegistry[mechanism.Name()] = mechanism
+}
+
+func lookupSaslMechanism(name string) (SaslMechanism, bool) {
+	saslRegistryLock.RLock()
+	defer saslRegistryLock.RUnlock()
+	mechanism, ok := saslRegistry[name]
+	return mechanism, ok
+}
+
+// EnableSaslMechanisms sets the SASL mechanisms that clients of this Server may use, in order of preference.
+// An error is returned if one of the mechanisms is not registered.
+func (s *Server) EnableSaslMechanisms(names []string) error {
+	for _, name := range names {
+		if _, ok := lookupSaslMechanism(name); !ok {
+			return errors.New("Unknown SASL mechanism " + name)
+		}
+	}
+	s.saslMechanisms = append([]string{}, names...)
+	return nil
+}
+
+// saslMechanism returns the mechanism with the given name if it is enabled on this Server.
+func (s *Server) saslMechanism(name string) (SaslMechanism, bool) {
+	if !contains(s.saslMechanisms, name) {
+		return nil, false
+	}
+	return lookupSaslMechanism(name)
+}
+
 type SaslObject struct {
 	Mechanism       string  `json:"mechanism,omitempty"`
 	InitialResponse *string `json:"initial-response,omitempty"`
@@ -41,54 +135,57 @@ func (c *ServerConnection) handleAuth(req *fosp.Request) *fosp.Response {
 	if err != nil {
 		return fosp.NewResponse(fosp.FAILED, fosp.StatusBadRequest)
 	}
-	response := ""
 	if authObj.Sasl.Mechanism != "" {
-		if authObj.Sasl.Mechanism != "PLAIN" {
+		mechanism, ok := c.server.saslMechanism(authObj.Sasl.Mechanism)
+		if !ok {
+			c.sasl = nil
 			return fosp.NewResponse(fosp.FAILED, fosp.StatusNotImplemented)
 		}
-		c.SaslMechanism = "PLAIN"
-		if authObj.Sasl.InitialResponse == nil {
-			content := AuthenticationObject{Sasl: SaslObject{Challenge: "Please provide your user name and password"}}
-			encoded, err := json.Marshal(content)
-			if err != nil {
-				return fosp.NewResponse(fosp.FAILED, fosp.StatusInternalServerError)
-			}
-			resp := fosp.NewResponse(fosp.SUCCEEDED, fosp.StatusAdditionalDataNeeded)
-			resp.Body = bytes.NewBuffer(encoded)
-			return resp
-		}
-		response = *authObj.Sasl.InitialResponse
-	} else {
-		if c.SaslMechanism != "PLAIN" {
-			return fosp.NewResponse(fosp.FAILED, fosp.StatusBadRequest)
-		}
-		if authObj.Sasl.Response == "" {
-			return fosp.NewResponse(fosp.FAILED, fosp.StatusBadRequest)
-		}
-		response = authObj.Sasl.Response
+		c.sasl = mechanism.NewSession(c.server.database)
+		return c.saslStep(authObj.Sasl.InitialResponse)
 	}
-	parts := strings.Split(response, "\x00")
-	if len(parts) != 3 {
+	if c.sasl == nil || authObj.Sasl.Response == "" {
 		return fosp.NewResponse(fosp.FAILED, fosp.StatusBadRequest)
 	}
-	authorizationId := parts[0]
-	authenticationId := parts[1]
-	password := parts[2]
-
-	if authorizationId != "" && authorizationId != authenticationId {
-		content := AuthenticationObject{Sasl: SaslObject{Outcome: "Authorization ID and authentication ID must be the same"}}
-		encoded, err := json.Marshal(content)
-		if err != nil {
-			return fosp.NewResponse(fosp.FAILED, fosp.StatusInternalServerError)
+	return c.saslStep(&authObj.Sasl.Response)
+}
+
+// saslStep feeds a client response into the running SASL session and translates the result into a response.
+func (c *ServerConnection) saslStep(response *string) *fosp.Response {
+	result := c.sasl.Step(response)
+	if result.Challenge != nil {
+		return saslResponse(fosp.SUCCEEDED, fosp.StatusAdditionalDataNeeded, SaslObject{Challenge: *result.Challenge})
+	}
+	c.sasl = nil
+	if result.User == "" && result.Domain == "" {
+		if result.Code == 0 {
+			result.Code = fosp.StatusUnauthorized
 		}
-		resp := fosp.NewResponse(fosp.FAILED, fosp.StatusUnauthorized)
-		resp.Body = bytes.NewBuffer(encoded)
-		return resp
+		if result.Outcome == "" {
+			return fosp.NewResponse(fosp.FAILED, result.Code)
+		}
+		return saslResponse(fosp.FAILED, result.Code, SaslObject{Outcome: result.Outcome})
+	}
+	if result.Domain != "" {
+		servConnLog.Info("Authenticated server %s", result.Domain)
+		c.RemoteDomain = result.Domain
+		c.server.registerConnection(c, "@"+result.Domain)
+	} else {
+		servConnLog.Info("Authenticated user %s", result.User)
+		c.User = result.User
 	}
-	servConnLog.Debug("Authenticating user %s", authenticationId)
-	if c.server.database.Authenticate(authenticationId, password) {
-		c.User = authenticationId
+	if result.AdditionalData == nil {
 		return fosp.NewResponse(fosp.SUCCEEDED, fosp.StatusOK)
 	}
-	return fosp.NewResponse(fosp.FAILED, fosp.StatusUnauthorized)
+	return saslResponse(fosp.SUCCEEDED, fosp.StatusOK, SaslObject{AdditionalData: result.AdditionalData})
+}
+
+func saslResponse(status string, code uint, sasl SaslObject) *fosp.Response {
+	encoded, err := json.Marshal(AuthenticationObject{Sasl: sasl})
+	if err != nil {
+		return fosp.NewResponse(fosp.FAILED, fosp.StatusInternalServerError)
+	}
+	resp := fosp.NewResponse(status, code)
+	resp.Body = bytes.NewBuffer(encoded)
+	return resp
 }
@@ -0,0 +1,224 @@
+// Copyright (C) 2015 Felix Maurer
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"github.com/gorilla/websocket"
+	"github.com/maufl/go-fosp/fosp"
+	"github.com/maufl/go-fosp/fosp/fospclient"
+	"github.com/maufl/go-fosp/fosp/fospws"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+// dialTestServer starts a FOSP server with an in-memory database and opens a client connection to it.
+func dialTestServer(t *testing.T) (*Server, *fospws.Connection, func()) {
+	srv := NewServer(NewMemoryDriver(), "example.com")
+	httpServer := httptest.NewServer(http.HandlerFunc(srv.RequestHandler))
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(httpServer.URL, "http"), http.Header{})
+	if err != nil {
+		httpServer.Close()
+		t.Fatalf("Could not connect to test server: %s", err)
+	}
+	connection := fospws.NewConnection(ws)
+	return srv, connection, func() {
+		connection.Close()
+		httpServer.Close()
+	}
+}
+
+func TestScramAuthentication(t *testing.T) {
+	srv, connection, closer := dialTestServer(t)
+	defer closer()
+	srv.database.Register("alice@example.com", "secret")
+
+	if err := connection.AuthenticateScram("alice@example.com", "wrong"); err == nil {
+		t.Errorf("Authentication with wrong password succeeded")
+	}
+	if err := connection.AuthenticateScram("mallory@example.com", "secret"); err == nil {
+		t.Errorf("Authentication of unknown user succeeded")
+	}
+	if err := connection.AuthenticateScram("alice@example.com", "secret"); err != nil {
+		t.Errorf("Authentication with correct password failed: %s", err)
+	}
+}
+
+func TestScramUnknownUserSalt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fospd-bolt-test-")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	driver := NewBoltDriver(dir + "/scram.db")
+	srv := NewServer(driver, "example.com")
+	salt := func(user string) string {
+		message := "n,,n=" + user + ",r=abc"
+		result := scramMechanism{}.NewSession(srv.database).Step(&message)
+		if result.Challenge == nil {
+			t.Fatalf("Expected a server-first message for %s but got %v", user, result)
+		}
+		attributes, err := fosp.ParseScramMessage(*result.Challenge)
+		if err != nil {
+			t.Fatalf("Invalid server-first message %s", *result.Challenge)
+		}
+		return attributes["s"]
+	}
+	if first, second := salt("mallory@example.com"), salt("mallory@example.com"); first != second {
+		t.Errorf("Salt of unknown user changed between attempts: %s and %s", first, second)
+	}
+	if salt("mallory@example.com") == salt("eve@example.com") {
+		t.Errorf("Unknown users have the same salt")
+	}
+	// The secret is stored in the database, a restarted server makes up the same salt.
+	before := salt("mallory@example.com")
+	driver.Close()
+	driver = NewBoltDriver(dir + "/scram.db")
+	defer driver.Close()
+	srv = NewServer(driver, "example.com")
+	if after := salt("mallory@example.com"); after != before {
+		t.Errorf("Salt of unknown user changed with a restart: %s and %s", before, after)
+	}
+}
+
+func TestPlainAuthentication(t *testing.T) {
+	srv, connection, closer := dialTestServer(t)
+	defer closer()
+	srv.database.Register("alice@example.com", "secret")
+
+	if err := connection.AuthenticatePlain("alice@example.com", "wrong"); err == nil {
+		t.Errorf("Authentication with wrong password succeeded")
+	}
+	if err := connection.AuthenticatePlain("alice@example.com", "secret"); err != nil {
+		t.Errorf("Authentication with correct password failed: %s", err)
+	}
+}
+
+func TestClientRequiresScram(t *testing.T) {
+	srv, connection, closer := dialTestServer(t)
+	defer closer()
+	srv.database.Register("alice@example.com", "secret")
+	srv.EnableSaslMechanisms([]string{"PLAIN"})
+	client := fospclient.New(connection)
+
+	// The password is not sent in cleartext unless the caller allows it.
+	if err := client.Authenticate("alice@example.com", "secret"); err != fospclient.ErrScramUnavailable {
+		t.Errorf("Expected authentication without SCRAM to be refused but got %v", err)
+	}
+	client.AllowPlain = true
+	if err := client.Authenticate("alice@example.com", "secret"); err != nil {
+		t.Errorf("Authentication with allowed PLAIN failed: %s", err)
+	}
+}
+
+func TestSessionTokens(t *testing.T) {
+	srv, connection, closer := dialTestServer(t)
+	defer closer()
+	srv.database.Register("alice@example.com", "secret")
+	srv.database.Register("bob@example.com", "secret")
+
+	if _, err := connection.RequestToken("alice@example.com", "phone"); err == nil {
+		t.Errorf("Unauthenticated connection obtained a token")
+	}
+	if err := connection.AuthenticatePlain("alice@example.com", "secret"); err != nil {
+		t.Fatalf("Authentication failed: %s", err)
+	}
+	token, err := connection.RequestToken("alice@example.com", "phone")
+	if err != nil {
+		t.Fatalf("Could not obtain token: %s", err)
+	}
+	if _, err := connection.RequestToken("bob@example.com", "stolen"); err == nil {
+		t.Errorf("Obtained a token for another user")
+	}
+	if err := connection.AuthenticateToken("bob@example.com", token); err == nil {
+		t.Errorf("Token of alice authenticated bob")
+	}
+	if err := connection.AuthenticateToken("alice@example.com", token+"x"); err == nil {
+		t.Errorf("Modified token was accepted")
+	}
+	if err := connection.AuthenticateToken("alice@example.com", token); err != nil {
+		t.Fatalf("Token was not accepted: %s", err)
+	}
+
+	tokens, _ := srv.database.driver.ListTokens("alice@example.com")
+	if len(tokens) != 1 || tokens[0].Label != "phone" {
+		t.Fatalf("Expected exactly one token labeled phone but got %v", tokens)
+	}
+	req := fosp.NewRequest(fosp.DELETE, mustParseURL(t, "fosp://alice@example.com/.tokens/"+tokens[0].ID))
+	if resp, err := connection.SendRequest(req); err != nil || resp.Code != fosp.StatusNoContent {
+		t.Fatalf("Could not revoke token: %v, %v", resp, err)
+	}
+	if err := connection.AuthenticateToken("alice@example.com", token); err == nil {
+		t.Errorf("Revoked token was accepted")
+	}
+}
+
+// echoMechanism authenticates every client as the user it names in its second response.
+type echoMechanism struct{}
+
+func (echoMechanism) Name() string                        { return "X-ECHO" }
+func (echoMechanism) NewSession(db *Database) SaslSession { return &echoSession{} }
+
+type echoSession struct{ steps int }
+
+func (s *echoSession) Step(response *string) SaslResult {
+	s.steps++
+	if s.steps == 1 {
+		return SaslContinue("Who are you?")
+	}
+	return SaslSuccess(*response, nil)
+}
+
+func init() {
+	RegisterSaslMechanism(echoMechanism{})
+}
+
+func authRequest(body string) *fosp.Request {
+	req := fosp.NewRequest(fosp.AUTH, nil)
+	req.Body = bytes.NewBufferString(body)
+	return req
+}
+
+func TestSaslMechanismRegistry(t *testing.T) {
+	srv := NewServer(NewMemoryDriver(), "example.com")
+	c := &ServerConnection{server: srv}
+	if resp := c.handleRequest(context.Background(), authRequest(`{"sasl": {"mechanism": "X-ECHO"}}`)); resp.Code != fosp.StatusNotImplemented {
+		t.Errorf("Expected disabled mechanism to be rejected but got %s", resp)
+	}
+	if err := srv.EnableSaslMechanisms([]string{"X-UNKNOWN"}); err == nil {
+		t.Errorf("Enabling an unknown mechanism succeeded")
+	}
+	if err := srv.EnableSaslMechanisms([]string{"X-ECHO"}); err != nil {
+		t.Fatalf("Could not enable registered mechanism: %s", err)
+	}
+	if resp := c.handleRequest(context.Background(), authRequest(`{"sasl": {"mechanism": "PLAIN", "initial-response": "\u0000a\u0000b"}}`)); resp.Code != fosp.StatusNotImplemented {
+		t.Errorf("Expected mechanism that is not enabled to be rejected but got %s", resp)
+	}
+	if resp := c.handleRequest(context.Background(), authRequest(`{"sasl": {"mechanism": "X-ECHO"}}`)); resp.Code != fosp.StatusAdditionalDataNeeded {
+		t.Fatalf("Expected a challenge but got %s", resp)
+	}
+	if resp := c.handleRequest(context.Background(), authRequest(`{"sasl": {"response": "alice@example.com"}}`)); resp.Code != fosp.StatusOK || c.User != "alice@example.com" {
+		t.Errorf("Expected to be authenticated as alice but got %s and user %q", resp, c.User)
+	}
+	if resp := c.handleRequest(context.Background(), authRequest(`{"sasl": {"response": "bob@example.com"}}`)); resp.Code != fosp.StatusBadRequest {
+		t.Errorf("Expected response after finished exchange to be rejected but got %s", resp)
+	}
+}
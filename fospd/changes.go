@@ -0,0 +1,110 @@
+// Copyright (C) 2015 Felix Maurer
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"context"
+	"github.com/maufl/go-fosp/fosp"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// The change log of a user records every change of the objects of the user with an increasing change ID, it is
+// written in the same transaction as the change. A client keeps a replica of a subtree in sync by sending
+//
+//	CHANGES alice@example.com/notes 1
+//	Since: 42
+//
+// and applying the returned changes, CREATED and UPDATED mean that the object has to be fetched if the entity tag
+// differs from the one of the replica and DELETED that the object and its descendants are gone. Only the latest change
+// of every object is kept, so a client that missed changes still gets the current state. The cursor of the response is
+// sent in the Since header of the next request.
+
+// changesLimit is the maximum number of changes in one response to a CHANGES request.
+const changesLimit = 1000
+
+// recordChange adds a change of the object at u to the change log of its owner within a transaction.
+func (d *Database) recordChange(store ObjectStore, event string, u *url.URL, etag string) error {
+	return store.RecordChange(u, &fosp.Change{Event: event, URL: u.String(), ETag: etag, Time: time.Now().UTC()})
+}
+
+// Changes returns the changes of the object at u and its descendants after the change ID since.
+// The user needs read permission for the children of the object, and only gets the changes of objects whose data the
+// user may read. Deletions are returned without a check, because the objects are gone and the URLs are known to the
+// replica already.
+func (d *Database) Changes(ctx context.Context, user string, u *url.URL, since uint64) (*fosp.ChangeList, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	object, err := d.driver.GetObjectWithParents(u)
+	if err != nil {
+		return nil, err
+	}
+	// The groups are defined by the owner of the tree, so they are the same for all changed objects.
+	groups := d.groupsOf(ctx, user, u)
+	if !object.PermissionsForChildren(user, groups...).Contain(fosp.PermissionRead) {
+		return nil, Forbidden
+	}
+	changes, last, err := d.driver.ListChanges(u, since, changesLimit+1)
+	if err != nil {
+		return nil, err
+	}
+	list := &fosp.ChangeList{Changes: changes, Cursor: last}
+	if len(changes) > changesLimit {
+		list.Changes, list.More = changes[:changesLimit], true
+		list.Cursor = changes[changesLimit-1].ID
+	}
+	// The cursor stays at the last listed change, even if the user may not read it.
+	readable := make([]*fosp.Change, 0, len(list.Changes))
+	for _, change := range list.Changes {
+		if change.Event == fosp.DELETED || d.mayReadChanged(user, groups, change) {
+			readable = append(readable, change)
+		}
+	}
+	list.Changes = readable
+	return list, nil
+}
+
+// mayReadChanged returns whether user may read the data of the object that was created or updated by change.
+// Objects that are gone meanwhile are left out, their deletion follows later in the change log.
+func (d *Database) mayReadChanged(user string, groups []string, change *fosp.Change) bool {
+	u, err := url.Parse(change.URL)
+	if err != nil {
+		dbLog.Warning("Change with invalid URL %s :: %s", change.URL, err)
+		return false
+	}
+	object, err := d.driver.GetObjectWithParents(u)
+	if err != nil {
+		return false
+	}
+	return object.PermissionsForData(user, groups...).Contain(fosp.PermissionRead)
+}
+
+func (c *ServerConnection) handleChanges(ctx context.Context, user string, req *fosp.Request) *fosp.Response {
+	var since uint64
+	if header := req.Header.Get(fosp.SinceHeader); header != "" {
+		var err error
+		if since, err = strconv.ParseUint(header, 10, 64); err != nil {
+			return fosp.NewResponse(fosp.FAILED, fosp.StatusBadRequest)
+		}
+	}
+	list, err := c.server.database.Changes(ctx, user, req.URL, since)
+	if err != nil {
+		return failedResponse(err)
+	}
+	return jsonResponse(fosp.StatusOK, list)
+}
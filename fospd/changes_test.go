@@ -0,0 +1,103 @@
+// Copyright (C) 2015 Felix Maurer
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"context"
+	"github.com/maufl/go-fosp/fosp"
+	"github.com/maufl/go-fosp/fosp/fospclient"
+	"strings"
+	"testing"
+)
+
+func TestChanges(t *testing.T) {
+	srv, connection, closer := dialTestServer(t)
+	defer closer()
+	client := fospclient.New(connection)
+	db := srv.database
+	db.Register("alice@example.com", "secret")
+	db.Register("bob@example.com", "secret")
+	if err := client.Authenticate("alice@example.com", "secret"); err != nil {
+		t.Fatalf("Authenticate failed: %s", err)
+	}
+	notes := mustParseURL(t, "fosp://alice@example.com/notes")
+	child := mustParseURL(t, "fosp://alice@example.com/notes/a")
+	client.Create(notes, fosp.NewObject())
+	client.Create(child, fosp.NewObject())
+	client.Patch(child, fosp.PatchObject{"data": "changed"})
+	if err := client.Write(notes, strings.NewReader("attachment")); err != nil {
+		t.Fatalf("Write failed: %s", err)
+	}
+	client.Create(mustParseURL(t, "fosp://alice@example.com/other"), fosp.NewObject())
+	client.Delete(child)
+
+	list, err := client.Changes(notes, 0)
+	if err != nil {
+		t.Fatalf("Changes failed: %s", err)
+	}
+	if len(list.Changes) != 2 || list.Cursor != 6 || list.More {
+		t.Fatalf("Changes of notes are %+v", list)
+	}
+	object, _ := client.Get(notes)
+	if change := list.Changes[0]; change.ID != 4 || change.Event != fosp.UPDATED || change.URL != notes.String() || change.ETag != object.ETag {
+		t.Errorf("Change of the attachment is %+v, the entity tag is %s", change, object.ETag)
+	}
+	if change := list.Changes[1]; change.ID != 6 || change.Event != fosp.DELETED || change.URL != child.String() {
+		t.Errorf("Change of the deleted child is %+v", change)
+	}
+	if list, err := client.Changes(notes, list.Cursor); err != nil || len(list.Changes) != 0 || list.Cursor != 6 {
+		t.Errorf("Changes after the cursor are %+v, %v", list, err)
+	}
+	if _, err := client.Changes(mustParseURL(t, "fosp://bob@example.com/"), 0); !fospclient.IsForbidden(err) {
+		t.Errorf("Reading the changes of another user returned %v", err)
+	}
+}
+
+func TestChangesArePermissionFiltered(t *testing.T) {
+	db := newTestDatabase(t)
+	notes := mustParseURL(t, "fosp://alice@example.com/notes")
+	public := mustParseURL(t, "fosp://alice@example.com/notes/public")
+	private := mustParseURL(t, "fosp://alice@example.com/notes/private")
+	for _, u := range []string{notes.String(), public.String(), private.String()} {
+		if _, err := db.Create(context.Background(), "alice@example.com", mustParseURL(t, u), fosp.NewObject()); err != nil {
+			t.Fatalf("Creating %s failed: %s", u, err)
+		}
+	}
+
+	_, err := db.Changes(context.Background(), "bob@example.com", notes, 0)
+	expectForbidden(t, "CHANGES", err)
+
+	grant := func(u string, permissions map[string]interface{}) {
+		patch := fosp.PatchObject{"acl": map[string]interface{}{"users": map[string]interface{}{"bob@example.com": permissions}}}
+		if _, err := db.Patch(context.Background(), "alice@example.com", mustParseURL(t, u), Preconditions{}, patch); err != nil {
+			t.Fatalf("Granting permissions on %s failed: %s", u, err)
+		}
+	}
+	grant(notes.String(), map[string]interface{}{"children": []interface{}{"read"}})
+	grant(public.String(), map[string]interface{}{"data": []interface{}{"read"}})
+	db.Delete(context.Background(), "alice@example.com", private, Preconditions{})
+
+	list, err := db.Changes(context.Background(), "bob@example.com", notes, 0)
+	if err != nil {
+		t.Fatalf("Changes failed: %s", err)
+	}
+	if len(list.Changes) != 2 || list.Changes[0].URL != public.String() || list.Changes[1].Event != fosp.DELETED || list.Changes[1].URL != private.String() {
+		t.Errorf("Changes visible to bob are %+v", list.Changes)
+	}
+	if list.Cursor != 6 {
+		t.Errorf("Cursor of the filtered changes is %d", list.Cursor)
+	}
+}
@@ -0,0 +1,115 @@
+// Copyright (C) 2015 Felix Maurer
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"context"
+	"github.com/gorilla/websocket"
+	"github.com/maufl/go-fosp/fosp"
+	"github.com/maufl/go-fosp/fosp/fospws"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSendRequestContext(t *testing.T) {
+	// The silent server accepts WebSocket connections but never answers.
+	silent := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		ws, err := websocket.Upgrade(res, req, nil, 1024, 1024)
+		if err != nil {
+			return
+		}
+		defer ws.Close()
+		for {
+			if _, _, err := ws.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+	defer silent.Close()
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(silent.URL, "http"), http.Header{})
+	if err != nil {
+		t.Fatalf("Could not connect to silent server: %s", err)
+	}
+	connection := fospws.NewConnection(ws)
+	defer connection.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	req := fosp.NewRequest(fosp.GET, mustParseURL(t, "fosp://alice@example.com/"))
+	if _, err := connection.SendRequestContext(ctx, req); err != context.DeadlineExceeded {
+		t.Errorf("Expected deadline to be exceeded but got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Request was not abandoned at the deadline but after %s", elapsed)
+	}
+	if timeout, ok := req.Timeout(); !ok || timeout > 50*time.Millisecond {
+		t.Errorf("Expected deadline to be announced in the request but got %s", timeout)
+	}
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := connection.SendRequestContext(cancelled, fosp.NewRequest(fosp.OPTIONS, nil)); err != context.Canceled {
+		t.Errorf("Expected cancelled request to fail but got %v", err)
+	}
+}
+
+func TestRequestContextHonorsTimeout(t *testing.T) {
+	connCtx, closeConnection := context.WithCancel(context.Background())
+	c := &ServerConnection{ctx: connCtx}
+	req := fosp.NewRequest(fosp.GET, nil)
+	req.SetTimeout(time.Minute)
+	ctx, cancel := c.requestContext(req)
+	defer cancel()
+	if deadline, ok := ctx.Deadline(); !ok || time.Until(deadline) > time.Minute {
+		t.Errorf("Expected request context to expire with the announced timeout")
+	}
+	closeConnection()
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Errorf("Request context was not cancelled when the connection closed")
+	}
+}
+
+func TestEndedContextAbandonsChanges(t *testing.T) {
+	db := NewServer(NewMemoryDriver(), "example.com").database
+	db.Register("alice@example.com", "secret")
+	notes := mustParseURL(t, "fosp://alice@example.com/notes")
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := db.Create(cancelled, "alice@example.com", notes, fosp.NewObject()); err != context.Canceled {
+		t.Errorf("Expected create with cancelled context to fail but got %v", err)
+	}
+	if _, err := db.Get(context.Background(), "alice@example.com", notes); err == nil {
+		t.Errorf("Object was created although the context was cancelled")
+	}
+	if resp := failedResponse(context.DeadlineExceeded); resp.Code != fosp.StatusGatewayTimeout {
+		t.Errorf("Expected an expired request to time out but got %s", resp)
+	}
+
+	db.Create(context.Background(), "alice@example.com", notes, fosp.NewObject())
+	if _, err := db.Write(cancelled, "alice@example.com", notes, Preconditions{}, strings.NewReader("data")); err != context.Canceled {
+		t.Errorf("Expected write with cancelled context to fail but got %v", err)
+	}
+	if object, _ := db.Get(context.Background(), "alice@example.com", notes); object.Attachment != nil {
+		t.Errorf("Attachment was written although the context was cancelled")
+	}
+}
@@ -0,0 +1,860 @@
+// Copyright (C) 2015 Felix Maurer
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"bytes"
+	"code.google.com/p/go.crypto/bcrypt"
+	"encoding/binary"
+	"encoding/json"
+	"github.com/maufl/go-fosp/fosp"
+	"github.com/op/go-logging"
+	bolt "go.etcd.io/bbolt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+var boltLog = logging.MustGetLogger("go-fosp/fosp/bolt-driver")
+
+var (
+	boltUsersBucket       = []byte("users")
+	boltObjectsBucket     = []byte("objects")
+	boltAttachmentsBucket = []byte("attachment-digests")
+	boltBlobsBucket       = []byte("blobs")
+	boltReferencesBucket  = []byte("blob-references")
+	boltTokensBucket      = []byte("tokens")
+	boltSecretsBucket     = []byte("secrets")
+	// boltNotificationsBucket contains a bucket per user whose records are keyed by their sequence number.
+	boltNotificationsBucket = []byte("notifications")
+	// boltChangesBucket contains the change log of every user in a bucket whose changes are keyed by their ID,
+	// boltChangeIndexBucket a bucket per user that maps the URLs in the change log to the IDs of their changes.
+	boltChangesBucket     = []byte("changes")
+	boltChangeIndexBucket = []byte("change-index")
+	// boltUsageBucket maps every user to the storage used under the root of the user, encoded as JSON.
+	// Users that were registered before the usage was kept have no entry until it is counted once.
+	boltUsageBucket = []byte("usage")
+)
+
+// boltUser is the record stored for every user in the users bucket.
+type boltUser struct {
+	Password []byte                 `json:"password"`
+	Scram    *fosp.ScramCredentials `json:"scram"`
+}
+
+// BoltDriver implements the database specific operations for storing the data in a single bolt database file.
+// Users, objects and attachments are each kept in their own bucket, objects and attachments are keyed by URL.
+// The attachments bucket maps to the digest of the content, which is stored once in the blobs bucket
+// and reference counted in the blob-references bucket.
+// BoltDriver adheres to the DatabaseDriver interface and can be used by the Database object.
+type BoltDriver struct {
+	db *bolt.DB
+}
+
+// NewBoltDriver opens or creates the database file at the given path and instanciates a new BoltDriver for it.
+func NewBoltDriver(file string) *BoltDriver {
+	d := new(BoltDriver)
+	var err error
+	d.db, err = bolt.Open(file, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		boltLog.Fatal("Error occured when opening database file %s :: %s", file, err)
+	}
+	err = d.db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{boltUsersBucket, boltObjectsBucket, boltAttachmentsBucket, boltBlobsBucket, boltReferencesBucket, boltTokensBucket, boltNotificationsBucket, boltChangesBucket, boltChangeIndexBucket, boltUsageBucket, boltSecretsBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		boltLog.Fatal("Error occured when initializing database file %s :: %s", file, err)
+	}
+	return d
+}
+
+// Authenticate checks whether the name password pair is valid.
+func (d *BoltDriver) Authenticate(name, password string) bool {
+	user, err := d.getUser(name)
+	if err != nil {
+		boltLog.Error("No user %s known for authentication", name)
+		return false
+	}
+	if err := bcrypt.CompareHashAndPassword(user.Password, []byte(password)); err != nil {
+		boltLog.Error("Error while comparing password hashes :: %s", err)
+		return false
+	}
+	return true
+}
+
+// Register creates a new user and stores the object o as the root object of the user.
+func (d *BoltDriver) Register(name, password string, o *fosp.Object) bool {
+	passwordHash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return false
+	}
+	scram, err := fosp.NewScramCredentials(password)
+	if err != nil {
+		boltLog.Error("Error while deriving SCRAM credentials :: %s", err)
+		return false
+	}
+	record, err := json.Marshal(boltUser{Password: passwordHash, Scram: scram})
+	if err != nil {
+		boltLog.Error("Error while marshaling user :: %s", err)
+		return false
+	}
+	url, _ := url.Parse("fosp://" + name + "/")
+	content, err := json.Marshal(o)
+	if err != nil {
+		boltLog.Error("Error while marshaling object :: %s", err)
+		return false
+	}
+	usage, err := json.Marshal(objectUsage(o))
+	if err != nil {
+		boltLog.Error("Error while marshaling usage :: %s", err)
+		return false
+	}
+	err = d.db.Update(func(tx *bolt.Tx) error {
+		users := tx.Bucket(boltUsersBucket)
+		if users.Get([]byte(name)) != nil {
+			return NewFospError("User already exists", fosp.StatusConflict)
+		}
+		if err := users.Put([]byte(name), record); err != nil {
+			return err
+		}
+		if err := tx.Bucket(boltUsageBucket).Put([]byte(name), usage); err != nil {
+			return err
+		}
+		return tx.Bucket(boltObjectsBucket).Put([]byte(url.String()), content)
+	})
+	if err != nil {
+		boltLog.Error("Error when adding new user :: %s", err)
+		return false
+	}
+	return true
+}
+
+// ScramCredentials returns the stored SCRAM verifier of the user.
+func (d *BoltDriver) ScramCredentials(name string) (*fosp.ScramCredentials, error) {
+	user, err := d.getUser(name)
+	if err != nil {
+		return nil, err
+	}
+	return user.Scram, nil
+}
+
+func (d *BoltDriver) getUser(name string) (*boltUser, error) {
+	user := &boltUser{}
+	err := d.db.View(func(tx *bolt.Tx) error {
+		record := tx.Bucket(boltUsersBucket).Get([]byte(name))
+		if record == nil {
+			return NewFospError("User not found", fosp.StatusNotFound)
+		}
+		return json.Unmarshal(record, user)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// CreateToken stores a new session token.
+func (d *BoltDriver) CreateToken(token *SessionToken) error {
+	record, err := json.Marshal(token)
+	if err != nil {
+		boltLog.Error("Error while marshaling token :: %s", err)
+		return InternalServerError
+	}
+	return d.db.Update(func(tx *bolt.Tx) error {
+		tokens := tx.Bucket(boltTokensBucket)
+		if tokens.Get([]byte(token.ID)) != nil {
+			return NewFospError("Token already exists", fosp.StatusConflict)
+		}
+		return tokens.Put([]byte(token.ID), record)
+	})
+}
+
+// GetToken returns the session token with the given ID.
+func (d *BoltDriver) GetToken(id string) (*SessionToken, error) {
+	token := &SessionToken{}
+	err := d.db.View(func(tx *bolt.Tx) error {
+		record := tx.Bucket(boltTokensBucket).Get([]byte(id))
+		if record == nil {
+			return NewFospError("Token not found", fosp.StatusNotFound)
+		}
+		return json.Unmarshal(record, token)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+// ListTokens returns all session tokens of the user.
+func (d *BoltDriver) ListTokens(user string) ([]*SessionToken, error) {
+	tokens := make([]*SessionToken, 0)
+	err := d.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltTokensBucket).ForEach(func(k, v []byte) error {
+			token := &SessionToken{}
+			if err := json.Unmarshal(v, token); err != nil {
+				return err
+			}
+			if token.User == user {
+				tokens = append(tokens, token)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		boltLog.Error("Error while listing tokens :: %s", err)
+		return nil, InternalServerError
+	}
+	return tokens, nil
+}
+
+// DeleteToken revokes the session token with the given ID of the user.
+func (d *BoltDriver) DeleteToken(user, id string) error {
+	token, err := d.GetToken(id)
+	if err != nil {
+		return err
+	}
+	if token.User != user {
+		return NewFospError("Token not found", fosp.StatusNotFound)
+	}
+	return d.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltTokensBucket).Delete([]byte(id))
+	})
+}
+
+// ServerSecret returns the secret with the given name from the secrets bucket.
+func (d *BoltDriver) ServerSecret(name string) (secret []byte, err error) {
+	err = d.db.Update(func(tx *bolt.Tx) error {
+		secrets := tx.Bucket(boltSecretsBucket)
+		if stored := secrets.Get([]byte(name)); stored != nil {
+			secret = append([]byte{}, stored...)
+			return nil
+		}
+		if secret, err = newSecret(); err != nil {
+			return err
+		}
+		return secrets.Put([]byte(name), secret)
+	})
+	if err != nil {
+		boltLog.Error("Error while reading secret %s :: %s", name, err)
+		return nil, InternalServerError
+	}
+	return secret, nil
+}
+
+// QueueNotification appends the record to the notification bucket of the user.
+func (d *BoltDriver) QueueNotification(user string, record *fosp.NotificationRecord, retention NotificationRetention) error {
+	return d.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(boltUsersBucket).Get([]byte(user)) == nil {
+			return NewFospError("User not found", fosp.StatusNotFound)
+		}
+		queue, err := tx.Bucket(boltNotificationsBucket).CreateBucketIfNotExists([]byte(user))
+		if err != nil {
+			return err
+		}
+		if record.Seq, err = queue.NextSequence(); err != nil {
+			return err
+		}
+		value, err := json.Marshal(record)
+		if err != nil {
+			boltLog.Error("Error while marshaling notification :: %s", err)
+			return InternalServerError
+		}
+		if err := queue.Put(boltCount(record.Seq), value); err != nil {
+			return err
+		}
+		expired := make([][]byte, 0)
+		cursor := queue.Cursor()
+		for k, v := cursor.First(); k != nil; k, v = cursor.Next() {
+			stored := &fosp.NotificationRecord{}
+			if err := json.Unmarshal(v, stored); err != nil {
+				return err
+			}
+			if !retention.expired(stored, record.Seq) {
+				break
+			}
+			expired = append(expired, k)
+		}
+		for _, k := range expired {
+			if err := queue.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// ListNotifications returns the queued records of the user after since.
+func (d *BoltDriver) ListNotifications(user string, since uint64) ([]*fosp.NotificationRecord, error) {
+	records := make([]*fosp.NotificationRecord, 0)
+	err := d.db.View(func(tx *bolt.Tx) error {
+		queue := tx.Bucket(boltNotificationsBucket).Bucket([]byte(user))
+		if queue == nil {
+			return nil
+		}
+		cursor := queue.Cursor()
+		for k, v := cursor.Seek(boltCount(since + 1)); k != nil; k, v = cursor.Next() {
+			record := &fosp.NotificationRecord{}
+			if err := json.Unmarshal(v, record); err != nil {
+				return err
+			}
+			records = append(records, record)
+		}
+		return nil
+	})
+	if err != nil {
+		boltLog.Error("Error while listing notifications :: %s", err)
+		return nil, InternalServerError
+	}
+	return records, nil
+}
+
+// AckNotifications removes the queued records of the user up to and including seq.
+func (d *BoltDriver) AckNotifications(user string, seq uint64) error {
+	return d.db.Update(func(tx *bolt.Tx) error {
+		queue := tx.Bucket(boltNotificationsBucket).Bucket([]byte(user))
+		if queue == nil {
+			return nil
+		}
+		acknowledged := make([][]byte, 0)
+		cursor := queue.Cursor()
+		for k, _ := cursor.First(); k != nil && binary.BigEndian.Uint64(k) <= seq; k, _ = cursor.Next() {
+			acknowledged = append(acknowledged, k)
+		}
+		for _, k := range acknowledged {
+			if err := queue.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// GetObjectWithParents returns an object and all it's parents from the database.
+// The parents are stored recursively in the object.
+func (d *BoltDriver) GetObjectWithParents(u *url.URL) (object fosp.Object, err error) {
+	err = d.db.View(func(tx *bolt.Tx) error {
+		object, err = boltStore{tx}.GetObjectWithParents(u)
+		return err
+	})
+	return
+}
+
+// CreateObject saves a new object to the database under the given URL.
+func (d *BoltDriver) CreateObject(u *url.URL, o *fosp.Object) error {
+	return d.db.Update(func(tx *bolt.Tx) error {
+		return boltStore{tx}.CreateObject(u, o)
+	})
+}
+
+// UpdateObject replaces the object at the given URL with a new object.
+func (d *BoltDriver) UpdateObject(u *url.URL, o *fosp.Object) error {
+	return d.db.Update(func(tx *bolt.Tx) error {
+		return boltStore{tx}.UpdateObject(u, o)
+	})
+}
+
+// ListObjects returns an array of child object names of the object at the given URL.
+func (d *BoltDriver) ListObjects(u *url.URL) (names []string, err error) {
+	err = d.db.View(func(tx *bolt.Tx) error {
+		names, err = boltStore{tx}.ListObjects(u)
+		return err
+	})
+	return
+}
+
+// DeleteObjects deletes the object at the given URL, all its children and their attachments.
+func (d *BoltDriver) DeleteObjects(u *url.URL) error {
+	return d.db.Update(func(tx *bolt.Tx) error {
+		return boltStore{tx}.DeleteObjects(u)
+	})
+}
+
+// Usage returns the storage used under the root of the owner of the object at the given URL.
+func (d *BoltDriver) Usage(u *url.URL) (usage Usage, err error) {
+	err = d.db.View(func(tx *bolt.Tx) error {
+		usage, err = boltStore{tx}.Usage(u)
+		return err
+	})
+	return
+}
+
+// LinkAttachment makes the staged content the attachment of the object at the given URL.
+func (d *BoltDriver) LinkAttachment(u *url.URL, staged *StagedAttachment) error {
+	return d.db.Update(func(tx *bolt.Tx) error {
+		return boltStore{tx}.LinkAttachment(u, staged)
+	})
+}
+
+// RecordChange appends the change to the change log of the owner of the object at the given URL.
+func (d *BoltDriver) RecordChange(u *url.URL, change *fosp.Change) error {
+	return d.db.Update(func(tx *bolt.Tx) error {
+		return boltStore{tx}.RecordChange(u, change)
+	})
+}
+
+// ListChanges returns the changes of the object at the given URL and its descendants after since.
+func (d *BoltDriver) ListChanges(u *url.URL, since uint64, limit int) ([]*fosp.Change, uint64, error) {
+	changes := make([]*fosp.Change, 0)
+	var last uint64
+	prefix := childPrefix(u)
+	err := d.db.View(func(tx *bolt.Tx) error {
+		log := tx.Bucket(boltChangesBucket).Bucket([]byte(rootOwner(u)))
+		if log == nil {
+			return nil
+		}
+		last = log.Sequence()
+		c := log.Cursor()
+		for k, v := c.Seek(boltCount(since + 1)); k != nil && len(changes) < limit; k, v = c.Next() {
+			change := &fosp.Change{}
+			if err := json.Unmarshal(v, change); err != nil {
+				return err
+			}
+			if change.URL == u.String() || strings.HasPrefix(change.URL, prefix) {
+				changes = append(changes, change)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		boltLog.Error("Error while listing changes :: %s", err)
+		return nil, 0, InternalServerError
+	}
+	return changes, last, nil
+}
+
+// Transaction runs fn in a single bolt write transaction, which is rolled back if fn fails.
+func (d *BoltDriver) Transaction(fn func(ObjectStore) error) error {
+	return d.db.Update(func(tx *bolt.Tx) error {
+		return fn(boltStore{tx})
+	})
+}
+
+// ReadAttachment returns a reader for the attached file of the object at the given URL.
+// Bolt values are only valid during a transaction, so the attachment is copied into memory.
+func (d *BoltDriver) ReadAttachment(u *url.URL) (io.ReadSeekCloser, string, error) {
+	var data []byte
+	var digest string
+	err := d.db.View(func(tx *bolt.Tx) error {
+		key := tx.Bucket(boltAttachmentsBucket).Get([]byte(u.String()))
+		if key == nil {
+			return NewFospError("Attachment not found", fosp.StatusNotFound)
+		}
+		digest = string(key)
+		data = append([]byte{}, tx.Bucket(boltBlobsBucket).Get(key)...)
+		return nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return nopSeekCloser{bytes.NewReader(data)}, digest, nil
+}
+
+// StageAttachment reads data into memory, preceded by the first offset bytes of the current attachment.
+func (d *BoltDriver) StageAttachment(u *url.URL, offset int64, data io.Reader) (*StagedAttachment, error) {
+	content, readErr := ioutil.ReadAll(data)
+	staged := &StagedAttachment{}
+	if offset > 0 {
+		err := d.db.View(func(tx *bolt.Tx) error {
+			var existing []byte
+			if key := tx.Bucket(boltAttachmentsBucket).Get([]byte(u.String())); key != nil {
+				existing, staged.Base = tx.Bucket(boltBlobsBucket).Get(key), string(key)
+			}
+			if offset > int64(len(existing)) {
+				return NewFospError("Offset is beyond the end of the attachment", fosp.StatusRangeNotSatisfiable)
+			}
+			content = append(append([]byte{}, existing[:offset]...), content...)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	staged.content = content
+	staged.Size = int64(len(content))
+	staged.Digest = fosp.Digest(content)
+	return staged, readErr
+}
+
+// DiscardAttachment does nothing, staged content is only kept by the StagedAttachment itself.
+func (d *BoltDriver) DiscardAttachment(staged *StagedAttachment) {}
+
+// boltStore implements the ObjectStore operations of the BoltDriver within a bolt transaction.
+type boltStore struct {
+	tx *bolt.Tx
+}
+
+func (s boltStore) GetObjectWithParents(u *url.URL) (fosp.Object, error) {
+	urls := urlFamily(u)
+	var parent *fosp.Object
+	objects := s.tx.Bucket(boltObjectsBucket)
+	// urlFamily returns the URLs starting with the object itself, so walk it backwards to start at the root.
+	for i := len(urls) - 1; i >= 0; i-- {
+		content := objects.Get([]byte(urls[i].String()))
+		if content == nil {
+			boltLog.Debug("Object %s not found", urls[i])
+			return fosp.Object{}, NewFospError("Object not found", fosp.StatusNotFound)
+		}
+		obj := fosp.NewObject()
+		if err := json.Unmarshal(content, obj); err != nil {
+			boltLog.Critical("Error when unmarshaling json ::%T %s", err, err)
+			return fosp.Object{}, InternalServerError
+		}
+		obj.URL = urls[i]
+		obj.Parent = parent
+		parent = obj
+	}
+	return *parent, nil
+}
+
+func (s boltStore) CreateObject(u *url.URL, o *fosp.Object) error {
+	content, err := json.Marshal(o)
+	if err != nil {
+		boltLog.Error("Error while marshaling object :: %s", err)
+		return InternalServerError
+	}
+	parentURL := *u
+	parentURL.Path = path.Dir(u.Path)
+	objects := s.tx.Bucket(boltObjectsBucket)
+	if objects.Get([]byte(parentURL.String())) == nil {
+		boltLog.Error("Parent %s for new object does not exist", &parentURL)
+		return NewFospError("Parent object not found", fosp.StatusNotFound)
+	}
+	if objects.Get([]byte(u.String())) != nil {
+		return NewFospError("Object already exists", fosp.StatusConflict)
+	}
+	if err := s.changeUsage(u, objectUsage(o)); err != nil {
+		return err
+	}
+	if err := objects.Put([]byte(u.String()), content); err != nil {
+		boltLog.Error("Error when adding new object :: %s", err)
+		return InternalServerError
+	}
+	return nil
+}
+
+func (s boltStore) UpdateObject(u *url.URL, o *fosp.Object) error {
+	content, err := json.Marshal(o)
+	if err != nil {
+		boltLog.Error("Error while marshaling object :: %s", err)
+		return InternalServerError
+	}
+	objects := s.tx.Bucket(boltObjectsBucket)
+	old := objects.Get([]byte(u.String()))
+	if old == nil {
+		return NewFospError("Object not found", fosp.StatusNotFound)
+	}
+	oldUsage, err := storedUsage(old)
+	if err != nil {
+		boltLog.Error("Error when unmarshaling json of %s :: %s", u, err)
+		return InternalServerError
+	}
+	if err := s.changeUsage(u, objectUsage(o).minus(oldUsage)); err != nil {
+		return err
+	}
+	if err := objects.Put([]byte(u.String()), content); err != nil {
+		boltLog.Error("Error while updating object :: %s", err)
+		return InternalServerError
+	}
+	return nil
+}
+
+func (s boltStore) ListObjects(u *url.URL) ([]string, error) {
+	prefix := []byte(childPrefix(u))
+	names := make([]string, 0, 25)
+	objects := s.tx.Bucket(boltObjectsBucket)
+	if objects.Get([]byte(u.String())) == nil {
+		return nil, NewFospError("Object not found", fosp.StatusNotFound)
+	}
+	c := objects.Cursor()
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+		if name := string(k[len(prefix):]); name != "" && !strings.Contains(name, "/") {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+func (s boltStore) DeleteObjects(u *url.URL) error {
+	prefix := []byte(childPrefix(u))
+	objects := s.tx.Bucket(boltObjectsBucket)
+	if objects.Get([]byte(u.String())) == nil {
+		return NewFospError("Object not found", fosp.StatusNotFound)
+	}
+	keys := [][]byte{[]byte(u.String())}
+	c := objects.Cursor()
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+		keys = append(keys, append([]byte{}, k...))
+	}
+	deleted := Usage{}
+	for _, key := range keys {
+		usage, err := storedUsage(objects.Get(key))
+		if err != nil {
+			boltLog.Error("Error when unmarshaling json of %s :: %s", key, err)
+			return InternalServerError
+		}
+		deleted = deleted.plus(usage)
+	}
+	if err := s.changeUsage(u, Usage{}.minus(deleted)); err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := objects.Delete(key); err != nil {
+			boltLog.Error("Error while deleting object %s :: %s", key, err)
+			return InternalServerError
+		}
+		if err := boltUnlinkAttachment(s.tx, key); err != nil {
+			boltLog.Error("Error while deleting attachment %s :: %s", key, err)
+			return InternalServerError
+		}
+	}
+	return nil
+}
+
+func (s boltStore) Usage(u *url.URL) (Usage, error) {
+	owner := []byte(rootOwner(u))
+	usage := Usage{}
+	if record := s.tx.Bucket(boltUsageBucket).Get(owner); record != nil {
+		if err := json.Unmarshal(record, &usage); err != nil {
+			boltLog.Error("Error when unmarshaling usage of %s :: %s", owner, err)
+			return Usage{}, InternalServerError
+		}
+		return usage, nil
+	}
+	root := []byte("fosp://" + string(owner) + "/")
+	c := s.tx.Bucket(boltObjectsBucket).Cursor()
+	for k, v := c.Seek(root); k != nil && bytes.HasPrefix(k, root); k, v = c.Next() {
+		object, err := storedUsage(v)
+		if err != nil {
+			boltLog.Error("Error while computing usage of %s :: %s", owner, err)
+			return Usage{}, InternalServerError
+		}
+		usage = usage.plus(object)
+	}
+	if s.tx.Writable() {
+		return usage, s.putUsage(owner, usage)
+	}
+	return usage, nil
+}
+
+// changeUsage adds delta to the usage of the owner of the object at u.
+// It has to be called before the objects are changed, the usage of users without an entry is counted first.
+func (s boltStore) changeUsage(u *url.URL, delta Usage) error {
+	if delta == (Usage{}) {
+		return nil
+	}
+	usage, err := s.Usage(u)
+	if err != nil {
+		return err
+	}
+	return s.putUsage([]byte(rootOwner(u)), usage.plus(delta))
+}
+
+func (s boltStore) putUsage(owner []byte, usage Usage) error {
+	record, err := json.Marshal(usage)
+	if err != nil {
+		boltLog.Error("Error while marshaling usage :: %s", err)
+		return InternalServerError
+	}
+	if err := s.tx.Bucket(boltUsageBucket).Put(owner, record); err != nil {
+		boltLog.Error("Error while storing usage of %s :: %s", owner, err)
+		return InternalServerError
+	}
+	return nil
+}
+
+func (s boltStore) RecordChange(u *url.URL, change *fosp.Change) error {
+	owner := []byte(rootOwner(u))
+	log, err := s.tx.Bucket(boltChangesBucket).CreateBucketIfNotExists(owner)
+	if err != nil {
+		return err
+	}
+	index, err := s.tx.Bucket(boltChangeIndexBucket).CreateBucketIfNotExists(owner)
+	if err != nil {
+		return err
+	}
+	key := []byte(u.String())
+	stale := make([][]byte, 0)
+	if index.Get(key) != nil {
+		stale = append(stale, key)
+	}
+	if change.Event == fosp.DELETED {
+		prefix := []byte(childPrefix(u))
+		c := index.Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			stale = append(stale, append([]byte{}, k...))
+		}
+	}
+	for _, k := range stale {
+		if err := log.Delete(index.Get(k)); err != nil {
+			return err
+		}
+		if err := index.Delete(k); err != nil {
+			return err
+		}
+	}
+	if change.ID, err = log.NextSequence(); err != nil {
+		return err
+	}
+	value, err := json.Marshal(change)
+	if err != nil {
+		boltLog.Error("Error while marshaling change :: %s", err)
+		return InternalServerError
+	}
+	if err := log.Put(boltCount(change.ID), value); err != nil {
+		return err
+	}
+	return index.Put(key, boltCount(change.ID))
+}
+
+func (s boltStore) LinkAttachment(u *url.URL, staged *StagedAttachment) error {
+	key := []byte(u.String())
+	if s.tx.Bucket(boltObjectsBucket).Get(key) == nil {
+		return NewFospError("Object not found", fosp.StatusNotFound)
+	}
+	if staged.Base != "" && string(s.tx.Bucket(boltAttachmentsBucket).Get(key)) != staged.Base {
+		return AttachmentChanged
+	}
+	if _, err := boltLinkAttachment(s.tx, key, staged.content); err != nil {
+		boltLog.Error("Error while storing attachment of %s :: %s", u, err)
+		return InternalServerError
+	}
+	return nil
+}
+
+// boltLinkAttachment makes content the attachment of the object with the given key and returns its digest.
+func boltLinkAttachment(tx *bolt.Tx, key, content []byte) (string, error) {
+	digest := []byte(fosp.Digest(content))
+	blobs, references := tx.Bucket(boltBlobsBucket), tx.Bucket(boltReferencesBucket)
+	count := uint64(0)
+	if value := references.Get(digest); value != nil {
+		count = binary.BigEndian.Uint64(value)
+	} else if err := blobs.Put(digest, content); err != nil {
+		return "", err
+	}
+	if err := references.Put(digest, boltCount(count+1)); err != nil {
+		return "", err
+	}
+	if err := boltUnlinkAttachment(tx, key); err != nil {
+		return "", err
+	}
+	return string(digest), tx.Bucket(boltAttachmentsBucket).Put(key, digest)
+}
+
+// boltUnlinkAttachment removes the attachment of the object with the given key.
+// The content is deleted when it is not referenced by any other object.
+func boltUnlinkAttachment(tx *bolt.Tx, key []byte) error {
+	attachments, references := tx.Bucket(boltAttachmentsBucket), tx.Bucket(boltReferencesBucket)
+	value := attachments.Get(key)
+	if value == nil {
+		return nil
+	}
+	digest := append([]byte{}, value...)
+	if err := attachments.Delete(key); err != nil {
+		return err
+	}
+	count := uint64(0)
+	if value := references.Get(digest); value != nil {
+		count = binary.BigEndian.Uint64(value)
+	}
+	if count > 1 {
+		return references.Put(digest, boltCount(count-1))
+	}
+	if err := references.Delete(digest); err != nil {
+		return err
+	}
+	return tx.Bucket(boltBlobsBucket).Delete(digest)
+}
+
+// boltCount encodes a reference count or a sequence number as a bolt value.
+func boltCount(count uint64) []byte {
+	value := make([]byte, 8)
+	binary.BigEndian.PutUint64(value, count)
+	return value
+}
+
+// CollectGarbage drops the attachments of objects that do not exist anymore and recounts the references to the content.
+func (d *BoltDriver) CollectGarbage() (GarbageReport, error) {
+	report := GarbageReport{}
+	err := d.db.Update(func(tx *bolt.Tx) error {
+		objects, attachments := tx.Bucket(boltObjectsBucket), tx.Bucket(boltAttachmentsBucket)
+		blobs, references := tx.Bucket(boltBlobsBucket), tx.Bucket(boltReferencesBucket)
+		counts := make(map[string]uint64)
+		dangling := make([][]byte, 0)
+		err := attachments.ForEach(func(k, v []byte) error {
+			if objects.Get(k) == nil {
+				dangling = append(dangling, append([]byte{}, k...))
+			} else if blobs.Get(v) == nil {
+				report.Missing++
+			} else {
+				counts[string(v)]++
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, key := range dangling {
+			if err := attachments.Delete(key); err != nil {
+				return err
+			}
+			report.References++
+		}
+		unreferenced := make([][]byte, 0)
+		err = blobs.ForEach(func(k, v []byte) error {
+			if counts[string(k)] == 0 {
+				unreferenced = append(unreferenced, append([]byte{}, k...))
+				report.Bytes += int64(len(v))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, digest := range unreferenced {
+			if err := blobs.Delete(digest); err != nil {
+				return err
+			}
+			if err := references.Delete(digest); err != nil {
+				return err
+			}
+			report.Blobs++
+		}
+		for digest, count := range counts {
+			if err := references.Put([]byte(digest), boltCount(count)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		boltLog.Error("Error while collecting garbage :: %s", err)
+		return GarbageReport{}, InternalServerError
+	}
+	return report, nil
+}
+
+// Close closes the underlying database file.
+func (d *BoltDriver) Close() error {
+	return d.db.Close()
+}
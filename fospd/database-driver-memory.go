@@ -0,0 +1,614 @@
+// Copyright (C) 2015 Felix Maurer
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"bytes"
+	"code.google.com/p/go.crypto/bcrypt"
+	"encoding/json"
+	"github.com/maufl/go-fosp/fosp"
+	"github.com/op/go-logging"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+)
+
+var memLog = logging.MustGetLogger("go-fosp/fosp/memory-driver")
+
+// MemoryDriver implements the database specific operations for keeping all data in memory.
+// It is intended for tests and throwaway servers, all data is lost when the process exits.
+// MemoryDriver adheres to the DatabaseDriver interface and can be used by the Database object.
+type MemoryDriver struct {
+	lock        sync.RWMutex
+	users       map[string]*memoryUser
+	objects     map[string][]byte
+	attachments map[string]string
+	blobs       map[string]*memoryBlob
+	tokens      map[string]SessionToken
+	secrets     map[string][]byte
+	queues      map[string]*memoryQueue
+	changes     map[string]memoryChangeLog
+	usage       map[string]Usage
+}
+
+// memoryChangeLog is the change log of a user, the changes are never modified so that the log can be copied cheaply.
+type memoryChangeLog struct {
+	last    uint64
+	changes []*fosp.Change
+}
+
+// memoryQueue is the notification queue of a user.
+type memoryQueue struct {
+	sequence uint64
+	records  []*fosp.NotificationRecord
+}
+
+// memoryBlob is the content of an attachment together with the number of objects that reference it.
+type memoryBlob struct {
+	data       []byte
+	references int
+}
+
+type memoryUser struct {
+	passwordHash []byte
+	scram        *fosp.ScramCredentials
+}
+
+// NewMemoryDriver instanciates a new, empty MemoryDriver.
+func NewMemoryDriver() *MemoryDriver {
+	return &MemoryDriver{
+		users:       make(map[string]*memoryUser),
+		objects:     make(map[string][]byte),
+		attachments: make(map[string]string),
+		blobs:       make(map[string]*memoryBlob),
+		tokens:      make(map[string]SessionToken),
+		secrets:     make(map[string][]byte),
+		queues:      make(map[string]*memoryQueue),
+		changes:     make(map[string]memoryChangeLog),
+		usage:       make(map[string]Usage),
+	}
+}
+
+// Authenticate checks whether the name password pair is valid.
+func (d *MemoryDriver) Authenticate(name, password string) bool {
+	d.lock.RLock()
+	user, ok := d.users[name]
+	d.lock.RUnlock()
+	if !ok {
+		memLog.Error("No user %s known for authentication", name)
+		return false
+	}
+	if err := bcrypt.CompareHashAndPassword(user.passwordHash, []byte(password)); err != nil {
+		memLog.Error("Error while comparing password hashes :: %s", err)
+		return false
+	}
+	return true
+}
+
+// Register creates a new user and stores the object o as the root object of the user.
+func (d *MemoryDriver) Register(name, password string, o *fosp.Object) bool {
+	passwordHash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return false
+	}
+	scram, err := fosp.NewScramCredentials(password)
+	if err != nil {
+		memLog.Error("Error while deriving SCRAM credentials :: %s", err)
+		return false
+	}
+	content, err := json.Marshal(o)
+	if err != nil {
+		memLog.Error("Error while marshaling object :: %s", err)
+		return false
+	}
+	url, _ := url.Parse("fosp://" + name + "/")
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if _, ok := d.users[name]; ok {
+		return false
+	}
+	d.users[name] = &memoryUser{passwordHash: passwordHash, scram: scram}
+	d.objects[url.String()] = content
+	d.usage[name] = objectUsage(o)
+	return true
+}
+
+// ScramCredentials returns the stored SCRAM verifier of the user.
+func (d *MemoryDriver) ScramCredentials(name string) (*fosp.ScramCredentials, error) {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	user, ok := d.users[name]
+	if !ok {
+		return nil, NewFospError("User not found", fosp.StatusNotFound)
+	}
+	return user.scram, nil
+}
+
+// CreateToken stores a new session token.
+func (d *MemoryDriver) CreateToken(token *SessionToken) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if _, ok := d.tokens[token.ID]; ok {
+		return NewFospError("Token already exists", fosp.StatusConflict)
+	}
+	d.tokens[token.ID] = *token
+	return nil
+}
+
+// GetToken returns the session token with the given ID.
+func (d *MemoryDriver) GetToken(id string) (*SessionToken, error) {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	token, ok := d.tokens[id]
+	if !ok {
+		return nil, NewFospError("Token not found", fosp.StatusNotFound)
+	}
+	return &token, nil
+}
+
+// ListTokens returns all session tokens of the user.
+func (d *MemoryDriver) ListTokens(user string) ([]*SessionToken, error) {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	tokens := make([]*SessionToken, 0)
+	for _, token := range d.tokens {
+		if token.User == user {
+			token := token
+			tokens = append(tokens, &token)
+		}
+	}
+	return tokens, nil
+}
+
+// DeleteToken revokes the session token with the given ID of the user.
+func (d *MemoryDriver) DeleteToken(user, id string) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if token, ok := d.tokens[id]; !ok || token.User != user {
+		return NewFospError("Token not found", fosp.StatusNotFound)
+	}
+	delete(d.tokens, id)
+	return nil
+}
+
+// ServerSecret returns the secret with the given name, it only lasts as long as the other data of the driver.
+func (d *MemoryDriver) ServerSecret(name string) ([]byte, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if secret, ok := d.secrets[name]; ok {
+		return secret, nil
+	}
+	secret, err := newSecret()
+	if err != nil {
+		memLog.Error("Error while generating secret :: %s", err)
+		return nil, InternalServerError
+	}
+	d.secrets[name] = secret
+	return secret, nil
+}
+
+// QueueNotification appends the record to the notification queue of the user.
+func (d *MemoryDriver) QueueNotification(user string, record *fosp.NotificationRecord, retention NotificationRetention) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if _, ok := d.users[user]; !ok {
+		return NewFospError("User not found", fosp.StatusNotFound)
+	}
+	queue, ok := d.queues[user]
+	if !ok {
+		queue = &memoryQueue{}
+		d.queues[user] = queue
+	}
+	queue.sequence++
+	record.Seq = queue.sequence
+	stored := *record
+	records := make([]*fosp.NotificationRecord, 0, len(queue.records)+1)
+	for _, r := range append(queue.records, &stored) {
+		if !retention.expired(r, queue.sequence) {
+			records = append(records, r)
+		}
+	}
+	queue.records = records
+	return nil
+}
+
+// ListNotifications returns the queued records of the user after since.
+func (d *MemoryDriver) ListNotifications(user string, since uint64) ([]*fosp.NotificationRecord, error) {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	records := make([]*fosp.NotificationRecord, 0)
+	if queue, ok := d.queues[user]; ok {
+		for _, r := range queue.records {
+			if r.Seq > since {
+				record := *r
+				records = append(records, &record)
+			}
+		}
+	}
+	return records, nil
+}
+
+// AckNotifications removes the queued records of the user up to and including seq.
+func (d *MemoryDriver) AckNotifications(user string, seq uint64) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	queue, ok := d.queues[user]
+	if !ok {
+		return nil
+	}
+	i := 0
+	for i < len(queue.records) && queue.records[i].Seq <= seq {
+		i++
+	}
+	queue.records = queue.records[i:]
+	return nil
+}
+
+// GetObjectWithParents returns an object and all it's parents.
+// The parents are stored recursively in the object.
+func (d *MemoryDriver) GetObjectWithParents(u *url.URL) (fosp.Object, error) {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	return memoryStore{d}.GetObjectWithParents(u)
+}
+
+// CreateObject saves a new object under the given URL.
+func (d *MemoryDriver) CreateObject(u *url.URL, o *fosp.Object) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return memoryStore{d}.CreateObject(u, o)
+}
+
+// UpdateObject replaces the object at the given URL with a new object.
+func (d *MemoryDriver) UpdateObject(u *url.URL, o *fosp.Object) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return memoryStore{d}.UpdateObject(u, o)
+}
+
+// ListObjects returns an array of child object names of the object at the given URL.
+func (d *MemoryDriver) ListObjects(u *url.URL) ([]string, error) {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	return memoryStore{d}.ListObjects(u)
+}
+
+// DeleteObjects deletes the object at the given URL, all its children and their attachments.
+func (d *MemoryDriver) DeleteObjects(u *url.URL) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return memoryStore{d}.DeleteObjects(u)
+}
+
+// Usage returns the storage used under the root of the owner of the object at the given URL.
+func (d *MemoryDriver) Usage(u *url.URL) (Usage, error) {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	return memoryStore{d}.Usage(u)
+}
+
+// LinkAttachment makes the staged content the attachment of the object at the given URL.
+func (d *MemoryDriver) LinkAttachment(u *url.URL, staged *StagedAttachment) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return memoryStore{d}.LinkAttachment(u, staged)
+}
+
+// RecordChange appends the change to the change log of the owner of the object at the given URL.
+func (d *MemoryDriver) RecordChange(u *url.URL, change *fosp.Change) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return memoryStore{d}.RecordChange(u, change)
+}
+
+// ListChanges returns the changes of the object at the given URL and its descendants after since.
+func (d *MemoryDriver) ListChanges(u *url.URL, since uint64, limit int) ([]*fosp.Change, uint64, error) {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	log := d.changes[rootOwner(u)]
+	prefix := childPrefix(u)
+	changes := make([]*fosp.Change, 0)
+	for _, c := range log.changes {
+		if len(changes) == limit {
+			break
+		}
+		if c.ID > since && (c.URL == u.String() || strings.HasPrefix(c.URL, prefix)) {
+			change := *c
+			changes = append(changes, &change)
+		}
+	}
+	return changes, log.last, nil
+}
+
+// Transaction calls fn while holding the write lock and restores the previous state if fn fails.
+func (d *MemoryDriver) Transaction(fn func(ObjectStore) error) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	objects := make(map[string][]byte, len(d.objects))
+	for uri, content := range d.objects {
+		objects[uri] = content
+	}
+	attachments := make(map[string]string, len(d.attachments))
+	for uri, digest := range d.attachments {
+		attachments[uri] = digest
+	}
+	blobs := make(map[string]memoryBlob, len(d.blobs))
+	for digest, blob := range d.blobs {
+		blobs[digest] = *blob
+	}
+	changes := make(map[string]memoryChangeLog, len(d.changes))
+	for user, log := range d.changes {
+		changes[user] = log
+	}
+	usage := make(map[string]Usage, len(d.usage))
+	for user, used := range d.usage {
+		usage[user] = used
+	}
+	if err := fn(memoryStore{d}); err != nil {
+		d.objects, d.attachments, d.changes, d.usage = objects, attachments, changes, usage
+		d.blobs = make(map[string]*memoryBlob, len(blobs))
+		for digest, blob := range blobs {
+			blob := blob
+			d.blobs[digest] = &blob
+		}
+		return err
+	}
+	return nil
+}
+
+// ReadAttachment returns a reader for the attached file of the object at the given URL.
+func (d *MemoryDriver) ReadAttachment(u *url.URL) (io.ReadSeekCloser, string, error) {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	digest, ok := d.attachments[u.String()]
+	if !ok {
+		return nil, "", NewFospError("Attachment not found", fosp.StatusNotFound)
+	}
+	return nopSeekCloser{bytes.NewReader(d.blobs[digest].data)}, digest, nil
+}
+
+// StageAttachment reads data into memory, preceded by the first offset bytes of the current attachment.
+func (d *MemoryDriver) StageAttachment(u *url.URL, offset int64, data io.Reader) (*StagedAttachment, error) {
+	content, readErr := ioutil.ReadAll(data)
+	staged := &StagedAttachment{}
+	if offset > 0 {
+		d.lock.RLock()
+		var existing []byte
+		if digest, ok := d.attachments[u.String()]; ok {
+			existing, staged.Base = d.blobs[digest].data, digest
+		}
+		d.lock.RUnlock()
+		if offset > int64(len(existing)) {
+			return nil, NewFospError("Offset is beyond the end of the attachment", fosp.StatusRangeNotSatisfiable)
+		}
+		content = append(append([]byte{}, existing[:offset]...), content...)
+	}
+	staged.content = content
+	staged.Size = int64(len(content))
+	staged.Digest = fosp.Digest(content)
+	return staged, readErr
+}
+
+// DiscardAttachment does nothing, staged content is only kept by the StagedAttachment itself.
+func (d *MemoryDriver) DiscardAttachment(staged *StagedAttachment) {}
+
+// memoryStore implements the ObjectStore operations of the MemoryDriver.
+// The caller has to hold the lock of the driver, the write lock for operations that change data.
+type memoryStore struct {
+	d *MemoryDriver
+}
+
+func (s memoryStore) GetObjectWithParents(u *url.URL) (fosp.Object, error) {
+	urls := urlFamily(u)
+	var parent *fosp.Object
+	// urlFamily returns the URLs starting with the object itself, so walk it backwards to start at the root.
+	for i := len(urls) - 1; i >= 0; i-- {
+		content, ok := s.d.objects[urls[i].String()]
+		if !ok {
+			memLog.Debug("Object %s not found", urls[i])
+			return fosp.Object{}, NewFospError("Object not found", fosp.StatusNotFound)
+		}
+		obj := fosp.NewObject()
+		if err := json.Unmarshal(content, obj); err != nil {
+			memLog.Critical("Error when unmarshaling json ::%T %s", err, err)
+			return fosp.Object{}, InternalServerError
+		}
+		obj.URL = urls[i]
+		obj.Parent = parent
+		parent = obj
+	}
+	return *parent, nil
+}
+
+func (s memoryStore) CreateObject(u *url.URL, o *fosp.Object) error {
+	content, err := json.Marshal(o)
+	if err != nil {
+		memLog.Error("Error while marshaling object :: %s", err)
+		return InternalServerError
+	}
+	parentURL := *u
+	parentURL.Path = path.Dir(u.Path)
+	if _, ok := s.d.objects[parentURL.String()]; !ok {
+		memLog.Error("Parent %s for new object does not exist", &parentURL)
+		return NewFospError("Parent object not found", fosp.StatusNotFound)
+	}
+	if _, ok := s.d.objects[u.String()]; ok {
+		return NewFospError("Object already exists", fosp.StatusConflict)
+	}
+	s.d.objects[u.String()] = content
+	s.d.usage[rootOwner(u)] = s.d.usage[rootOwner(u)].plus(objectUsage(o))
+	return nil
+}
+
+func (s memoryStore) UpdateObject(u *url.URL, o *fosp.Object) error {
+	content, err := json.Marshal(o)
+	if err != nil {
+		memLog.Error("Error while marshaling object :: %s", err)
+		return InternalServerError
+	}
+	old, ok := s.d.objects[u.String()]
+	if !ok {
+		return NewFospError("Object not found", fosp.StatusNotFound)
+	}
+	oldUsage, err := storedUsage(old)
+	if err != nil {
+		memLog.Error("Error when unmarshaling json of %s :: %s", u, err)
+		return InternalServerError
+	}
+	s.d.objects[u.String()] = content
+	s.d.usage[rootOwner(u)] = s.d.usage[rootOwner(u)].minus(oldUsage).plus(objectUsage(o))
+	return nil
+}
+
+func (s memoryStore) ListObjects(u *url.URL) ([]string, error) {
+	if _, ok := s.d.objects[u.String()]; !ok {
+		return nil, NewFospError("Object not found", fosp.StatusNotFound)
+	}
+	names := make([]string, 0, 25)
+	for uri := range s.d.objects {
+		child, err := url.Parse(uri)
+		if err != nil {
+			memLog.Error("Error while parsing URL %s :: %s", uri, err)
+			return nil, InternalServerError
+		}
+		if child.Path == "/" {
+			continue
+		}
+		parentURL := *child
+		parentURL.Path = path.Dir(child.Path)
+		if parentURL.String() == u.String() {
+			names = append(names, path.Base(child.Path))
+		}
+	}
+	return names, nil
+}
+
+func (s memoryStore) DeleteObjects(u *url.URL) error {
+	prefix := childPrefix(u)
+	if _, ok := s.d.objects[u.String()]; !ok {
+		return NewFospError("Object not found", fosp.StatusNotFound)
+	}
+	deleted, uris := Usage{}, []string{}
+	for uri, content := range s.d.objects {
+		if uri == u.String() || strings.HasPrefix(uri, prefix) {
+			usage, err := storedUsage(content)
+			if err != nil {
+				memLog.Error("Error when unmarshaling json of %s :: %s", uri, err)
+				return InternalServerError
+			}
+			deleted, uris = deleted.plus(usage), append(uris, uri)
+		}
+	}
+	for _, uri := range uris {
+		delete(s.d.objects, uri)
+		s.d.unlinkAttachment(uri)
+	}
+	s.d.usage[rootOwner(u)] = s.d.usage[rootOwner(u)].minus(deleted)
+	return nil
+}
+
+func (s memoryStore) Usage(u *url.URL) (Usage, error) {
+	return s.d.usage[rootOwner(u)], nil
+}
+
+func (s memoryStore) RecordChange(u *url.URL, change *fosp.Change) error {
+	owner := rootOwner(u)
+	log := s.d.changes[owner]
+	prefix := childPrefix(u)
+	changes := make([]*fosp.Change, 0, len(log.changes)+1)
+	for _, c := range log.changes {
+		if c.URL != u.String() && (change.Event != fosp.DELETED || !strings.HasPrefix(c.URL, prefix)) {
+			changes = append(changes, c)
+		}
+	}
+	log.last++
+	change.ID = log.last
+	stored := *change
+	log.changes = append(changes, &stored)
+	s.d.changes[owner] = log
+	return nil
+}
+
+func (s memoryStore) LinkAttachment(u *url.URL, staged *StagedAttachment) error {
+	if _, ok := s.d.objects[u.String()]; !ok {
+		return NewFospError("Object not found", fosp.StatusNotFound)
+	}
+	if staged.Base != "" && s.d.attachments[u.String()] != staged.Base {
+		return AttachmentChanged
+	}
+	s.d.linkAttachment(u.String(), staged.content)
+	return nil
+}
+
+// linkAttachment makes content the attachment of the object at uri and returns its digest.
+// The caller has to hold the write lock.
+func (d *MemoryDriver) linkAttachment(uri string, content []byte) string {
+	digest := fosp.Digest(content)
+	blob, ok := d.blobs[digest]
+	if !ok {
+		blob = &memoryBlob{data: content}
+		d.blobs[digest] = blob
+	}
+	blob.references++
+	d.unlinkAttachment(uri)
+	d.attachments[uri] = digest
+	return digest
+}
+
+// unlinkAttachment removes the attachment of the object at uri and drops its content if it is not referenced anymore.
+// The caller has to hold the write lock.
+func (d *MemoryDriver) unlinkAttachment(uri string) {
+	digest, ok := d.attachments[uri]
+	if !ok {
+		return
+	}
+	delete(d.attachments, uri)
+	blob := d.blobs[digest]
+	if blob.references--; blob.references <= 0 {
+		delete(d.blobs, digest)
+	}
+}
+
+// CollectGarbage drops the attachments of objects that do not exist anymore and recounts the references to the content.
+func (d *MemoryDriver) CollectGarbage() (GarbageReport, error) {
+	report := GarbageReport{}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	references := make(map[string]int)
+	for uri, digest := range d.attachments {
+		if _, ok := d.objects[uri]; !ok {
+			delete(d.attachments, uri)
+			report.References++
+		} else if _, ok := d.blobs[digest]; !ok {
+			report.Missing++
+		} else {
+			references[digest]++
+		}
+	}
+	for digest, blob := range d.blobs {
+		if references[digest] == 0 {
+			delete(d.blobs, digest)
+			report.Blobs++
+			report.Bytes += int64(len(blob.data))
+		} else {
+			blob.references = references[digest]
+		}
+	}
+	return report, nil
+}
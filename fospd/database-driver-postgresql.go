@@ -17,9 +17,7 @@ package main
 
 import (
 	"code.google.com/p/go.crypto/bcrypt"
-	"crypto/sha512"
 	"database/sql"
-	"encoding/base32"
 	"encoding/json"
 	"fmt"
 	// This import is needed to make the postgres driver available to database/sql.
@@ -32,15 +30,21 @@ import (
 	"os"
 	"path"
 	"strings"
+	"sync"
+	"time"
 )
 
 var psqlLog = logging.MustGetLogger("go-fosp/fosp/postgresql-driver")
 
 // PostgresqlDriver implements the database specific operations for storing the data in a Postgres database.
 // PostgresqlDriver adheres to the DatabaseDriver interface and can be used by the Database object.
+// Attachments are stored in files under basepath that are named by the digest of their content.
+// The attachments table maps the URLs of objects to digests and counts the references to a file.
 type PostgresqlDriver struct {
 	db       *sql.DB
 	basepath string
+	// blobLock serializes changes of the references to attachment files with their creation and removal.
+	blobLock sync.Mutex
 }
 
 // NewPostgresqlDriver instanciates a new PostgresqlDriver for the given connectionString.
@@ -76,7 +80,14 @@ func (d *PostgresqlDriver) Register(name, password string, o *fosp.Object) bool
 	if err != nil {
 		return false
 	}
-	_, err = d.db.Exec("INSERT INTO users (name, password) VALUES ($1, $2)", name, passwordHash)
+	scram, err := fosp.NewScramCredentials(password)
+	if err != nil {
+		psqlLog.Error("Error while deriving SCRAM credentials :: %s", err)
+		return false
+	}
+	usage := objectUsage(o)
+	_, err = d.db.Exec("INSERT INTO users (name, password, scram_salt, scram_iterations, scram_stored_key, scram_server_key, object_count, attachment_bytes) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)",
+		name, passwordHash, scram.Salt, scram.Iterations, scram.StoredKey, scram.ServerKey, usage.Objects, usage.AttachmentBytes)
 	if err != nil {
 		return false
 	}
@@ -94,9 +105,326 @@ func (d *PostgresqlDriver) Register(name, password string, o *fosp.Object) bool
 	return true
 }
 
+// ScramCredentials returns the stored SCRAM verifier of the user.
+func (d *PostgresqlDriver) ScramCredentials(name string) (*fosp.ScramCredentials, error) {
+	var (
+		scram      fosp.ScramCredentials
+		iterations sql.NullInt64
+	)
+	err := d.db.QueryRow("SELECT scram_salt, scram_iterations, scram_stored_key, scram_server_key FROM users WHERE name = $1", name).Scan(&scram.Salt, &iterations, &scram.StoredKey, &scram.ServerKey)
+	if err == sql.ErrNoRows {
+		return nil, NewFospError("User not found", fosp.StatusNotFound)
+	} else if err != nil {
+		psqlLog.Error("Error when selecting SCRAM credentials :: %s", err)
+		return nil, InternalServerError
+	}
+	if !iterations.Valid {
+		return nil, NewFospError("User has no SCRAM credentials", fosp.StatusNotFound)
+	}
+	scram.Iterations = int(iterations.Int64)
+	return &scram, nil
+}
+
+// CreateToken stores a new session token.
+func (d *PostgresqlDriver) CreateToken(token *SessionToken) error {
+	_, err := d.db.Exec("INSERT INTO tokens (id, name, hash, label, created) VALUES ($1, $2, $3, $4, $5)",
+		token.ID, token.User, token.Hash, token.Label, token.Created)
+	if err != nil {
+		psqlLog.Error("Error when adding new token :: %s", err)
+		return InternalServerError
+	}
+	return nil
+}
+
+// GetToken returns the session token with the given ID.
+func (d *PostgresqlDriver) GetToken(id string) (*SessionToken, error) {
+	token := &SessionToken{ID: id}
+	err := d.db.QueryRow("SELECT name, hash, label, created FROM tokens WHERE id = $1", id).Scan(&token.User, &token.Hash, &token.Label, &token.Created)
+	if err == sql.ErrNoRows {
+		return nil, NewFospError("Token not found", fosp.StatusNotFound)
+	} else if err != nil {
+		psqlLog.Error("Error when selecting token :: %s", err)
+		return nil, InternalServerError
+	}
+	return token, nil
+}
+
+// ListTokens returns all session tokens of the user.
+func (d *PostgresqlDriver) ListTokens(user string) ([]*SessionToken, error) {
+	rows, err := d.db.Query("SELECT id, hash, label, created FROM tokens WHERE name = $1", user)
+	if err != nil {
+		psqlLog.Error("Error when selecting tokens :: %s", err)
+		return nil, InternalServerError
+	}
+	defer rows.Close()
+	tokens := make([]*SessionToken, 0)
+	for rows.Next() {
+		token := &SessionToken{User: user}
+		if err := rows.Scan(&token.ID, &token.Hash, &token.Label, &token.Created); err != nil {
+			psqlLog.Error("Error when reading token row :: %s", err)
+			return nil, InternalServerError
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens, nil
+}
+
+// DeleteToken revokes the session token with the given ID of the user.
+func (d *PostgresqlDriver) DeleteToken(user, id string) error {
+	result, err := d.db.Exec("DELETE FROM tokens WHERE id = $1 AND name = $2", id, user)
+	if err != nil {
+		psqlLog.Error("Error when deleting token :: %s", err)
+		return InternalServerError
+	}
+	if affected, err := result.RowsAffected(); err == nil && affected == 0 {
+		return NewFospError("Token not found", fosp.StatusNotFound)
+	}
+	return nil
+}
+
+// ServerSecret returns the secret with the given name from the secrets table.
+// Servers that start at the same time agree on the secret that was inserted first.
+func (d *PostgresqlDriver) ServerSecret(name string) ([]byte, error) {
+	secret, err := newSecret()
+	if err != nil {
+		psqlLog.Error("Error while generating secret :: %s", err)
+		return nil, InternalServerError
+	}
+	_, err = d.db.Exec("INSERT INTO secrets (name, value) VALUES ($1, $2) ON CONFLICT (name) DO NOTHING", name, secret)
+	if err != nil {
+		psqlLog.Error("Error when adding secret %s :: %s", name, err)
+		return nil, InternalServerError
+	}
+	if err := d.db.QueryRow("SELECT value FROM secrets WHERE name = $1", name).Scan(&secret); err != nil {
+		psqlLog.Error("Error when selecting secret %s :: %s", name, err)
+		return nil, InternalServerError
+	}
+	return secret, nil
+}
+
+// QueueNotification inserts the record into the notifications table, the sequence number is counted in the users table.
+func (d *PostgresqlDriver) QueueNotification(user string, record *fosp.NotificationRecord, retention NotificationRetention) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		psqlLog.Error("Error while starting transaction :: %s", err)
+		return InternalServerError
+	}
+	defer tx.Rollback()
+	err = tx.QueryRow("UPDATE users SET notification_seq = notification_seq + 1 WHERE name = $1 RETURNING notification_seq", user).Scan(&record.Seq)
+	if err == sql.ErrNoRows {
+		return NewFospError("User not found", fosp.StatusNotFound)
+	} else if err != nil {
+		psqlLog.Error("Error when counting notification sequence :: %s", err)
+		return InternalServerError
+	}
+	var object *string
+	if record.Object != nil {
+		content := string(record.Object)
+		object = &content
+	}
+	_, err = tx.Exec("INSERT INTO notifications (name, seq, event, uri, etag, base_etag, object, created) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)",
+		user, record.Seq, record.Event, record.URL, record.ETag, record.BaseETag, object, record.Time)
+	if err != nil {
+		psqlLog.Error("Error when inserting notification :: %s", err)
+		return InternalServerError
+	}
+	if retention.MaxCount > 0 && record.Seq > uint64(retention.MaxCount) {
+		if _, err := tx.Exec("DELETE FROM notifications WHERE name = $1 AND seq <= $2", user, record.Seq-uint64(retention.MaxCount)); err != nil {
+			psqlLog.Error("Error when trimming notifications :: %s", err)
+			return InternalServerError
+		}
+	}
+	if retention.MaxAge > 0 {
+		if _, err := tx.Exec("DELETE FROM notifications WHERE name = $1 AND created < $2", user, time.Now().Add(-retention.MaxAge)); err != nil {
+			psqlLog.Error("Error when trimming notifications :: %s", err)
+			return InternalServerError
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		psqlLog.Error("Error while committing transaction :: %s", err)
+		return InternalServerError
+	}
+	return nil
+}
+
+// ListNotifications returns the queued records of the user after since.
+func (d *PostgresqlDriver) ListNotifications(user string, since uint64) ([]*fosp.NotificationRecord, error) {
+	rows, err := d.db.Query("SELECT seq, event, uri, etag, base_etag, object, created FROM notifications WHERE name = $1 AND seq > $2 ORDER BY seq", user, since)
+	if err != nil {
+		psqlLog.Error("Error when selecting notifications :: %s", err)
+		return nil, InternalServerError
+	}
+	defer rows.Close()
+	records := make([]*fosp.NotificationRecord, 0)
+	for rows.Next() {
+		record := &fosp.NotificationRecord{}
+		var etag, baseETag, object sql.NullString
+		if err := rows.Scan(&record.Seq, &record.Event, &record.URL, &etag, &baseETag, &object, &record.Time); err != nil {
+			psqlLog.Error("Error when reading notification row :: %s", err)
+			return nil, InternalServerError
+		}
+		record.ETag, record.BaseETag = etag.String, baseETag.String
+		if object.Valid {
+			record.Object = json.RawMessage(object.String)
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// AckNotifications removes the queued records of the user up to and including seq.
+func (d *PostgresqlDriver) AckNotifications(user string, seq uint64) error {
+	if _, err := d.db.Exec("DELETE FROM notifications WHERE name = $1 AND seq <= $2", user, seq); err != nil {
+		psqlLog.Error("Error when deleting notifications :: %s", err)
+		return InternalServerError
+	}
+	return nil
+}
+
+// queryer is implemented by sql.DB and sql.Tx, so that the ObjectStore operations can run in or outside of a transaction.
+type queryer interface {
+	Exec(string, ...interface{}) (sql.Result, error)
+	Query(string, ...interface{}) (*sql.Rows, error)
+	QueryRow(string, ...interface{}) *sql.Row
+}
+
 // GetObjectWithParents returns an object and all it's parents from the database.
 // The parents are stored recursively in the object.
 func (d *PostgresqlDriver) GetObjectWithParents(url *url.URL) (fosp.Object, error) {
+	return (&postgresqlStore{d: d, q: d.db}).GetObjectWithParents(url)
+}
+
+// CreateObject saves a new object to the database under the given URL.
+func (d *PostgresqlDriver) CreateObject(url *url.URL, o *fosp.Object) error {
+	return d.Transaction(func(s ObjectStore) error { return s.CreateObject(url, o) })
+}
+
+// UpdateObject replaces the object at the given URL with a new object.
+func (d *PostgresqlDriver) UpdateObject(url *url.URL, o *fosp.Object) error {
+	return (&postgresqlStore{d: d, q: d.db}).UpdateObject(url, o)
+}
+
+// ListObjects returns an array of child object names of the object at the given URL.
+func (d *PostgresqlDriver) ListObjects(url *url.URL) ([]string, error) {
+	return (&postgresqlStore{d: d, q: d.db}).ListObjects(url)
+}
+
+// DeleteObjects deletes the object at the given URL, all its children and their attachments.
+func (d *PostgresqlDriver) DeleteObjects(url *url.URL) error {
+	return d.Transaction(func(s ObjectStore) error { return s.DeleteObjects(url) })
+}
+
+// Usage returns the storage used under the root of the owner of the object at the given URL.
+func (d *PostgresqlDriver) Usage(url *url.URL) (Usage, error) {
+	return (&postgresqlStore{d: d, q: d.db}).Usage(url)
+}
+
+// LinkAttachment makes the staged content the attachment of the object at the given URL.
+func (d *PostgresqlDriver) LinkAttachment(url *url.URL, staged *StagedAttachment) error {
+	return d.Transaction(func(s ObjectStore) error { return s.LinkAttachment(url, staged) })
+}
+
+// RecordChange appends the change to the change log of the owner of the object at the given URL.
+func (d *PostgresqlDriver) RecordChange(url *url.URL, change *fosp.Change) error {
+	return d.Transaction(func(s ObjectStore) error { return s.RecordChange(url, change) })
+}
+
+// ListChanges returns the changes of the object at the given URL and its descendants after since.
+func (d *PostgresqlDriver) ListChanges(url *url.URL, since uint64, limit int) ([]*fosp.Change, uint64, error) {
+	var last uint64
+	err := d.db.QueryRow("SELECT change_seq FROM users WHERE name = $1", rootOwner(url)).Scan(&last)
+	if err != nil && err != sql.ErrNoRows {
+		psqlLog.Error("Error when selecting change sequence :: %s", err)
+		return nil, 0, InternalServerError
+	}
+	rows, err := d.db.Query("SELECT id, event, uri, etag, created FROM changes WHERE name = $1 AND id > $2 AND (uri = $3 OR left(uri, length($4)) = $4) ORDER BY id LIMIT $5",
+		rootOwner(url), since, url.String(), childPrefix(url), limit)
+	if err != nil {
+		psqlLog.Error("Error when selecting changes :: %s", err)
+		return nil, 0, InternalServerError
+	}
+	defer rows.Close()
+	changes := make([]*fosp.Change, 0)
+	for rows.Next() {
+		change := &fosp.Change{}
+		var etag sql.NullString
+		if err := rows.Scan(&change.ID, &change.Event, &change.URL, &etag, &change.Time); err != nil {
+			psqlLog.Error("Error when reading change row :: %s", err)
+			return nil, 0, InternalServerError
+		}
+		change.ETag = etag.String
+		changes = append(changes, change)
+	}
+	return changes, last, nil
+}
+
+// Transaction runs fn in an SQL transaction, which is committed if fn succeeds and rolled back otherwise.
+// Objects that are read in the transaction are locked until it ends. Attachment files that lose their last
+// reference are only removed after the commit, files that were stored by a transaction which is rolled back
+// are left for the garbage collector.
+func (d *PostgresqlDriver) Transaction(fn func(ObjectStore) error) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		psqlLog.Error("Error while starting transaction :: %s", err)
+		return InternalServerError
+	}
+	store := &postgresqlStore{d: d, q: tx, locking: true}
+	defer store.unlockBlobs()
+	if err := fn(store); err != nil {
+		if rollbackErr := tx.Rollback(); rollbackErr != nil {
+			psqlLog.Error("Error while rolling back transaction :: %s", rollbackErr)
+		}
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		psqlLog.Error("Error while committing transaction :: %s", err)
+		return InternalServerError
+	}
+	for _, digest := range store.released {
+		d.releaseBlob(digest)
+	}
+	return nil
+}
+
+// postgresqlStore implements the ObjectStore operations of the PostgresqlDriver on a connection or a transaction.
+type postgresqlStore struct {
+	d *PostgresqlDriver
+	q queryer
+	// locking is set in transactions, it makes GetObjectWithParents lock the row of the object.
+	locking bool
+	// blobsLocked is set when the store holds blobLock of the driver, which is then held until the transaction ends.
+	// To avoid deadlocks, a transaction must not lock rows of the data or users table after it took blobLock.
+	blobsLocked bool
+	// released are the digests of attachment files that lost a reference.
+	released []string
+}
+
+// lockBlobs takes blobLock of the driver if the store does not hold it already.
+func (s *postgresqlStore) lockBlobs() {
+	if !s.blobsLocked {
+		s.d.blobLock.Lock()
+		s.blobsLocked = true
+	}
+}
+
+func (s *postgresqlStore) unlockBlobs() {
+	if s.blobsLocked {
+		s.d.blobLock.Unlock()
+		s.blobsLocked = false
+	}
+}
+
+func (s *postgresqlStore) GetObjectWithParents(url *url.URL) (fosp.Object, error) {
+	if s.locking {
+		var id uint64
+		err := s.q.QueryRow("SELECT id FROM data WHERE uri = $1 FOR UPDATE", url.String()).Scan(&id)
+		if err == sql.ErrNoRows {
+			return fosp.Object{}, NewFospError("Object not found", fosp.StatusNotFound)
+		} else if err != nil {
+			psqlLog.Error("Error when locking object %s :: %s", url, err)
+			return fosp.Object{}, InternalServerError
+		}
+	}
 	urls := urlFamily(url)
 	args := make([]interface{}, len(urls))
 	params := make([]string, len(urls))
@@ -106,7 +434,7 @@ func (d *PostgresqlDriver) GetObjectWithParents(url *url.URL) (fosp.Object, erro
 	}
 	psqlLog.Debug("Fetching objects for URLs %v from database", args)
 	psqlLog.Debug("SELECT * FROM data WHERE uri IN (" + strings.Join(params, ",") + ") ORDER BY uri ASC")
-	rows, err := d.db.Query("SELECT * FROM data WHERE uri IN ("+strings.Join(params, ",")+") ORDER BY uri ASC", args...)
+	rows, err := s.q.Query("SELECT * FROM data WHERE uri IN ("+strings.Join(params, ",")+") ORDER BY uri ASC", args...)
 	if err != nil {
 		psqlLog.Error("Error when fetching object and parents from database: ", err)
 		return fosp.Object{}, InternalServerError
@@ -147,14 +475,15 @@ func (d *PostgresqlDriver) GetObjectWithParents(url *url.URL) (fosp.Object, erro
 	return *parent, nil
 }
 
-// CreateObject saves a new object to the database under the given URL.
-func (d *PostgresqlDriver) CreateObject(url *url.URL, o *fosp.Object) error {
+func (s *postgresqlStore) CreateObject(url *url.URL, o *fosp.Object) error {
 	psqlLog.Debug("Inserting object %#v with URL %s into database", o, url)
 	var parentID uint64
 	parentUrl := *url
 	parentUrl.Path = path.Dir(url.Path)
-	err := d.db.QueryRow("SELECT id FROM data WHERE uri = $1", parentUrl.String()).Scan(&parentID)
-	if err != nil {
+	err := s.q.QueryRow("SELECT id FROM data WHERE uri = $1", parentUrl.String()).Scan(&parentID)
+	if err == sql.ErrNoRows {
+		return NewFospError("Parent object not found", fosp.StatusNotFound)
+	} else if err != nil {
 		psqlLog.Error("Error when fetching parent %s for new object :: %s", parentUrl, err)
 		return InternalServerError
 	}
@@ -163,44 +492,52 @@ func (d *PostgresqlDriver) CreateObject(url *url.URL, o *fosp.Object) error {
 		psqlLog.Error("Error while marshaling object :: %s", err)
 		return InternalServerError
 	}
-	_, err = d.db.Exec("INSERT INTO data (uri, parent_id, content) VALUES ($1, $2, $3)", url.String(), parentID, content)
+	_, err = s.q.Exec("INSERT INTO data (uri, parent_id, content) VALUES ($1, $2, $3)", url.String(), parentID, content)
 	if err != nil {
 		psqlLog.Error("Error when adding new object :: %s", err)
 		return InternalServerError
 	}
-	return nil
+	return s.changeUsage(url, objectUsage(o))
 }
 
-// UpdateObject replaces the object at the given URL with a new object.
-func (d *PostgresqlDriver) UpdateObject(url *url.URL, o *fosp.Object) error {
+func (s *postgresqlStore) UpdateObject(url *url.URL, o *fosp.Object) error {
 	content, err := json.Marshal(o)
 	if err != nil {
 		psqlLog.Error("Error while marshaling object :: %s", err)
 		return InternalServerError
 	}
-	_, err = d.db.Exec("UPDATE data SET content = $1 WHERE uri = $2", content, url.String())
-	if err != nil {
+	var old []byte
+	err = s.q.QueryRow("WITH old AS (SELECT id, content FROM data WHERE uri = $2 FOR UPDATE) UPDATE data SET content = $1 FROM old WHERE data.id = old.id RETURNING old.content",
+		content, url.String()).Scan(&old)
+	if err == sql.ErrNoRows {
+		return NewFospError("Object not found", fosp.StatusNotFound)
+	} else if err != nil {
 		psqlLog.Error("Error while updating object :: %s", err)
 		return InternalServerError
 	}
-	return nil
+	oldUsage, err := storedUsage(old)
+	if err != nil {
+		psqlLog.Error("Error when unmarshaling json of %s :: %s", url, err)
+		return InternalServerError
+	}
+	return s.changeUsage(url, objectUsage(o).minus(oldUsage))
 }
 
-// ListObjects returns an array of child object names of the object at the given URL.
-func (d *PostgresqlDriver) ListObjects(url *url.URL) ([]string, error) {
+func (s *postgresqlStore) ListObjects(url *url.URL) ([]string, error) {
 	var parentID uint64
-	err := d.db.QueryRow("SELECT id FROM data WHERE uri = $1", url.String()).Scan(&parentID)
-	if err != nil {
+	err := s.q.QueryRow("SELECT id FROM data WHERE uri = $1", url.String()).Scan(&parentID)
+	if err == sql.ErrNoRows {
+		return nil, NewFospError("Object not found", fosp.StatusNotFound)
+	} else if err != nil {
 		psqlLog.Error("Error while fetching object %s :: %s", url, err)
 		return nil, InternalServerError
 	}
-	var rows *sql.Rows
-	rows, err = d.db.Query("SELECT uri FROM data WHERE parent_id = $1", parentID)
-	defer rows.Close()
+	rows, err := s.q.Query("SELECT uri FROM data WHERE parent_id = $1", parentID)
 	if err != nil {
 		psqlLog.Error("Error while fetching children of %s :: %s", url, err)
 		return nil, InternalServerError
 	}
+	defer rows.Close()
 	uris := make([]string, 0, 25)
 	for rows.Next() {
 		var uri string
@@ -218,32 +555,323 @@ func (d *PostgresqlDriver) ListObjects(url *url.URL) ([]string, error) {
 	return uris, nil
 }
 
-// DeleteObjects deletes the object at the given URL and all its children.
-func (d *PostgresqlDriver) DeleteObjects(url *url.URL) error {
-	_, err := d.db.Exec("DELETE FROM data WHERE uri ~ $1", "^"+url.String())
+func (s *postgresqlStore) DeleteObjects(url *url.URL) error {
+	deleted := Usage{}
+	err := s.q.QueryRow("WITH deleted AS (DELETE FROM data WHERE uri = $1 OR left(uri, length($2)) = $2 RETURNING content) SELECT count(*), COALESCE(sum((content::json->'attachment'->>'size')::bigint), 0) FROM deleted",
+		url.String(), childPrefix(url)).Scan(&deleted.Objects, &deleted.AttachmentBytes)
 	if err != nil {
 		psqlLog.Error("Error while deleting recorde for URL %s :: %s", url, err)
 		return InternalServerError
 	}
+	if err := s.changeUsage(url, Usage{}.minus(deleted)); err != nil {
+		return err
+	}
+	s.lockBlobs()
+	rows, err := s.q.Query("DELETE FROM attachments WHERE uri = $1 OR left(uri, length($2)) = $2 RETURNING digest", url.String(), childPrefix(url))
+	if err != nil {
+		psqlLog.Error("Error while deleting attachments for URL %s :: %s", url, err)
+		return InternalServerError
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var digest string
+		if err := rows.Scan(&digest); err != nil {
+			psqlLog.Error("Error when reading digest of deleted attachment :: %s", err)
+			return InternalServerError
+		}
+		s.released = append(s.released, digest)
+	}
 	return nil
 }
 
-// ReadAttachment returns the content of the attached file of the object at the given URL.
-func (d *PostgresqlDriver) ReadAttachment(url *url.URL) ([]byte, error) {
-	hash := sha512.Sum512([]byte(url.String()))
-	filename := base32.StdEncoding.EncodeToString(hash[:sha512.Size])
-	path := d.basepath + "/" + filename
-	return ioutil.ReadFile(path)
+// Usage reads the usage that is counted in the row of the owner in the users table. In a transaction the row stays
+// locked until the transaction ends, so that concurrent writes under the same root are checked against the quota
+// one after another. Users that were registered before the usage was counted have no usage stored yet, it is counted
+// once by a transaction.
+func (s *postgresqlStore) Usage(url *url.URL) (Usage, error) {
+	owner := rootOwner(url)
+	query := "SELECT object_count, attachment_bytes FROM users WHERE name = $1"
+	if s.locking {
+		query += " FOR UPDATE"
+	}
+	var objects, attachmentBytes sql.NullInt64
+	err := s.q.QueryRow(query, owner).Scan(&objects, &attachmentBytes)
+	if err == sql.ErrNoRows {
+		return Usage{}, NewFospError("User not found", fosp.StatusNotFound)
+	} else if err != nil {
+		psqlLog.Error("Error while reading usage of %s :: %s", owner, err)
+		return Usage{}, InternalServerError
+	}
+	if objects.Valid && attachmentBytes.Valid {
+		return Usage{Objects: objects.Int64, AttachmentBytes: attachmentBytes.Int64}, nil
+	}
+	usage := Usage{}
+	prefix := "fosp://" + owner + "/"
+	err = s.q.QueryRow("SELECT count(*), COALESCE(sum((content::json->'attachment'->>'size')::bigint), 0) FROM data WHERE left(uri, length($1)) = $1",
+		prefix).Scan(&usage.Objects, &usage.AttachmentBytes)
+	if err != nil {
+		psqlLog.Error("Error while computing usage of %s :: %s", owner, err)
+		return Usage{}, InternalServerError
+	}
+	if s.locking {
+		_, err = s.q.Exec("UPDATE users SET object_count = $2, attachment_bytes = $3 WHERE name = $1", owner, usage.Objects, usage.AttachmentBytes)
+		if err != nil {
+			psqlLog.Error("Error while storing usage of %s :: %s", owner, err)
+			return Usage{}, InternalServerError
+		}
+	}
+	return usage, nil
 }
 
-// WriteAttachment stores the data as the attachment of the object at the given URL.
-func (d *PostgresqlDriver) WriteAttachment(url *url.URL, data io.Reader) (int64, error) {
-	hash := sha512.Sum512([]byte(url.String()))
-	filename := base32.StdEncoding.EncodeToString(hash[:sha512.Size])
-	path := d.basepath + "/" + filename
-	file, err := os.Create(path)
+// changeUsage adds delta to the usage that is counted in the row of the owner in the users table.
+// Like RecordChange, it has to be called before attachments are changed in a transaction.
+func (s *postgresqlStore) changeUsage(url *url.URL, delta Usage) error {
+	if delta == (Usage{}) {
+		return nil
+	}
+	_, err := s.q.Exec("UPDATE users SET object_count = object_count + $2, attachment_bytes = attachment_bytes + $3 WHERE name = $1",
+		rootOwner(url), delta.Objects, delta.AttachmentBytes)
 	if err != nil {
-		return -1, err
+		psqlLog.Error("Error while counting usage of %s :: %s", url, err)
+		return InternalServerError
+	}
+	return nil
+}
+
+// RecordChange counts the change ID in the row of the owner in the users table. The row stays locked until the
+// transaction ends, so that the change IDs of a user are committed in order.
+func (s *postgresqlStore) RecordChange(url *url.URL, change *fosp.Change) error {
+	owner := rootOwner(url)
+	err := s.q.QueryRow("UPDATE users SET change_seq = change_seq + 1 WHERE name = $1 RETURNING change_seq", owner).Scan(&change.ID)
+	if err == sql.ErrNoRows {
+		return NewFospError("User not found", fosp.StatusNotFound)
+	} else if err != nil {
+		psqlLog.Error("Error when counting change sequence :: %s", err)
+		return InternalServerError
+	}
+	if change.Event == fosp.DELETED {
+		_, err = s.q.Exec("DELETE FROM changes WHERE name = $1 AND (uri = $2 OR left(uri, length($3)) = $3)", owner, url.String(), childPrefix(url))
+	} else {
+		_, err = s.q.Exec("DELETE FROM changes WHERE name = $1 AND uri = $2", owner, url.String())
+	}
+	if err != nil {
+		psqlLog.Error("Error when removing earlier changes of %s :: %s", url, err)
+		return InternalServerError
+	}
+	_, err = s.q.Exec("INSERT INTO changes (name, id, event, uri, etag, created) VALUES ($1, $2, $3, $4, $5, $6)",
+		owner, change.ID, change.Event, url.String(), change.ETag, change.Time)
+	if err != nil {
+		psqlLog.Error("Error when inserting change of %s :: %s", url, err)
+		return InternalServerError
+	}
+	return nil
+}
+
+// LinkAttachment moves the staged file to the path of its digest, unless a file with the same content exists already,
+// and references it from the object at the given URL.
+func (s *postgresqlStore) LinkAttachment(url *url.URL, staged *StagedAttachment) error {
+	s.lockBlobs()
+	var previous sql.NullString
+	err := s.q.QueryRow("SELECT digest FROM attachments WHERE uri = $1", url.String()).Scan(&previous)
+	if err != nil && err != sql.ErrNoRows {
+		psqlLog.Error("Error while fetching attachment of %s :: %s", url, err)
+		return InternalServerError
+	}
+	if staged.Base != "" && previous.String != staged.Base {
+		return AttachmentChanged
+	}
+	if staged.file != "" {
+		blobPath := s.d.blobPath(staged.Digest)
+		if _, err := os.Stat(blobPath); err == nil {
+			os.Remove(staged.file)
+		} else if err := os.Rename(staged.file, blobPath); err != nil {
+			psqlLog.Error("Error while storing attachment of %s :: %s", url, err)
+			return InternalServerError
+		}
+		staged.file = ""
+	}
+	_, err = s.q.Exec("INSERT INTO attachments (uri, digest) VALUES ($1, $2) ON CONFLICT (uri) DO UPDATE SET digest = $2", url.String(), staged.Digest)
+	if err != nil {
+		psqlLog.Error("Error while storing attachment reference of %s :: %s", url, err)
+		return InternalServerError
+	}
+	if previous.Valid && previous.String != staged.Digest {
+		s.released = append(s.released, previous.String)
+	}
+	return nil
+}
+
+// blobPath returns the path of the file that stores the attachment content with the given digest.
+func (d *PostgresqlDriver) blobPath(digest string) string {
+	return d.basepath + "/" + strings.TrimPrefix(digest, fosp.DigestPrefix)
+}
+
+// attachmentDigest returns the digest of the attachment of the object at the given URL.
+func (d *PostgresqlDriver) attachmentDigest(url *url.URL) (string, error) {
+	var digest string
+	err := d.db.QueryRow("SELECT digest FROM attachments WHERE uri = $1", url.String()).Scan(&digest)
+	if err == sql.ErrNoRows {
+		return "", NewFospError("Attachment not found", fosp.StatusNotFound)
+	} else if err != nil {
+		psqlLog.Error("Error while fetching attachment of %s :: %s", url, err)
+		return "", InternalServerError
+	}
+	return digest, nil
+}
+
+// ReadAttachment opens the attached file of the object at the given URL.
+func (d *PostgresqlDriver) ReadAttachment(url *url.URL) (io.ReadSeekCloser, string, error) {
+	d.blobLock.Lock()
+	defer d.blobLock.Unlock()
+	digest, err := d.attachmentDigest(url)
+	if err != nil {
+		return nil, "", err
+	}
+	file, err := os.Open(d.blobPath(digest))
+	if err != nil {
+		psqlLog.Error("Error while opening attachment of %s :: %s", url, err)
+		return nil, "", InternalServerError
+	}
+	return file, digest, nil
+}
+
+// StageAttachment streams data into a temporary file under basepath, preceded by the first offset bytes of the
+// current attachment, so that files can be shared by objects.
+func (d *PostgresqlDriver) StageAttachment(url *url.URL, offset int64, data io.Reader) (*StagedAttachment, error) {
+	staged := &StagedAttachment{}
+	var existing io.ReadCloser
+	if offset > 0 {
+		var err error
+		existing, staged.Base, err = d.ReadAttachment(url)
+		if fospErr, ok := err.(FospError); ok && fospErr.Code == fosp.StatusNotFound {
+			return nil, NewFospError("Offset is beyond the end of the attachment", fosp.StatusRangeNotSatisfiable)
+		} else if err != nil {
+			return nil, err
+		}
+		defer existing.Close()
+	}
+	file, err := ioutil.TempFile(d.basepath, ".upload-")
+	if err != nil {
+		psqlLog.Error("Error while creating temporary file :: %s", err)
+		return nil, InternalServerError
+	}
+	digester := fosp.NewDigester()
+	writer := io.MultiWriter(file, digester)
+	if existing != nil {
+		if copied, err := io.CopyN(writer, existing, offset); err != nil {
+			file.Close()
+			os.Remove(file.Name())
+			if err == io.EOF && copied < offset {
+				return nil, NewFospError("Offset is beyond the end of the attachment", fosp.StatusRangeNotSatisfiable)
+			}
+			psqlLog.Error("Error while copying attachment of %s :: %s", url, err)
+			return nil, InternalServerError
+		}
+	}
+	written, copyErr := io.Copy(writer, data)
+	if err := file.Close(); err != nil {
+		os.Remove(file.Name())
+		psqlLog.Error("Error while writing attachment of %s :: %s", url, err)
+		return nil, InternalServerError
+	}
+	staged.file = file.Name()
+	staged.Size = offset + written
+	staged.Digest = digester.Digest()
+	return staged, copyErr
+}
+
+// DiscardAttachment removes the temporary file of staged content that was not linked.
+func (d *PostgresqlDriver) DiscardAttachment(staged *StagedAttachment) {
+	if staged.file != "" {
+		os.Remove(staged.file)
+		staged.file = ""
+	}
+}
+
+// releaseBlob removes the file with the given digest if no object references it anymore.
+// The caller has to hold blobLock.
+func (d *PostgresqlDriver) releaseBlob(digest string) {
+	var references int
+	if err := d.db.QueryRow("SELECT count(*) FROM attachments WHERE digest = $1", digest).Scan(&references); err != nil {
+		psqlLog.Error("Error while counting references to attachment %s :: %s", digest, err)
+		return
+	}
+	if references == 0 {
+		if err := os.Remove(d.blobPath(digest)); err != nil && !os.IsNotExist(err) {
+			psqlLog.Error("Error while removing attachment %s :: %s", digest, err)
+		}
+	}
+}
+
+// staleUploadAge is the age after which a temporary upload file is considered abandoned by the garbage collector.
+const staleUploadAge = time.Hour
+
+// CollectGarbage removes the attachment references of objects that do not exist anymore and reconciles the files
+// under basepath with the remaining references. Files that are not named like a digest are left untouched,
+// except for temporary upload files that were abandoned.
+func (d *PostgresqlDriver) CollectGarbage() (GarbageReport, error) {
+	report := GarbageReport{}
+	d.blobLock.Lock()
+	defer d.blobLock.Unlock()
+	result, err := d.db.Exec("DELETE FROM attachments WHERE uri NOT IN (SELECT uri FROM data WHERE uri IS NOT NULL)")
+	if err != nil {
+		psqlLog.Error("Error while deleting dangling attachment references :: %s", err)
+		return report, InternalServerError
+	}
+	if affected, err := result.RowsAffected(); err == nil {
+		report.References = int(affected)
+	}
+	rows, err := d.db.Query("SELECT DISTINCT digest FROM attachments")
+	if err != nil {
+		psqlLog.Error("Error while fetching attachment digests :: %s", err)
+		return report, InternalServerError
+	}
+	referenced := make(map[string]bool)
+	for rows.Next() {
+		var digest string
+		if err := rows.Scan(&digest); err != nil {
+			rows.Close()
+			psqlLog.Error("Error when reading attachment digest :: %s", err)
+			return report, InternalServerError
+		}
+		referenced[strings.TrimPrefix(digest, fosp.DigestPrefix)] = true
+	}
+	rows.Close()
+	files, err := ioutil.ReadDir(d.basepath)
+	if err != nil {
+		psqlLog.Error("Error while listing attachment files :: %s", err)
+		return report, InternalServerError
+	}
+	present := make(map[string]bool)
+	for _, file := range files {
+		if !file.Mode().IsRegular() {
+			continue
+		}
+		name := file.Name()
+		switch {
+		case strings.HasPrefix(name, ".upload-"):
+			if time.Since(file.ModTime()) < staleUploadAge {
+				continue
+			}
+		case isHexDigest(name):
+			if present[name] = true; referenced[name] {
+				continue
+			}
+		default:
+			continue
+		}
+		if err := os.Remove(d.basepath + "/" + name); err != nil {
+			psqlLog.Error("Error while removing attachment file %s :: %s", name, err)
+			continue
+		}
+		report.Blobs++
+		report.Bytes += file.Size()
+	}
+	for digest := range referenced {
+		if !present[digest] {
+			psqlLog.Error("Attachment file %s is missing", digest)
+			report.Missing++
+		}
 	}
-	return io.Copy(file, data)
+	return report, nil
 }
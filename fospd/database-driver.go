@@ -26,11 +26,71 @@ import (
 type DatabaseDriver interface {
 	Authenticate(string, string) bool
 	Register(string, string, *fosp.Object) bool
+	ScramCredentials(string) (*fosp.ScramCredentials, error)
+	CreateToken(*SessionToken) error
+	GetToken(string) (*SessionToken, error)
+	ListTokens(string) ([]*SessionToken, error)
+	DeleteToken(string, string) error
+	// ServerSecret returns the secret of the server with the given name. A random secret is generated and stored
+	// the first time, so that the secret stays the same when the server restarts.
+	ServerSecret(string) ([]byte, error)
+	// The notification queue of a user keeps notifications with increasing sequence numbers until they are acknowledged.
+	// QueueNotification assigns the next sequence number of the user to the record, stores it and removes
+	// the records of the user that exceed the retention limits.
+	QueueNotification(string, *fosp.NotificationRecord, NotificationRetention) error
+	// ListNotifications returns the queued records of the user after the given sequence number in order.
+	ListNotifications(string, uint64) ([]*fosp.NotificationRecord, error)
+	// AckNotifications removes the queued records of the user up to and including the given sequence number.
+	AckNotifications(string, uint64) error
+	// ListChanges returns up to limit changes of the object at the given URL and its descendants after the given
+	// change ID in order, together with the latest change ID of the owner of the object.
+	ListChanges(*url.URL, uint64, int) ([]*fosp.Change, uint64, error)
+	// The methods of the ObjectStore are applied immediately when they are called on the driver.
+	ObjectStore
+	// Transaction calls fn with an ObjectStore whose changes are applied atomically when fn returns nil
+	// and discarded when it returns an error, which is then returned by Transaction.
+	Transaction(fn func(ObjectStore) error) error
+	// Attachments are stored by their digest and reference counted, objects with the same
+	// attachment share the stored content. The content is removed when the last reference is gone.
+	// ReadAttachment returns the content of the attachment and its digest.
+	ReadAttachment(*url.URL) (io.ReadSeekCloser, string, error)
+	// StageAttachment stores data as new attachment content without attaching it to an object, which
+	// is done by LinkAttachment. If offset is positive, the content starts with the first offset bytes of the
+	// current attachment. When the data could only be read partially, the partial content is staged and
+	// returned together with the error. Staged content that is not linked has to be discarded.
+	StageAttachment(*url.URL, int64, io.Reader) (*StagedAttachment, error)
+	DiscardAttachment(*StagedAttachment)
+}
+
+// ObjectStore contains the operations on objects that can be combined in a transaction.
+type ObjectStore interface {
 	GetObjectWithParents(*url.URL) (fosp.Object, error)
 	CreateObject(*url.URL, *fosp.Object) error
 	UpdateObject(*url.URL, *fosp.Object) error
 	ListObjects(*url.URL) ([]string, error)
 	DeleteObjects(*url.URL) error
-	ReadAttachment(*url.URL) ([]byte, error)
-	WriteAttachment(*url.URL, io.Reader) (int64, error)
+	// Usage returns the storage used under the root of the owner of the object at the given URL.
+	// Drivers keep the usage of every user up to date when objects are changed, so it does not scan the objects.
+	// Inside a transaction the usage is locked until the transaction ends, like the change log in RecordChange.
+	Usage(*url.URL) (Usage, error)
+	// LinkAttachment makes the staged content the attachment of the object at the given URL.
+	// It fails with AttachmentChanged if the content was staged at an offset and the attachment changed since then.
+	LinkAttachment(*url.URL, *StagedAttachment) error
+	// RecordChange appends the change of the object at the given URL to the change log of its owner and assigns
+	// the next change ID of the owner to it. Earlier changes of the object, and of its descendants if it was
+	// deleted, are removed from the log. It has to be called before attachments are changed in a transaction.
+	RecordChange(*url.URL, *fosp.Change) error
+}
+
+// StagedAttachment is attachment content that was stored by StageAttachment.
+type StagedAttachment struct {
+	Size   int64
+	Digest string
+	// Base is the digest of the attachment whose beginning was copied when staging at an offset.
+	Base string
+
+	// content holds the data for drivers that keep attachments in the database.
+	content []byte
+	// file is the temporary file for drivers that keep attachments in files.
+	file string
 }
@@ -0,0 +1,421 @@
+// Copyright (C) 2015 Felix Maurer
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"bytes"
+	"github.com/maufl/go-fosp/fosp"
+	bolt "go.etcd.io/bbolt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func mustParseURL(t *testing.T, rawurl string) *url.URL {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		t.Fatalf("Could not parse URL %s: %s", rawurl, err)
+	}
+	return u
+}
+
+// writeAttachment stages data at offset and links it to the object at u.
+func writeAttachment(d DatabaseDriver, u *url.URL, offset int64, data string) (*StagedAttachment, error) {
+	staged, err := d.StageAttachment(u, offset, bytes.NewBufferString(data))
+	if err != nil {
+		if staged != nil {
+			d.DiscardAttachment(staged)
+		}
+		return nil, err
+	}
+	if err := d.LinkAttachment(u, staged); err != nil {
+		d.DiscardAttachment(staged)
+		return nil, err
+	}
+	return staged, nil
+}
+
+func TestMemoryDriver(t *testing.T) {
+	testDriverUsers(t, NewMemoryDriver())
+	testDriverObjects(t, NewMemoryDriver())
+	testDriverNotifications(t, NewMemoryDriver())
+	testDriverChanges(t, NewMemoryDriver())
+	testDriverUsage(t, NewMemoryDriver())
+}
+
+func TestBoltDriver(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fospd-bolt-test-")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	users := NewBoltDriver(dir + "/users.db")
+	defer users.Close()
+	testDriverUsers(t, users)
+	objects := NewBoltDriver(dir + "/objects.db")
+	defer objects.Close()
+	testDriverObjects(t, objects)
+	notifications := NewBoltDriver(dir + "/notifications.db")
+	defer notifications.Close()
+	testDriverNotifications(t, notifications)
+	changes := NewBoltDriver(dir + "/changes.db")
+	defer changes.Close()
+	testDriverChanges(t, changes)
+	usage := NewBoltDriver(dir + "/usage.db")
+	defer usage.Close()
+	testDriverUsage(t, usage)
+	// Databases written before the usage was kept have no usage stored, it is counted on first use.
+	usage.db.Update(func(tx *bolt.Tx) error { return tx.Bucket(boltUsageBucket).Delete([]byte("alice@example.com")) })
+	if err := usage.Transaction(func(store ObjectStore) error {
+		return store.CreateObject(mustParseURL(t, "fosp://alice@example.com/counted"), fosp.NewObject())
+	}); err != nil {
+		t.Fatalf("Creating object failed: %s", err)
+	}
+	if used, err := usage.Usage(mustParseURL(t, "fosp://alice@example.com/")); err != nil || used != (Usage{Objects: 3, AttachmentBytes: 3}) {
+		t.Errorf("Usage was not counted again: %+v, %v", used, err)
+	}
+}
+
+func testDriverUsers(t *testing.T, d DatabaseDriver) {
+	if !d.Register("alice@example.com", "secret", fosp.NewObject()) {
+		t.Fatalf("Registering a new user failed")
+	}
+	if d.Register("alice@example.com", "other", fosp.NewObject()) {
+		t.Errorf("Registering an existing user succeeded")
+	}
+	if !d.Authenticate("alice@example.com", "secret") {
+		t.Errorf("Authentication with the correct password failed")
+	}
+	if d.Authenticate("alice@example.com", "wrong") {
+		t.Errorf("Authentication with a wrong password succeeded")
+	}
+	if d.Authenticate("bob@example.com", "secret") {
+		t.Errorf("Authentication of an unknown user succeeded")
+	}
+}
+
+func testDriverObjects(t *testing.T, d DatabaseDriver) {
+	root := fosp.NewObject()
+	root.Owner = "alice@example.com"
+	d.Register("alice@example.com", "secret", root)
+
+	for _, rawurl := range []string{"fosp://alice@example.com/a", "fosp://alice@example.com/a/b", "fosp://alice@example.com/ab"} {
+		obj := fosp.NewObject()
+		obj.Data = rawurl
+		if err := d.CreateObject(mustParseURL(t, rawurl), obj); err != nil {
+			t.Fatalf("Creating object %s failed: %s", rawurl, err)
+		}
+	}
+	if err := d.CreateObject(mustParseURL(t, "fosp://alice@example.com/x/y"), fosp.NewObject()); err == nil {
+		t.Errorf("Creating an object without parent succeeded")
+	}
+
+	obj, err := d.GetObjectWithParents(mustParseURL(t, "fosp://alice@example.com/a/b"))
+	if err != nil {
+		t.Fatalf("Fetching object failed: %s", err)
+	}
+	if obj.Data != "fosp://alice@example.com/a/b" || obj.Parent == nil || obj.Parent.Parent == nil || obj.Parent.Parent.Owner != "alice@example.com" {
+		t.Errorf("Object and parents were not returned correctly: %#v", obj)
+	}
+
+	list, err := d.ListObjects(mustParseURL(t, "fosp://alice@example.com/"))
+	if err != nil {
+		t.Fatalf("Listing objects failed: %s", err)
+	}
+	sort.Strings(list)
+	if len(list) != 2 || list[0] != "a" || list[1] != "ab" {
+		t.Errorf("Expected children [a ab] but got %v", list)
+	}
+
+	if _, err := writeAttachment(d, mustParseURL(t, "fosp://alice@example.com/a/b"), 0, "Hello World!"); err != nil {
+		t.Fatalf("Writing attachment failed: %s", err)
+	}
+	if attachment, digest, err := d.ReadAttachment(mustParseURL(t, "fosp://alice@example.com/a/b")); err != nil {
+		t.Errorf("Reading attachment failed: %s", err)
+	} else {
+		data, _ := ioutil.ReadAll(attachment)
+		attachment.Close()
+		if string(data) != "Hello World!" || digest != fosp.Digest(data) {
+			t.Errorf("Reading attachment returned %q with digest %s", data, digest)
+		}
+	}
+	// The sibling shares the content with a/b, it has to survive the deletion of a.
+	if staged, err := writeAttachment(d, mustParseURL(t, "fosp://alice@example.com/ab"), 0, "Hello World!"); err != nil || staged.Digest != fosp.Digest([]byte("Hello World!")) {
+		t.Fatalf("Writing shared attachment failed: %v, %+v", err, staged)
+	}
+
+	if err := d.DeleteObjects(mustParseURL(t, "fosp://alice@example.com/a")); err != nil {
+		t.Fatalf("Deleting objects failed: %s", err)
+	}
+	if _, err := d.GetObjectWithParents(mustParseURL(t, "fosp://alice@example.com/a/b")); err == nil {
+		t.Errorf("Child object still exists after deleting its parent")
+	}
+	if _, _, err := d.ReadAttachment(mustParseURL(t, "fosp://alice@example.com/a/b")); err == nil {
+		t.Errorf("Attachment still exists after deleting its object")
+	}
+	if _, err := d.GetObjectWithParents(mustParseURL(t, "fosp://alice@example.com/ab")); err != nil {
+		t.Errorf("Sibling object sharing a name prefix was deleted")
+	}
+	if attachment, _, err := d.ReadAttachment(mustParseURL(t, "fosp://alice@example.com/ab")); err != nil {
+		t.Errorf("Shared attachment was deleted with another object: %s", err)
+	} else {
+		data, _ := ioutil.ReadAll(attachment)
+		attachment.Close()
+		if string(data) != "Hello World!" {
+			t.Errorf("Shared attachment changed to %q", data)
+		}
+	}
+	stale, err := d.StageAttachment(mustParseURL(t, "fosp://alice@example.com/ab"), 6, bytes.NewBufferString("World"))
+	if err != nil {
+		t.Fatalf("Staging at an offset failed: %s", err)
+	}
+	if staged, err := writeAttachment(d, mustParseURL(t, "fosp://alice@example.com/ab"), 6, "FOSP"); err != nil || staged.Size != 10 || staged.Digest != fosp.Digest([]byte("Hello FOSP")) {
+		t.Errorf("Writing at an offset returned %+v, %v", staged, err)
+	}
+	if err := d.LinkAttachment(mustParseURL(t, "fosp://alice@example.com/ab"), stale); err != AttachmentChanged {
+		t.Errorf("Linking content staged on a changed attachment returned %v", err)
+	}
+	d.DiscardAttachment(stale)
+
+	failed := NewFospError("Failed", fosp.StatusInternalServerError)
+	err = d.Transaction(func(store ObjectStore) error {
+		if err := store.CreateObject(mustParseURL(t, "fosp://alice@example.com/c"), fosp.NewObject()); err != nil {
+			return err
+		}
+		if err := store.DeleteObjects(mustParseURL(t, "fosp://alice@example.com/ab")); err != nil {
+			return err
+		}
+		return failed
+	})
+	if err != failed {
+		t.Errorf("Failed transaction returned %v", err)
+	}
+	if _, err := d.GetObjectWithParents(mustParseURL(t, "fosp://alice@example.com/c")); err == nil {
+		t.Errorf("Object created in a failed transaction exists")
+	}
+	if attachment, _, err := d.ReadAttachment(mustParseURL(t, "fosp://alice@example.com/ab")); err != nil {
+		t.Errorf("Attachment deleted in a failed transaction is gone: %s", err)
+	} else {
+		attachment.Close()
+	}
+}
+
+func testDriverUsage(t *testing.T, d DatabaseDriver) {
+	d.Register("alice@example.com", "secret", fosp.NewObject())
+	d.Register("bob@example.com", "secret", fosp.NewObject())
+	expectUsage := func(user string, expected Usage) {
+		if usage, err := d.Usage(mustParseURL(t, "fosp://"+user+"/some/object")); err != nil || usage != expected {
+			t.Errorf("Expected usage %+v of %s but got %+v, %v", expected, user, usage, err)
+		}
+	}
+	expectUsage("alice@example.com", Usage{Objects: 1})
+
+	withAttachment := func(size uint) *fosp.Object {
+		obj := fosp.NewObject()
+		obj.Attachment = fosp.NewAttachment()
+		obj.Attachment.Size = size
+		return obj
+	}
+	for _, rawurl := range []string{"fosp://alice@example.com/a", "fosp://alice@example.com/a/b"} {
+		if err := d.CreateObject(mustParseURL(t, rawurl), withAttachment(5)); err != nil {
+			t.Fatalf("Creating object %s failed: %s", rawurl, err)
+		}
+	}
+	d.CreateObject(mustParseURL(t, "fosp://bob@example.com/a"), fosp.NewObject())
+	expectUsage("alice@example.com", Usage{Objects: 3, AttachmentBytes: 10})
+	expectUsage("bob@example.com", Usage{Objects: 2})
+
+	if err := d.UpdateObject(mustParseURL(t, "fosp://alice@example.com/a/b"), withAttachment(2)); err != nil {
+		t.Fatalf("Updating object failed: %s", err)
+	}
+	expectUsage("alice@example.com", Usage{Objects: 3, AttachmentBytes: 7})
+
+	failed := NewFospError("Failed", fosp.StatusInternalServerError)
+	d.Transaction(func(store ObjectStore) error {
+		if err := store.DeleteObjects(mustParseURL(t, "fosp://alice@example.com/a")); err != nil {
+			return err
+		}
+		return failed
+	})
+	expectUsage("alice@example.com", Usage{Objects: 3, AttachmentBytes: 7})
+
+	if err := d.DeleteObjects(mustParseURL(t, "fosp://alice@example.com/a/b")); err != nil {
+		t.Fatalf("Deleting object failed: %s", err)
+	}
+	expectUsage("alice@example.com", Usage{Objects: 2, AttachmentBytes: 5})
+
+	// Siblings that share a name prefix are not deleted and still count.
+	if err := d.CreateObject(mustParseURL(t, "fosp://alice@example.com/ab"), withAttachment(3)); err != nil {
+		t.Fatalf("Creating object failed: %s", err)
+	}
+	if err := d.DeleteObjects(mustParseURL(t, "fosp://alice@example.com/a")); err != nil {
+		t.Fatalf("Deleting object failed: %s", err)
+	}
+	expectUsage("alice@example.com", Usage{Objects: 2, AttachmentBytes: 3})
+}
+
+func testDriverNotifications(t *testing.T, d DatabaseDriver) {
+	d.Register("alice@example.com", "secret", fosp.NewObject())
+	queue := func(event string, retention NotificationRetention) uint64 {
+		record := &fosp.NotificationRecord{Event: event, URL: "fosp://alice@example.com/a", Time: time.Now().UTC()}
+		if err := d.QueueNotification("alice@example.com", record, retention); err != nil {
+			t.Fatalf("Queueing a notification failed: %s", err)
+		}
+		return record.Seq
+	}
+	sequence := func(since uint64) (seqs []uint64) {
+		records, err := d.ListNotifications("alice@example.com", since)
+		if err != nil {
+			t.Fatalf("Listing notifications failed: %s", err)
+		}
+		for _, record := range records {
+			seqs = append(seqs, record.Seq)
+		}
+		return seqs
+	}
+	for i, event := range []string{fosp.CREATED, fosp.UPDATED, fosp.DELETED} {
+		if seq := queue(event, NotificationRetention{}); seq != uint64(i+1) {
+			t.Errorf("Notification %d got sequence number %d", i+1, seq)
+		}
+	}
+	if seqs := sequence(1); !reflect.DeepEqual(seqs, []uint64{2, 3}) {
+		t.Errorf("Notifications after 1 are %v", seqs)
+	}
+	if err := d.AckNotifications("alice@example.com", 2); err != nil {
+		t.Errorf("Acknowledging notifications failed: %s", err)
+	}
+	if seqs := sequence(0); !reflect.DeepEqual(seqs, []uint64{3}) {
+		t.Errorf("Notifications after acknowledging 2 are %v", seqs)
+	}
+	// Sequence numbers are not reused after acknowledging and the oldest records are dropped beyond the limit.
+	queue(fosp.UPDATED, NotificationRetention{})
+	if seq := queue(fosp.UPDATED, NotificationRetention{MaxCount: 2}); seq != 5 {
+		t.Errorf("Notification after acknowledging got sequence number %d", seq)
+	}
+	if seqs := sequence(0); !reflect.DeepEqual(seqs, []uint64{4, 5}) {
+		t.Errorf("Notifications with a limit of 2 are %v", seqs)
+	}
+	if err := d.QueueNotification("mallory@example.com", &fosp.NotificationRecord{Event: fosp.CREATED}, NotificationRetention{}); err == nil {
+		t.Errorf("Queueing a notification for an unknown user succeeded")
+	}
+}
+
+func testDriverChanges(t *testing.T, d DatabaseDriver) {
+	d.Register("alice@example.com", "secret", fosp.NewObject())
+	record := func(store ObjectStore, event, rawurl string) uint64 {
+		change := &fosp.Change{Event: event, URL: rawurl, Time: time.Now().UTC()}
+		if err := store.RecordChange(mustParseURL(t, rawurl), change); err != nil {
+			t.Fatalf("Recording change %s %s failed: %s", event, rawurl, err)
+		}
+		return change.ID
+	}
+	list := func(rawurl string, since uint64, limit int) (ids []uint64, last uint64) {
+		changes, last, err := d.ListChanges(mustParseURL(t, rawurl), since, limit)
+		if err != nil {
+			t.Fatalf("Listing changes of %s failed: %s", rawurl, err)
+		}
+		for _, change := range changes {
+			ids = append(ids, change.ID)
+		}
+		return ids, last
+	}
+	record(d, fosp.CREATED, "fosp://alice@example.com/a")
+	record(d, fosp.CREATED, "fosp://alice@example.com/a/b")
+	record(d, fosp.UPDATED, "fosp://alice@example.com/a")
+	if id := record(d, fosp.CREATED, "fosp://alice@example.com/ab"); id != 4 {
+		t.Errorf("Fourth change got the ID %d", id)
+	}
+	// The first change of a was replaced by the update, ab is not a descendant of a.
+	if ids, last := list("fosp://alice@example.com/a", 0, 10); !reflect.DeepEqual(ids, []uint64{2, 3}) || last != 4 {
+		t.Errorf("Changes of a are %v with the latest ID %d", ids, last)
+	}
+	if ids, _ := list("fosp://alice@example.com/", 2, 10); !reflect.DeepEqual(ids, []uint64{3, 4}) {
+		t.Errorf("Changes after 2 are %v", ids)
+	}
+	if ids, _ := list("fosp://alice@example.com/", 0, 1); !reflect.DeepEqual(ids, []uint64{2}) {
+		t.Errorf("First change is %v", ids)
+	}
+	record(d, fosp.DELETED, "fosp://alice@example.com/a")
+	if ids, _ := list("fosp://alice@example.com/", 0, 10); !reflect.DeepEqual(ids, []uint64{4, 5}) {
+		t.Errorf("Changes after deleting a are %v", ids)
+	}
+
+	d.Transaction(func(store ObjectStore) error {
+		record(store, fosp.DELETED, "fosp://alice@example.com/ab")
+		return AttachmentChanged
+	})
+	if ids, last := list("fosp://alice@example.com/", 0, 10); !reflect.DeepEqual(ids, []uint64{4, 5}) || last != 5 {
+		t.Errorf("Changes after a failed transaction are %v with the latest ID %d", ids, last)
+	}
+	if ids, last := list("fosp://bob@example.com/", 0, 10); len(ids) != 0 || last != 0 {
+		t.Errorf("Changes of a user without changes are %v with the latest ID %d", ids, last)
+	}
+}
+
+func TestMemoryDriverGarbageCollection(t *testing.T) {
+	d := NewMemoryDriver()
+	d.Register("alice@example.com", "secret", fosp.NewObject())
+	file := mustParseURL(t, "fosp://alice@example.com/file")
+	d.CreateObject(file, fosp.NewObject())
+	writeAttachment(d, file, 0, "kept")
+	// Simulate a lost reference and an attachment whose object vanished.
+	d.blobs[fosp.Digest([]byte("orphan"))] = &memoryBlob{data: []byte("orphan"), references: 1}
+	d.attachments["fosp://alice@example.com/gone"] = fosp.Digest([]byte("kept"))
+	d.blobs[fosp.Digest([]byte("kept"))].references++
+
+	report, err := d.CollectGarbage()
+	if err != nil || report.Blobs != 1 || report.References != 1 || report.Bytes != 6 || report.Missing != 0 {
+		t.Errorf("Unexpected garbage collection report %+v, %v", report, err)
+	}
+	if blob := d.blobs[fosp.Digest([]byte("kept"))]; blob == nil || blob.references != 1 {
+		t.Errorf("References were not recounted: %+v", blob)
+	}
+	if _, _, err := d.ReadAttachment(file); err != nil {
+		t.Errorf("Referenced attachment was collected: %s", err)
+	}
+}
+
+func TestBoltDriverGarbageCollection(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fospd-bolt-test-")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	d := NewBoltDriver(dir + "/gc.db")
+	defer d.Close()
+	d.Register("alice@example.com", "secret", fosp.NewObject())
+	file := mustParseURL(t, "fosp://alice@example.com/file")
+	d.CreateObject(file, fosp.NewObject())
+	writeAttachment(d, file, 0, "kept")
+	d.db.Update(func(tx *bolt.Tx) error {
+		tx.Bucket(boltBlobsBucket).Put([]byte(fosp.Digest([]byte("orphan"))), []byte("orphan"))
+		return tx.Bucket(boltAttachmentsBucket).Put([]byte("fosp://alice@example.com/gone"), []byte(fosp.Digest([]byte("kept"))))
+	})
+
+	report, err := d.CollectGarbage()
+	if err != nil || report.Blobs != 1 || report.References != 1 || report.Bytes != 6 || report.Missing != 0 {
+		t.Errorf("Unexpected garbage collection report %+v, %v", report, err)
+	}
+	if attachment, _, err := d.ReadAttachment(file); err != nil {
+		t.Errorf("Referenced attachment was collected: %s", err)
+	} else {
+		attachment.Close()
+	}
+}
@@ -0,0 +1,122 @@
+// Copyright (C) 2015 Felix Maurer
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"context"
+	"net/url"
+	"sort"
+	"sync"
+)
+
+// groupsPath is the path below the root of a user where the group definitions of this user are stored.
+// Every child of this object defines a group, its name is the group name and the
+// "members" field of its data lists the users that belong to the group, e.g.
+//   fosp://alice@example.com/groups/friends {"data": {"members": ["bob@example.com"]}}
+// The groups of an ACL always refer to the groups defined by the owner of the tree the ACL belongs to.
+const groupsPath = "/groups"
+
+// groupCache keeps the group definitions that were read while handling a request or sending the notifications about
+// an event, so that they are read once and not for every permission check.
+type groupCache struct {
+	lock sync.Mutex
+	// definitions maps the owner of a tree to the members of the groups defined in the tree by group name.
+	definitions map[string]map[string][]string
+}
+
+// groupCacheKey is the key of the groupCache in a context.
+type groupCacheKey struct{}
+
+// withGroupCache returns a context that caches the group definitions that are read with it.
+func withGroupCache(ctx context.Context) context.Context {
+	return context.WithValue(ctx, groupCacheKey{}, &groupCache{definitions: make(map[string]map[string][]string)})
+}
+
+// groupsOf returns the names of all groups that user is a member of in the tree of the resource at u.
+// The group definitions are read from the cache of ctx, if it has one.
+func (d *Database) groupsOf(ctx context.Context, user string, u *url.URL) []string {
+	if user == "" {
+		return nil
+	}
+	definitions := d.groupDefinitions(ctx, u)
+	groups := make([]string, 0, len(definitions))
+	for name, members := range definitions {
+		if contains(members, user) {
+			groups = append(groups, name)
+		}
+	}
+	// The permissions of later groups overwrite those of earlier ones, so their order has to be stable.
+	sort.Strings(groups)
+	return groups
+}
+
+// groupDefinitions returns the members of the groups defined in the tree of the resource at u by group name.
+func (d *Database) groupDefinitions(ctx context.Context, u *url.URL) map[string][]string {
+	owner := rootOwner(u)
+	cache, _ := ctx.Value(groupCacheKey{}).(*groupCache)
+	if cache != nil {
+		cache.lock.Lock()
+		definitions, ok := cache.definitions[owner]
+		cache.lock.Unlock()
+		if ok {
+			return definitions
+		}
+	}
+	definitions := make(map[string][]string)
+	groupsURL := *u
+	groupsURL.Path = groupsPath
+	if _, err := d.driver.GetObjectWithParents(&groupsURL); err == nil {
+		names, err := d.driver.ListObjects(&groupsURL)
+		if err != nil {
+			names = nil
+		}
+		for _, name := range names {
+			groupURL := groupsURL
+			groupURL.Path = groupsPath + "/" + name
+			group, err := d.driver.GetObjectWithParents(&groupURL)
+			if err != nil {
+				dbLog.Warning("Could not read group definition %s :: %s", &groupURL, err)
+				continue
+			}
+			definitions[name] = groupMembers(group.Data)
+		}
+	}
+	if cache != nil {
+		cache.lock.Lock()
+		cache.definitions[owner] = definitions
+		cache.lock.Unlock()
+	}
+	return definitions
+}
+
+// groupMembers extracts the member list from the data of a group definition object.
+func groupMembers(data interface{}) []string {
+	fields, ok := data.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	list, ok := fields["members"].([]interface{})
+	if !ok {
+		return nil
+	}
+	members := make([]string, 0, len(list))
+	for _, element := range list {
+		if member, ok := element.(string); ok {
+			members = append(members, member)
+		}
+	}
+	return members
+}
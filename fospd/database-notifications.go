@@ -17,40 +17,115 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"github.com/maufl/go-fosp/fosp"
-	"strings"
 )
 
-func (d *Database) notify(event string, object *fosp.Object) {
+// patchDelta describes an UPDATED event that was caused by a patch, so that subscribers can get the patch
+// instead of the whole object.
+type patchDelta struct {
+	patch fosp.PatchObject
+	// base is the entity tag of the object before the patch was applied.
+	base string
+}
+
+// deltaFor returns delta if the subscription asks for deltas and nil otherwise.
+func deltaFor(entry *fosp.SubscriptionEntry, delta *patchDelta) *patchDelta {
+	if entry == nil || !entry.Delta {
+		return nil
+	}
+	return delta
+}
+
+// notify sends notifications about event on object to the subscribed users and connections.
+// delta is the patch that caused an UPDATED event, or nil.
+func (d *Database) notify(event string, object *fosp.Object, delta *patchDelta) {
 	dbLog.Debug("Event %s on object %s occured", event, object.URL)
-	users := subscribedUsers(object, event, 0)
-	dbLog.Debug("Users %v should be notified", users)
-	for _, user := range users {
-		notification := fosp.NewNotification(event, object.URL)
-		if event != fosp.DELETED {
-			if serialized, err := json.Marshal(object); err == nil {
-				notification.Body = bytes.NewBuffer(serialized)
-			} else {
-				dbLog.Error("Unable to serialize object %s for sending notification :: %s", object.URL, err)
-				continue
-			}
+	var etag string
+	if event != fosp.DELETED {
+		var err error
+		if etag, err = fosp.ComputeETag(object); err != nil {
+			dbLog.Error("Unable to compute entity tag of %s for sending notification :: %s", object.URL, err)
+			return
+		}
+	}
+	// The permissions of all subscribers are checked against the same group definitions.
+	ctx := withGroupCache(context.Background())
+	subscribers := subscribedUsers(object, event, 0)
+	dbLog.Debug("Users %v should be notified", subscribers)
+	for user, entry := range subscribers {
+		if notification, ok := d.notificationFor(ctx, user, event, object, etag, deltaFor(entry, delta)); ok {
+			d.server.routeNotification(user, notification)
+		}
+	}
+	d.server.notifySubscribers(ctx, event, object, etag, delta)
+}
+
+// notificationFor creates the notification about event on object for user. It contains the object as user would get
+// it with GET, or with a delta the fields of the patch that user may read, and the entity tag of the object.
+// Permissions are checked when the notification is delivered, so that subscriptions can not be used to read what the
+// ACL hides. It returns false if user may not subscribe to the object anymore or may not read any of its fields.
+func (d *Database) notificationFor(ctx context.Context, user, event string, object *fosp.Object, etag string, delta *patchDelta) (*fosp.Notification, bool) {
+	groups := d.groupsOf(ctx, user, object.URL)
+	if !object.PermissionsForSubscriptions(user, groups...).Contain(fosp.PermissionWrite) {
+		dbLog.Debug("Dropping notification %s %s for %s who may not subscribe", event, object.URL, user)
+		return nil, false
+	}
+	visible := *object
+	if err := stripUnreadable(&visible, user, groups); err != nil {
+		return nil, false
+	}
+	notification := fosp.NewNotification(event, object.URL)
+	if event == fosp.DELETED {
+		return notification, true
+	}
+	notification.Header.Set(fosp.ETagHeader, etag)
+	var content interface{} = &visible
+	if delta != nil {
+		notification.Header.Set(fosp.BaseETagHeader, delta.base)
+		content = visiblePatch(delta.patch, object, user, groups)
+	}
+	body, err := json.Marshal(content)
+	if err != nil {
+		dbLog.Error("Unable to serialize object %s for sending notification :: %s", object.URL, err)
+		return nil, false
+	}
+	notification.Body = bytes.NewBuffer(body)
+	return notification, true
+}
+
+// visiblePatch returns the fields of patch that user, as a member of groups, may read on object.
+// The same fields are hidden as by stripUnreadable.
+func visiblePatch(patch fosp.PatchObject, object *fosp.Object, user string, groups []string) fosp.PatchObject {
+	visible := fosp.PatchObject{}
+	for field, value := range patch {
+		var perms *fosp.PermissionSet
+		switch field {
+		case "data", "type":
+			perms = object.PermissionsForData(user, groups...)
+		case "acl":
+			perms = object.PermissionsForAcl(user, groups...)
+		case "subscriptions":
+			perms = object.PermissionsForSubscriptions(user, groups...)
+		}
+		if perms == nil || perms.Contain(fosp.PermissionRead) {
+			visible[field] = value
 		}
-		d.server.routeNotification(user, notification)
 	}
+	return visible
 }
 
-func subscribedUsers(obj *fosp.Object, event string, depth int) (users []string) {
+// subscribedUsers returns the users that subscribed to event on obj, which is depth levels below the object it was
+// called on first, together with their subscription. The subscription closest to the object wins.
+func subscribedUsers(obj *fosp.Object, event string, depth int) map[string]*fosp.SubscriptionEntry {
+	users := make(map[string]*fosp.SubscriptionEntry)
 	if obj.Parent != nil {
 		users = subscribedUsers(obj.Parent, event, depth+1)
 	}
 	for user, subscription := range obj.Subscriptions {
-		if !contains(users, user) && (subscription.Depth == -1 || subscription.Depth >= depth) {
-			for _, ev := range subscription.Events {
-				if strings.EqualFold(ev, event) {
-					users = append(users, user)
-				}
-			}
+		if subscription.Matches(event, depth) {
+			users[user] = subscription
 		}
 	}
 	return users
@@ -0,0 +1,110 @@
+// Copyright (C) 2015 Felix Maurer
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"github.com/maufl/go-fosp/fosp"
+	"net/url"
+	"sync"
+)
+
+// Preconditions make a modifying request conditional on the current state of the object,
+// see fosp.IfMatchHeader and fosp.IfNoneMatchHeader. Empty fields are not checked.
+type Preconditions struct {
+	IfMatch     string
+	IfNoneMatch string
+}
+
+// preconditionsOf reads the preconditions from the headers of req.
+func preconditionsOf(req *fosp.Request) Preconditions {
+	return Preconditions{IfMatch: req.Header.Get(fosp.IfMatchHeader), IfNoneMatch: req.Header.Get(fosp.IfNoneMatchHeader)}
+}
+
+// check fails with PreconditionFailed if the entity tag of object does not satisfy the preconditions.
+func (p Preconditions) check(object *fosp.Object) error {
+	etag, err := fosp.ComputeETag(object)
+	if err != nil {
+		return InternalServerError
+	}
+	if p.IfMatch != "" && !fosp.MatchETag(p.IfMatch, etag) {
+		return PreconditionFailed
+	}
+	if p.IfNoneMatch != "" && fosp.MatchETag(p.IfNoneMatch, etag) {
+		return PreconditionFailed
+	}
+	return nil
+}
+
+// checkWrite is like check, but the preconditions may also refer to the digest of the attachment of object.
+// If-None-Match: * only fails if the object already has an attachment.
+func (p Preconditions) checkWrite(object *fosp.Object) error {
+	etag, err := fosp.ComputeETag(object)
+	if err != nil {
+		return InternalServerError
+	}
+	digest := ""
+	if object.Attachment != nil {
+		digest = object.Attachment.Digest
+	}
+	if p.IfMatch != "" && !fosp.MatchETag(p.IfMatch, etag) && !fosp.MatchDigest(p.IfMatch, digest) {
+		return PreconditionFailed
+	}
+	if p.IfNoneMatch != "" && (fosp.ListContains(p.IfNoneMatch, etag) || fosp.MatchDigest(p.IfNoneMatch, digest)) {
+		return PreconditionFailed
+	}
+	return nil
+}
+
+// objectLocks serializes writes to the attachment of the same object. The data of a write is received outside
+// of a transaction, the lock keeps concurrent writes from staging content for the same object at the same time.
+type objectLocks struct {
+	lock    sync.Mutex
+	entries map[string]*objectLock
+}
+
+type objectLock struct {
+	sync.Mutex
+	waiting int
+}
+
+// Lock locks the object at u and returns a function that unlocks it again.
+func (l *objectLocks) Lock(u *url.URL) (unlock func()) {
+	return l.LockKey(u.String())
+}
+
+// LockKey locks an arbitrary key, e.g. the notification queue of a user, and returns a function that unlocks it again.
+func (l *objectLocks) LockKey(key string) (unlock func()) {
+	l.lock.Lock()
+	if l.entries == nil {
+		l.entries = make(map[string]*objectLock)
+	}
+	entry, ok := l.entries[key]
+	if !ok {
+		entry = &objectLock{}
+		l.entries[key] = entry
+	}
+	entry.waiting++
+	l.lock.Unlock()
+	entry.Lock()
+	return func() {
+		entry.Unlock()
+		l.lock.Lock()
+		if entry.waiting--; entry.waiting == 0 {
+			delete(l.entries, key)
+		}
+		l.lock.Unlock()
+	}
+}
@@ -0,0 +1,91 @@
+// Copyright (C) 2015 Felix Maurer
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/maufl/go-fosp/fosp"
+	"github.com/maufl/go-fosp/fosp/fospclient"
+	"sync"
+	"testing"
+)
+
+func TestConditionalRequests(t *testing.T) {
+	srv, connection, closer := dialTestServer(t)
+	defer closer()
+	srv.database.Register("alice@example.com", "secret")
+	client := fospclient.New(connection)
+	if err := client.Authenticate("alice@example.com", "secret"); err != nil {
+		t.Fatalf("Authentication failed: %s", err)
+	}
+	notes := mustParseURL(t, "fosp://alice@example.com/notes")
+	client.Create(notes, fosp.NewObject())
+	obj, err := client.Get(notes)
+	if err != nil || obj.ETag == "" {
+		t.Fatalf("Expected an entity tag but got %v, %v", obj, err)
+	}
+	if _, err := client.GetIfNoneMatch(notes, obj.ETag); err != fospclient.ErrNotModified {
+		t.Errorf("Expected unchanged object to be not modified but got %v", err)
+	}
+
+	etag, err := client.PatchIfMatch(notes, obj.ETag, fosp.PatchObject{"data": "first"})
+	if err != nil || etag == "" || etag == obj.ETag {
+		t.Fatalf("Conditional patch failed: %v, new entity tag %q", err, etag)
+	}
+	// A second device still has the old entity tag and must not overwrite the change.
+	if _, err := client.PatchIfMatch(notes, obj.ETag, fosp.PatchObject{"data": "second"}); !fospclient.IsPreconditionFailed(err) {
+		t.Errorf("Expected stale patch to fail the precondition but got %v", err)
+	}
+	if current, err := client.GetIfNoneMatch(notes, obj.ETag); err != nil || current.Data != "first" || current.ETag != etag {
+		t.Errorf("Expected the first change with entity tag %s but got %v, %v", etag, current, err)
+	}
+
+	if etag, err = client.WriteIfMatch(notes, etag, bytes.NewBufferString("attachment")); err != nil {
+		t.Fatalf("Conditional write failed: %s", err)
+	}
+	if err := client.DeleteIfMatch(notes, obj.ETag); !fospclient.IsPreconditionFailed(err) {
+		t.Errorf("Expected stale delete to fail the precondition but got %v", err)
+	}
+	if err := client.DeleteIfMatch(notes, etag); err != nil {
+		t.Errorf("Conditional delete failed: %s", err)
+	}
+}
+
+func TestConcurrentPatchesKeepAllChanges(t *testing.T) {
+	db := newTestDatabase(t)
+	notes := mustParseURL(t, "fosp://alice@example.com/notes")
+	if _, err := db.Create(context.Background(), "alice@example.com", notes, fosp.NewObject()); err != nil {
+		t.Fatalf("Create failed: %s", err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			patch := fosp.PatchObject{"data": map[string]interface{}{fmt.Sprintf("device%d", i): true}}
+			if _, err := db.Patch(context.Background(), "alice@example.com", notes, Preconditions{}, patch); err != nil {
+				t.Errorf("Patch failed: %s", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	obj, err := db.Get(context.Background(), "alice@example.com", notes)
+	if data, ok := obj.Data.(map[string]interface{}); err != nil || !ok || len(data) != 20 {
+		t.Errorf("Expected the changes of all 20 patches but got %v, %v", obj.Data, err)
+	}
+}
@@ -16,6 +16,7 @@
 package main
 
 import (
+	"context"
 	"github.com/maufl/go-fosp/fosp"
 	"github.com/op/go-logging"
 	"io"
@@ -32,6 +33,7 @@ var dbLog = logging.MustGetLogger("go-fosp/fosp/database")
 type Database struct {
 	driver DatabaseDriver
 	server *Server
+	locks  objectLocks
 }
 
 // NewDatabase creates a new Database struct and intializes the databaseDriver and server field.
@@ -50,6 +52,11 @@ func (d *Database) Authenticate(user, password string) bool {
 	return d.driver.Authenticate(user, password)
 }
 
+// ScramCredentials returns the SCRAM verifier stored for user.
+func (d *Database) ScramCredentials(user string) (*fosp.ScramCredentials, error) {
+	return d.driver.ScramCredentials(user)
+}
+
 func (d *Database) Register(user, password string) bool {
 	newRoot := fosp.NewObject()
 	newRoot.Owner = user
@@ -68,83 +75,123 @@ func (d *Database) Register(user, password string) bool {
 }
 
 // Get returns the object for the given url.
-func (d *Database) Get(user string, url *url.URL) (fosp.Object, error) {
+func (d *Database) Get(ctx context.Context, user string, url *url.URL) (fosp.Object, error) {
+	if err := ctx.Err(); err != nil {
+		return fosp.Object{}, err
+	}
 	object, err := d.driver.GetObjectWithParents(url)
 	if err != nil {
 		return fosp.Object{}, err
 	}
-	missingPermissions := 0
-	if !object.PermissionsForData(user).Contain(fosp.PermissionRead) {
-		object.Data = nil
-		object.Type = nil
-		missingPermissions += 1
-	}
-	if !object.PermissionsForAcl(user).Contain(fosp.PermissionRead) {
-		object.Acl = nil
-		missingPermissions += 1
+	if object.ETag, err = fosp.ComputeETag(&object); err != nil {
+		return fosp.Object{}, InternalServerError
 	}
-	if !object.PermissionsForSubscriptions(user).Contain(fosp.PermissionRead) {
-		object.Subscriptions = nil
-		missingPermissions += 1
-	}
-	if missingPermissions == 3 {
-		return fosp.Object{}, NewFospError("Insufficent rights", fosp.StatusForbidden)
+	if err := stripUnreadable(&object, user, d.groupsOf(ctx, user, url)); err != nil {
+		return fosp.Object{}, err
 	}
 	dbLog.Debug("Selected object is %v", object)
 	return object, nil
 }
 
 // Create saves a new object at the given url.
-func (d *Database) Create(user string, url *url.URL, o *fosp.Object) (*fosp.Object, error) {
+// The parent is checked and the object is stored in one transaction.
+func (d *Database) Create(ctx context.Context, user string, url *url.URL, o *fosp.Object) (*fosp.Object, error) {
 	if url.Path == "/" {
 		return nil, BadRequest
 	}
 	parentUrl := *url
 	parentUrl.Path = path.Dir(url.Path)
-	parent, err := d.driver.GetObjectWithParents(&parentUrl)
-	if err != nil {
-		dbLog.Warning("Could not get parent %s for new object %s", parentUrl, url)
-		return nil, err
-	}
-	dbLog.Debug("Parent of to be created object is %v", parent)
-
+	groups := d.groupsOf(ctx, user, url)
 	o.Updated = time.Now().UTC()
 	o.Created = time.Now().UTC()
 	o.Owner = user
-	err = d.driver.CreateObject(url, o)
+	var created fosp.Object
+	err := d.transaction(ctx, func(store ObjectStore) error {
+		parent, err := store.GetObjectWithParents(&parentUrl)
+		if err != nil {
+			dbLog.Warning("Could not get parent %s for new object %s", parentUrl, url)
+			return err
+		}
+		dbLog.Debug("Parent of to be created object is %v", parent)
+		if !parent.PermissionsForChildren(user, groups...).Contain(fosp.PermissionWrite) {
+			return Forbidden
+		}
+		if err := d.checkObjectQuota(store, url, o, true); err != nil {
+			return err
+		}
+		if err := store.CreateObject(url, o); err != nil {
+			return err
+		}
+		if created, err = store.GetObjectWithParents(url); err != nil {
+			return err
+		}
+		o.ETag, _ = fosp.ComputeETag(o)
+		return d.recordChange(store, fosp.CREATED, url, o.ETag)
+	})
 	if err != nil {
 		return nil, err
 	}
-	if object, err := d.driver.GetObjectWithParents(url); err == nil {
-		go d.notify(fosp.CREATED, &object)
-	}
+	go d.notify(fosp.CREATED, &created, nil)
 	return o, nil
 }
 
-// Update merges changes into the object at the given url.
-func (d *Database) Patch(user string, url *url.URL, patch fosp.PatchObject) (*fosp.Object, error) {
-	obj, err := d.driver.GetObjectWithParents(url)
-	if err != nil {
-		return nil, err
-	}
-	dbLog.Debug("Before patching, object is %#v", obj)
-	if err := obj.Patch(patch); err != nil {
-		return nil, err
-	}
-	dbLog.Debug("Patched object is now %#v", obj)
-	obj.Updated = time.Now().UTC()
-	err = d.driver.UpdateObject(url, &obj)
+// Patch merges changes into the object at the given url if the preconditions are satisfied.
+// The object is read, checked and updated in one transaction.
+func (d *Database) Patch(ctx context.Context, user string, url *url.URL, pre Preconditions, patch fosp.PatchObject) (*fosp.Object, error) {
+	groups := d.groupsOf(ctx, user, url)
+	var obj, updated fosp.Object
+	var base string
+	err := d.transaction(ctx, func(store ObjectStore) error {
+		var err error
+		if obj, err = store.GetObjectWithParents(url); err != nil {
+			return err
+		}
+		if !patchPermitted(user, groups, &obj, patch) {
+			return Forbidden
+		}
+		if err := pre.check(&obj); err != nil {
+			return err
+		}
+		dbLog.Debug("Before patching, object is %#v", obj)
+		if base, err = fosp.ComputeETag(&obj); err != nil {
+			return err
+		}
+		if err := obj.Patch(patch); err != nil {
+			return err
+		}
+		dbLog.Debug("Patched object is now %#v", obj)
+		obj.Updated = time.Now().UTC()
+		if err := d.checkObjectQuota(store, url, &obj, false); err != nil {
+			return err
+		}
+		if err := store.UpdateObject(url, &obj); err != nil {
+			return err
+		}
+		if updated, err = store.GetObjectWithParents(url); err != nil {
+			return err
+		}
+		obj.ETag, _ = fosp.ComputeETag(&obj)
+		return d.recordChange(store, fosp.UPDATED, url, obj.ETag)
+	})
 	if err != nil {
 		return nil, err
 	}
-	if object, err := d.driver.GetObjectWithParents(url); err == nil {
-		go d.notify(fosp.UPDATED, &object)
-	}
+	go d.notify(fosp.UPDATED, &updated, &patchDelta{patch: patch, base: base})
 	return &obj, nil
 }
 
 // List returns all child objects for the given url.
-func (d *Database) List(user string, url *url.URL) ([]string, error) {
+func (d *Database) List(ctx context.Context, user string, url *url.URL) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return []string{}, err
+	}
+	obj, err := d.driver.GetObjectWithParents(url)
+	if err != nil {
+		return []string{}, err
+	}
+	if !obj.PermissionsForChildren(user, d.groupsOf(ctx, user, url)...).Contain(fosp.PermissionRead) {
+		return []string{}, Forbidden
+	}
 	list, err := d.driver.ListObjects(url)
 	if err != nil {
 		return []string{}, err
@@ -152,42 +199,228 @@ func (d *Database) List(user string, url *url.URL) ([]string, error) {
 	return list, nil
 }
 
-// Delete removes the object for the given url.
-func (d *Database) Delete(user string, url *url.URL) error {
+// Delete removes the object for the given url if the preconditions are satisfied.
+// The object is read, checked and deleted in one transaction.
+func (d *Database) Delete(ctx context.Context, user string, url *url.URL, pre Preconditions) error {
 	if path.Base(url.Path) == "/" {
 		return BadRequest
 	}
-	obj, err := d.driver.GetObjectWithParents(url)
-	if err != nil {
-		return err
-	}
-	err = d.driver.DeleteObjects(url)
+	groups := d.groupsOf(ctx, user, url)
+	var obj fosp.Object
+	err := d.transaction(ctx, func(store ObjectStore) error {
+		var err error
+		if obj, err = store.GetObjectWithParents(url); err != nil {
+			return err
+		}
+		if obj.Parent == nil || !obj.Parent.PermissionsForChildren(user, groups...).Contain(fosp.PermissionDelete) {
+			return Forbidden
+		}
+		if err := pre.check(&obj); err != nil {
+			return err
+		}
+		if err := d.recordChange(store, fosp.DELETED, url, ""); err != nil {
+			return err
+		}
+		return store.DeleteObjects(url)
+	})
 	if err == nil {
-		go d.notify(fosp.DELETED, &obj)
+		go d.notify(fosp.DELETED, &obj, nil)
 	}
 	return err
 }
 
-// Read returns the attached file for the given url.
-func (d *Database) Read(user string, url *url.URL) ([]byte, error) {
+// Read returns a reader for the attached file for the given url and its digest, the caller has to close the reader.
+func (d *Database) Read(ctx context.Context, user string, url *url.URL) (io.ReadSeekCloser, string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, "", err
+	}
+	object, err := d.driver.GetObjectWithParents(url)
+	if err != nil {
+		return nil, "", err
+	}
+	if !object.PermissionsForData(user, d.groupsOf(ctx, user, url)...).Contain(fosp.PermissionRead) {
+		return nil, "", Forbidden
+	}
 	return d.driver.ReadAttachment(url)
 }
 
-// Write saves a file attachment at the givn url.
-func (d *Database) Write(user string, url *url.URL, data io.Reader) error {
+// Write saves a file attachment at the givn url if the preconditions are satisfied and returns the new entity tag.
+// The object stays locked while the data is received, the attachment only replaces the old one when all data was received.
+// Receiving the data stops and the attachment is discarded when ctx ends.
+func (d *Database) Write(ctx context.Context, user string, url *url.URL, pre Preconditions, data io.Reader) (string, error) {
+	defer d.locks.Lock(url)()
+	groups := d.groupsOf(ctx, user, url)
+	check := func(object *fosp.Object) error {
+		if !object.PermissionsForData(user, groups...).Contain(fosp.PermissionWrite) {
+			return Forbidden
+		}
+		return pre.checkWrite(object)
+	}
 	object, err := d.driver.GetObjectWithParents(url)
 	if err != nil {
-		return err
+		return "", err
+	}
+	if err := check(&object); err != nil {
+		return "", err
+	}
+	if data, err = d.limitAttachmentQuota(url, &object, 0, data); err != nil {
+		return "", err
+	}
+	staged, err := d.driver.StageAttachment(url, 0, &contextReader{ctx: ctx, reader: data})
+	if err != nil {
+		if staged != nil {
+			d.driver.DiscardAttachment(staged)
+		}
+		return "", err
+	}
+	return d.linkAttachment(ctx, url, staged, "", check)
+}
+
+// WriteAt writes data into the file attachment at the given url starting at offset.
+// If upload is not empty, the write continues the resumable upload with this identifier:
+// offset must then be the end of the data that was received for the upload, or 0 to start a new upload.
+// The new size of the attachment is returned, or on a conflicting offset the size the upload has to continue at.
+// Data that was received before an error is kept and counted in the size of the attachment.
+// The preconditions are checked like for Write, the new entity tag of the object is returned as well.
+// Receiving the data stops when ctx ends, what was received until then is kept so that the upload can be resumed.
+func (d *Database) WriteAt(ctx context.Context, user string, url *url.URL, offset int64, upload string, pre Preconditions, data io.Reader) (int64, string, error) {
+	defer d.locks.Lock(url)()
+	groups := d.groupsOf(ctx, user, url)
+	check := func(object *fosp.Object) error {
+		if !object.PermissionsForData(user, groups...).Contain(fosp.PermissionWrite) {
+			return Forbidden
+		}
+		return pre.checkWrite(object)
 	}
-	bytesWritten, err := d.driver.WriteAttachment(url, data)
+	object, err := d.driver.GetObjectWithParents(url)
+	if err != nil {
+		return -1, "", err
+	}
+	if err := check(&object); err != nil {
+		return -1, "", err
+	}
+	if upload != "" {
+		current := fosp.NewAttachment()
+		if object.Attachment != nil {
+			current = object.Attachment
+		}
+		if current.Upload != upload && offset != 0 {
+			return 0, "", UploadConflict
+		} else if current.Upload == upload && offset != int64(current.Size) {
+			return int64(current.Size), "", UploadConflict
+		}
+	}
+	if data, err = d.limitAttachmentQuota(url, &object, offset, data); err != nil {
+		return -1, "", err
+	}
+	staged, err := d.driver.StageAttachment(url, offset, &contextReader{ctx: ctx, reader: data})
+	if staged == nil {
+		return -1, "", err
+	}
+	etag, linkErr := d.linkAttachment(context.Background(), url, staged, upload, check)
+	if linkErr != nil {
+		return -1, "", linkErr
+	}
+	return staged.Size, etag, err
+}
+
+// linkAttachment makes the staged content the attachment of the object at url and returns the new entity tag.
+// The object is read again and checked with check in the same transaction that links the content and updates the
+// object, so that changes which happened while the data was received are not overwritten unchecked.
+// The staged content is discarded if the transaction fails.
+func (d *Database) linkAttachment(ctx context.Context, url *url.URL, staged *StagedAttachment, upload string, check func(*fosp.Object) error) (string, error) {
+	var etag string
+	err := d.transaction(ctx, func(store ObjectStore) error {
+		object, err := store.GetObjectWithParents(url)
+		if err != nil {
+			return err
+		}
+		if err := check(&object); err != nil {
+			return err
+		}
+		if err := d.checkAttachmentQuota(store, url, &object, staged.Size); err != nil {
+			return err
+		}
+		if object.Attachment == nil {
+			object.Attachment = fosp.NewAttachment()
+		}
+		object.Attachment.Size = uint(staged.Size)
+		object.Attachment.Digest = staged.Digest
+		object.Attachment.Upload = upload
+		object.Updated = time.Now().UTC()
+		if etag, err = fosp.ComputeETag(&object); err != nil {
+			return err
+		}
+		// The change and the usage are recorded first, as the owner has to be locked before the attachments.
+		if err := d.recordChange(store, fosp.UPDATED, url, etag); err != nil {
+			return err
+		}
+		if err := store.UpdateObject(url, &object); err != nil {
+			return err
+		}
+		return store.LinkAttachment(url, staged)
+	})
 	if err != nil {
+		d.driver.DiscardAttachment(staged)
+		return "", err
+	}
+	return etag, nil
+}
+
+// transaction runs fn in a transaction of the driver.
+// The transaction is rolled back instead of committed if ctx ended in the meantime.
+func (d *Database) transaction(ctx context.Context, fn func(ObjectStore) error) error {
+	if err := ctx.Err(); err != nil {
 		return err
 	}
-	if object.Attachment == nil {
-		object.Attachment = fosp.NewAttachment()
+	return d.driver.Transaction(func(store ObjectStore) error {
+		if err := fn(store); err != nil {
+			return err
+		}
+		return ctx.Err()
+	})
+}
+
+// stripUnreadable removes the fields of object that user, as a member of groups, may not read.
+// It fails with Forbidden if the user may read none of them.
+func stripUnreadable(object *fosp.Object, user string, groups []string) error {
+	missingPermissions := 0
+	if !object.PermissionsForData(user, groups...).Contain(fosp.PermissionRead) {
+		object.Data = nil
+		object.Type = nil
+		missingPermissions += 1
+	}
+	if !object.PermissionsForAcl(user, groups...).Contain(fosp.PermissionRead) {
+		object.Acl = nil
+		missingPermissions += 1
+	}
+	if !object.PermissionsForSubscriptions(user, groups...).Contain(fosp.PermissionRead) {
+		object.Subscriptions = nil
+		missingPermissions += 1
+	}
+	if missingPermissions == 3 {
+		return Forbidden
 	}
-	object.Attachment.Size = uint(bytesWritten)
-	object.Updated = time.Now().UTC()
-	d.driver.UpdateObject(url, &object)
 	return nil
 }
+
+// patchPermitted checks whether user, as a member of groups, may write every field that is changed by patch.
+func patchPermitted(user string, groups []string, obj *fosp.Object, patch fosp.PatchObject) bool {
+	for field := range patch {
+		var perms *fosp.PermissionSet
+		switch field {
+		case "data", "type", "attachment":
+			perms = obj.PermissionsForData(user, groups...)
+		case "acl":
+			perms = obj.PermissionsForAcl(user, groups...)
+		case "subscriptions":
+			perms = obj.PermissionsForSubscriptions(user, groups...)
+		default:
+			continue
+		}
+		if !perms.Contain(fosp.PermissionWrite) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,131 @@
+// Copyright (C) 2015 Felix Maurer
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"github.com/maufl/go-fosp/fosp"
+	"testing"
+)
+
+func newTestDatabase(t *testing.T) *Database {
+	db := NewServer(NewMemoryDriver(), "example.com").database
+	for _, user := range []string{"alice@example.com", "bob@example.com"} {
+		if !db.Register(user, "secret") {
+			t.Fatalf("Could not register user %s", user)
+		}
+	}
+	return db
+}
+
+func expectForbidden(t *testing.T, operation string, err error) {
+	if fe, ok := err.(FospError); !ok || fe.Code != fosp.StatusForbidden {
+		t.Errorf("Expected %s to be forbidden but got %v", operation, err)
+	}
+}
+
+func TestDatabaseEnforcesACL(t *testing.T) {
+	db := newTestDatabase(t)
+	root := mustParseURL(t, "fosp://alice@example.com/")
+	child := mustParseURL(t, "fosp://alice@example.com/notes")
+
+	if _, err := db.Create(context.Background(), "alice@example.com", child, fosp.NewObject()); err != nil {
+		t.Fatalf("Owner could not create object: %s", err)
+	}
+	if _, err := db.Write(context.Background(), "alice@example.com", child, Preconditions{}, bytes.NewBufferString("Hello")); err != nil {
+		t.Fatalf("Owner could not write attachment: %s", err)
+	}
+
+	_, err := db.Create(context.Background(), "bob@example.com", mustParseURL(t, "fosp://alice@example.com/bobs"), fosp.NewObject())
+	expectForbidden(t, "CREATE", err)
+	_, err = db.Patch(context.Background(), "bob@example.com", child, Preconditions{}, fosp.PatchObject{"data": "changed"})
+	expectForbidden(t, "PATCH", err)
+	_, err = db.List(context.Background(), "bob@example.com", root)
+	expectForbidden(t, "LIST", err)
+	_, _, err = db.Read(context.Background(), "bob@example.com", child)
+	expectForbidden(t, "READ", err)
+	_, err = db.Write(context.Background(), "bob@example.com", child, Preconditions{}, bytes.NewBufferString("Bye"))
+	expectForbidden(t, "WRITE", err)
+	err = db.Delete(context.Background(), "bob@example.com", child, Preconditions{})
+	expectForbidden(t, "DELETE", err)
+
+	grant := fosp.PatchObject{"acl": map[string]interface{}{"users": map[string]interface{}{
+		"bob@example.com": map[string]interface{}{"data": []interface{}{"read", "write"}},
+	}}}
+	if _, err := db.Patch(context.Background(), "alice@example.com", child, Preconditions{}, grant); err != nil {
+		t.Fatalf("Owner could not patch acl: %s", err)
+	}
+	if _, err := db.Patch(context.Background(), "bob@example.com", child, Preconditions{}, fosp.PatchObject{"data": "changed"}); err != nil {
+		t.Errorf("Granted user could not patch data: %s", err)
+	}
+	_, err = db.Patch(context.Background(), "bob@example.com", child, Preconditions{}, fosp.PatchObject{"acl": map[string]interface{}{}})
+	expectForbidden(t, "PATCH of acl", err)
+	if _, _, err := db.Read(context.Background(), "bob@example.com", child); err != nil {
+		t.Errorf("Granted user could not read attachment: %s", err)
+	}
+	err = db.Delete(context.Background(), "bob@example.com", child, Preconditions{})
+	expectForbidden(t, "DELETE", err)
+	if err := db.Delete(context.Background(), "alice@example.com", child, Preconditions{}); err != nil {
+		t.Errorf("Owner could not delete object: %s", err)
+	}
+}
+
+func TestDatabaseResolvesGroups(t *testing.T) {
+	db := newTestDatabase(t)
+	groups := mustParseURL(t, "fosp://alice@example.com/groups")
+	friends := mustParseURL(t, "fosp://alice@example.com/groups/friends")
+	shared := mustParseURL(t, "fosp://alice@example.com/shared")
+
+	if _, err := db.Create(context.Background(), "alice@example.com", groups, fosp.NewObject()); err != nil {
+		t.Fatalf("Could not create groups object: %s", err)
+	}
+	group := fosp.NewObject()
+	group.Data = map[string]interface{}{"members": []interface{}{"bob@example.com"}}
+	if _, err := db.Create(context.Background(), "alice@example.com", friends, group); err != nil {
+		t.Fatalf("Could not create group definition: %s", err)
+	}
+	if groups := db.groupsOf(context.Background(), "bob@example.com", shared); len(groups) != 1 || groups[0] != "friends" {
+		t.Errorf("Expected bob to be in group friends but groups are %v", groups)
+	}
+	if groups := db.groupsOf(context.Background(), "alice@example.com", shared); len(groups) != 0 {
+		t.Errorf("Expected alice to be in no group but groups are %v", groups)
+	}
+
+	obj := fosp.NewObject()
+	obj.Data = "shared"
+	obj.Acl = fosp.NewAccessControlList()
+	obj.Acl.Groups["friends"] = &fosp.AccessControlEntry{Data: fosp.NewPermissionSet(fosp.PermissionRead)}
+	if _, err := db.Create(context.Background(), "alice@example.com", shared, obj); err != nil {
+		t.Fatalf("Could not create shared object: %s", err)
+	}
+	if object, err := db.Get(context.Background(), "bob@example.com", shared); err != nil || object.Data != "shared" {
+		t.Errorf("Group member could not read shared data: %v, %v", object.Data, err)
+	}
+	_, err := db.Patch(context.Background(), "bob@example.com", shared, Preconditions{}, fosp.PatchObject{"data": "changed"})
+	expectForbidden(t, "PATCH by group member", err)
+
+	// The group definitions are read once per request, later checks of the request use the cached ones.
+	ctx := withGroupCache(context.Background())
+	db.groupsOf(ctx, "bob@example.com", shared)
+	db.driver.DeleteObjects(friends)
+	if groups := db.groupsOf(ctx, "bob@example.com", shared); len(groups) != 1 {
+		t.Errorf("Group definitions were read again within a request, groups are %v", groups)
+	}
+	if groups := db.groupsOf(context.Background(), "bob@example.com", shared); len(groups) != 0 {
+		t.Errorf("Expected bob to be in no group after the group was deleted but groups are %v", groups)
+	}
+}
@@ -35,3 +35,9 @@ func (e FospError) Error() string {
 
 var InternalServerError = NewFospError("Internal server error", fosp.StatusInternalServerError)
 var BadRequest = NewFospError("Invalid request", fosp.StatusBadRequest)
+var AttachmentTooLarge = NewFospError("Attachment too large", fosp.StatusRequestEntityTooLarge)
+var AttachmentChanged = NewFospError("Attachment was changed concurrently", fosp.StatusConflict)
+var UploadConflict = NewFospError("Upload does not continue at the end of the received data", fosp.StatusConflict)
+var QuotaExceeded = NewFospError("Storage quota exceeded", fosp.StatusRequestEntityTooLarge)
+var PreconditionFailed = NewFospError("Precondition failed", fosp.StatusPreconditionFailed)
+var Forbidden = NewFospError("Insufficent rights", fosp.StatusForbidden)
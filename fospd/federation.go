@@ -0,0 +1,129 @@
+// Copyright (C) 2015 Felix Maurer
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"github.com/maufl/go-fosp/fosp"
+	"io/ioutil"
+	"strings"
+)
+
+// ErrFederationDisabled is returned when a connection to another server is needed but no server key is configured.
+var ErrFederationDisabled = errors.New("federation is not configured")
+
+// ErrUntrustedServer is returned when there is no trusted key for a remote domain.
+var ErrUntrustedServer = errors.New("remote server is not trusted")
+
+func init() {
+	RegisterSaslMechanism(serverMechanism{})
+}
+
+// LoadServerKey reads an Ed25519 private key from a file that contains the base64 encoded seed of the key.
+func LoadServerKey(file string) (ed25519.PrivateKey, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	seed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(content)))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, errors.New("Invalid server key in " + file)
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// ParseTrustedServers decodes a mapping of domains to base64 encoded Ed25519 public keys.
+func ParseTrustedServers(encoded map[string]string) (map[string]ed25519.PublicKey, error) {
+	trusted := make(map[string]ed25519.PublicKey, len(encoded))
+	for domain, key := range encoded {
+		raw, err := base64.StdEncoding.DecodeString(key)
+		if err != nil || len(raw) != ed25519.PublicKeySize {
+			return nil, errors.New("Invalid public key for server " + domain)
+		}
+		trusted[domain] = ed25519.PublicKey(raw)
+	}
+	return trusted, nil
+}
+
+// EnableFederation configures the key this Server uses to prove its domain and the keys of the remote servers it trusts.
+// Requests and notifications are only exchanged with remote servers whose key is known.
+func (s *Server) EnableFederation(key ed25519.PrivateKey, trusted map[string]ed25519.PublicKey) {
+	s.serverKey = key
+	s.trustedServers = trusted
+}
+
+// trustedKey returns the public key of a remote domain, if the domain is trusted.
+func (s *Server) trustedKey(domain string) (ed25519.PublicKey, bool) {
+	if s.serverKey == nil || domain == s.Domain() {
+		return nil, false
+	}
+	key, ok := s.trustedServers[domain]
+	return key, ok
+}
+
+// serverMechanism implements the server side of fosp.ServerMechanism.
+type serverMechanism struct{}
+
+func (serverMechanism) Name() string {
+	return fosp.ServerMechanism
+}
+
+func (serverMechanism) NewSession(db *Database) SaslSession {
+	return &serverSession{server: db.server}
+}
+
+type serverSession struct {
+	server   *Server
+	exchange *fosp.ServerAuthentication
+}
+
+func (s *serverSession) Step(response *string) SaslResult {
+	if response == nil {
+		return SaslFailure(fosp.StatusBadRequest, "An initial response is required")
+	}
+	attributes, err := fosp.ParseScramMessage(*response)
+	if err != nil {
+		return SaslFailure(fosp.StatusBadRequest, "")
+	}
+	if s.exchange == nil {
+		if attributes["d"] == "" || attributes["r"] == "" {
+			return SaslFailure(fosp.StatusBadRequest, "")
+		}
+		if _, ok := s.server.trustedKey(attributes["d"]); !ok {
+			return SaslFailure(fosp.StatusUnauthorized, "Server "+attributes["d"]+" is not trusted")
+		}
+		serverNonce, err := randomString(18)
+		if err != nil {
+			return SaslFailure(fosp.StatusInternalServerError, "")
+		}
+		s.exchange = &fosp.ServerAuthentication{
+			ClientDomain: attributes["d"],
+			ServerDomain: s.server.Domain(),
+			ClientNonce:  attributes["r"],
+			ServerNonce:  serverNonce,
+		}
+		return SaslContinue("d=" + s.exchange.ServerDomain + ",r=" + serverNonce)
+	}
+	key, _ := s.server.trustedKey(s.exchange.ClientDomain)
+	if !s.exchange.VerifyClient(key, attributes["s"]) {
+		srvLog.Warning("Server %s failed to prove its identity", s.exchange.ClientDomain)
+		return SaslFailure(fosp.StatusUnauthorized, "")
+	}
+	additionalData := "s=" + s.exchange.SignServer(s.server.serverKey)
+	return SaslResult{Domain: s.exchange.ClientDomain, AdditionalData: &additionalData}
+}
@@ -0,0 +1,110 @@
+// Copyright (C) 2015 Felix Maurer
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"github.com/maufl/go-fosp/fosp"
+	"github.com/maufl/go-fosp/fosp/fospws"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func mustGenerateKey(t *testing.T) (ed25519.PublicKey, ed25519.PrivateKey) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Could not generate key: %s", err)
+	}
+	return public, private
+}
+
+func fromRequest(t *testing.T, user string) *fosp.Request {
+	req := fosp.NewRequest(fosp.GET, mustParseURL(t, "fosp://alice@example.com/"))
+	req.Header.Set("From", user)
+	return req
+}
+
+func TestServerAuthentication(t *testing.T) {
+	srv, connection, closer := dialTestServer(t)
+	defer closer()
+	srv.database.Register("alice@example.com", "secret")
+	localPublic, localPrivate := mustGenerateKey(t)
+	remotePublic, remotePrivate := mustGenerateKey(t)
+	_, otherPrivate := mustGenerateKey(t)
+	srv.EnableFederation(localPrivate, map[string]ed25519.PublicKey{"remote.net": remotePublic})
+
+	if resp, err := connection.SendRequest(fromRequest(t, "bob@remote.net")); err != nil || resp.Code != fosp.StatusForbidden {
+		t.Errorf("Unauthenticated connection could act on behalf of a remote user: %v, %v", resp, err)
+	}
+	if err := connection.AuthenticateServer("remote.net", "example.com", otherPrivate, localPublic); err == nil {
+		t.Errorf("Authentication with wrong server key succeeded")
+	}
+	if err := connection.AuthenticateServer("other.net", "example.com", remotePrivate, localPublic); err == nil {
+		t.Errorf("Authentication of untrusted domain succeeded")
+	}
+	if err := connection.AuthenticateServer("remote.net", "example.com", remotePrivate, remotePublic); err == nil {
+		t.Errorf("Accepted server signature made with the wrong key")
+	}
+	if err := connection.AuthenticateServer("remote.net", "example.com", remotePrivate, localPublic); err != nil {
+		t.Fatalf("Authentication with correct server key failed: %s", err)
+	}
+	if resp, err := connection.SendRequest(fromRequest(t, "alice@example.com")); err != nil || resp.Code != fosp.StatusForbidden {
+		t.Errorf("Remote server could act on behalf of a local user: %v, %v", resp, err)
+	}
+	grant := fosp.PatchObject{"acl": map[string]interface{}{"users": map[string]interface{}{
+		"bob@remote.net": map[string]interface{}{"data": []interface{}{"read"}},
+	}}}
+	if _, err := srv.database.Patch(context.Background(), "alice@example.com", mustParseURL(t, "fosp://alice@example.com/"), Preconditions{}, grant); err != nil {
+		t.Fatalf("Could not grant rights to remote user: %s", err)
+	}
+	if resp, err := connection.SendRequest(fromRequest(t, "bob@remote.net")); err != nil || resp.Code != fosp.StatusOK {
+		t.Errorf("Authenticated server could not act on behalf of its user: %v, %v", resp, err)
+	}
+}
+
+func TestFederatedRequest(t *testing.T) {
+	local, connection, closer := dialTestServer(t)
+	defer closer()
+	remote := NewServer(NewMemoryDriver(), "remote.net")
+	remoteHTTP := httptest.NewServer(http.HandlerFunc(remote.RequestHandler))
+	defer remoteHTTP.Close()
+
+	localPublic, localPrivate := mustGenerateKey(t)
+	remotePublic, remotePrivate := mustGenerateKey(t)
+	local.EnableFederation(localPrivate, map[string]ed25519.PublicKey{"remote.net": remotePublic})
+	remote.EnableFederation(remotePrivate, map[string]ed25519.PublicKey{"example.com": localPublic})
+	local.Resolver = fospws.StaticResolver{"remote.net": {"ws" + strings.TrimPrefix(remoteHTTP.URL, "http")}}
+
+	local.database.Register("alice@example.com", "secret")
+	remote.database.Register("bob@remote.net", "secret")
+	grant := fosp.PatchObject{"acl": map[string]interface{}{"users": map[string]interface{}{
+		"alice@example.com": map[string]interface{}{"data": []interface{}{"read"}},
+	}}}
+	if _, err := remote.database.Patch(context.Background(), "bob@remote.net", mustParseURL(t, "fosp://bob@remote.net/"), Preconditions{}, grant); err != nil {
+		t.Fatalf("Could not grant rights to remote user: %s", err)
+	}
+	if err := connection.AuthenticatePlain("alice@example.com", "secret"); err != nil {
+		t.Fatalf("Authentication failed: %s", err)
+	}
+	resp, err := connection.SendRequest(fosp.NewRequest(fosp.GET, mustParseURL(t, "fosp://bob@remote.net/")))
+	if err != nil || resp.Code != fosp.StatusOK {
+		t.Errorf("Forwarded request failed: %v, %v", resp, err)
+	}
+}
@@ -91,12 +91,93 @@ ALTER SEQUENCE data_parent_id_seq OWNED BY data.parent_id;
 
 CREATE TABLE users (
     name character varying(256),
-    password character varying(256)
+    password character varying(256),
+    scram_salt bytea,
+    scram_iterations integer,
+    scram_stored_key bytea,
+    scram_server_key bytea,
+    notification_seq bigint DEFAULT 0 NOT NULL,
+    change_seq bigint DEFAULT 0 NOT NULL,
+    object_count bigint,
+    attachment_bytes bigint
 );
 
 
 ALTER TABLE public.users OWNER TO fosp;
 
+--
+-- Name: tokens; Type: TABLE; Schema: public; Owner: fosp; Tablespace: 
+--
+
+CREATE TABLE tokens (
+    id character varying(64) NOT NULL,
+    name character varying(256) NOT NULL,
+    hash bytea NOT NULL,
+    label text,
+    created timestamp with time zone NOT NULL
+);
+
+
+ALTER TABLE public.tokens OWNER TO fosp;
+
+--
+-- Name: secrets; Type: TABLE; Schema: public; Owner: fosp; Tablespace: 
+--
+
+CREATE TABLE secrets (
+    name character varying(64) NOT NULL,
+    value bytea NOT NULL
+);
+
+
+ALTER TABLE public.secrets OWNER TO fosp;
+
+--
+-- Name: attachments; Type: TABLE; Schema: public; Owner: fosp; Tablespace: 
+--
+
+CREATE TABLE attachments (
+    uri text NOT NULL,
+    digest character varying(80) NOT NULL
+);
+
+
+ALTER TABLE public.attachments OWNER TO fosp;
+
+--
+-- Name: notifications; Type: TABLE; Schema: public; Owner: fosp; Tablespace: 
+--
+
+CREATE TABLE notifications (
+    name character varying(256) NOT NULL,
+    seq bigint NOT NULL,
+    event character varying(16) NOT NULL,
+    uri text NOT NULL,
+    etag character varying(80),
+    base_etag character varying(80),
+    object text,
+    created timestamp with time zone NOT NULL
+);
+
+
+ALTER TABLE public.notifications OWNER TO fosp;
+
+--
+-- Name: changes; Type: TABLE; Schema: public; Owner: fosp; Tablespace: 
+--
+
+CREATE TABLE changes (
+    name character varying(256) NOT NULL,
+    id bigint NOT NULL,
+    event character varying(16) NOT NULL,
+    uri text NOT NULL,
+    etag character varying(80),
+    created timestamp with time zone NOT NULL
+);
+
+
+ALTER TABLE public.changes OWNER TO fosp;
+
 --
 -- Name: id; Type: DEFAULT; Schema: public; Owner: fosp
 --
@@ -127,6 +208,60 @@ ALTER TABLE ONLY data
     ADD CONSTRAINT data_uri_key UNIQUE (uri);
 
 
+--
+-- Name: attachments_pkey; Type: CONSTRAINT; Schema: public; Owner: fosp; Tablespace: 
+--
+
+ALTER TABLE ONLY attachments
+    ADD CONSTRAINT attachments_pkey PRIMARY KEY (uri);
+
+
+--
+-- Name: attachments_digest_idx; Type: INDEX; Schema: public; Owner: fosp; Tablespace: 
+--
+
+CREATE INDEX attachments_digest_idx ON attachments USING btree (digest);
+
+
+--
+-- Name: tokens_pkey; Type: CONSTRAINT; Schema: public; Owner: fosp; Tablespace: 
+--
+
+ALTER TABLE ONLY tokens
+    ADD CONSTRAINT tokens_pkey PRIMARY KEY (id);
+
+
+--
+-- Name: secrets_pkey; Type: CONSTRAINT; Schema: public; Owner: fosp; Tablespace: 
+--
+
+ALTER TABLE ONLY secrets
+    ADD CONSTRAINT secrets_pkey PRIMARY KEY (name);
+
+
+--
+-- Name: notifications_pkey; Type: CONSTRAINT; Schema: public; Owner: fosp; Tablespace: 
+--
+
+ALTER TABLE ONLY notifications
+    ADD CONSTRAINT notifications_pkey PRIMARY KEY (name, seq);
+
+
+--
+-- Name: changes_pkey; Type: CONSTRAINT; Schema: public; Owner: fosp; Tablespace: 
+--
+
+ALTER TABLE ONLY changes
+    ADD CONSTRAINT changes_pkey PRIMARY KEY (name, id);
+
+
+--
+-- Name: changes_uri_idx; Type: INDEX; Schema: public; Owner: fosp; Tablespace: 
+--
+
+CREATE INDEX changes_uri_idx ON changes USING btree (name, uri);
+
+
 --
 -- Name: users_name_key; Type: CONSTRAINT; Schema: public; Owner: fosp; Tablespace: 
 --
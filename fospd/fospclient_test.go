@@ -0,0 +1,72 @@
+// Copyright (C) 2015 Felix Maurer
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"bytes"
+	"github.com/maufl/go-fosp/fosp"
+	"github.com/maufl/go-fosp/fosp/fospclient"
+	"testing"
+)
+
+func TestTypedClient(t *testing.T) {
+	_, connection, closer := dialTestServer(t)
+	defer closer()
+	client := fospclient.New(connection)
+	root := mustParseURL(t, "fosp://alice@example.com/")
+	child := mustParseURL(t, "fosp://alice@example.com/notes")
+
+	if err := client.Register("alice@example.com", "secret"); err != nil {
+		t.Fatalf("Register failed: %s", err)
+	}
+	if err := client.Authenticate("alice@example.com", "secret"); err != nil {
+		t.Fatalf("Authenticate failed: %s", err)
+	}
+	obj := fosp.NewObject()
+	obj.Data = "Hello"
+	created, err := client.Create(child, obj)
+	if err != nil {
+		t.Fatalf("Create failed: %s", err)
+	}
+	if created.Data != "Hello" || created.Owner != "alice@example.com" || created.ETag == "" {
+		t.Errorf("Expected the created object but got %v", created)
+	}
+	if names, err := client.List(root); err != nil || len(names) != 1 || names[0] != "notes" {
+		t.Errorf("Expected [notes] but got %v, %v", names, err)
+	}
+	if updated, err := client.Patch(child, fosp.PatchObject{"data": "World"}); err != nil || updated.Data != "World" || updated.ETag == created.ETag {
+		t.Errorf("Expected the patched object but got %v, %v", updated, err)
+	}
+	if got, err := client.Get(child); err != nil || got.Data != "World" {
+		t.Errorf("Expected patched data but got %v, %v", got, err)
+	}
+	if err := client.Write(child, bytes.NewBufferString("attached")); err != nil {
+		t.Errorf("Write failed: %s", err)
+	}
+	if data, err := client.Read(child); err != nil || string(data) != "attached" {
+		t.Errorf("Expected attachment but got %q, %v", data, err)
+	}
+	if err := client.Delete(child); err != nil {
+		t.Errorf("Delete failed: %s", err)
+	}
+	_, err = client.Get(child)
+	if !fospclient.IsNotFound(err) {
+		t.Errorf("Expected not found error but got %v", err)
+	}
+	if statusErr, ok := err.(*fospclient.StatusError); !ok || statusErr.Method != fosp.GET {
+		t.Errorf("Expected a StatusError for GET but got %#v", err)
+	}
+}
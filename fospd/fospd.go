@@ -16,26 +16,44 @@
 package main
 
 import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
 	"encoding/json"
 	"flag"
+	"fmt"
+	"github.com/maufl/go-fosp/fosp/fospws"
 	"github.com/op/go-logging"
 	"net/http"
 	"os"
 	"os/signal"
 	"runtime/pprof"
+	"time"
 )
 
 var lg = logging.MustGetLogger("go-fosp/fospd")
 
 type config struct {
-	Localdomain  string            `json:"localdomain"`
-	Listen       string            `json:"listen"`
-	ListenSecure string            `json:"listensecure"`
-	Database     string            `json:"database"`
-	BasePath     string            `json:"basepath"`
-	Logging      map[string]string `json:"logging"`
-	Key          string            `json:"keyfile"`
-	Certificate  string            `json:"certfile"`
+	Localdomain        string              `json:"localdomain"`
+	Listen             string              `json:"listen"`
+	ListenSecure       string              `json:"listensecure"`
+	Driver             string              `json:"driver"`
+	Database           string              `json:"database"`
+	BasePath           string              `json:"basepath"`
+	MaxMessageSize     int64               `json:"maxmessagesize"`
+	MaxAttachmentSize  int64               `json:"maxattachmentsize"`
+	GCInterval         string              `json:"gcinterval"`
+	Quota              Quota               `json:"quota"`
+	Quotas             map[string]Quota    `json:"quotas"`
+	NotificationLimit  int                 `json:"notificationlimit"`
+	NotificationMaxAge string              `json:"notificationmaxage"`
+	SaslMechanisms     []string            `json:"saslmechanisms"`
+	ServerKey          string              `json:"serverkey"`
+	TrustedServers     map[string]string   `json:"trustedservers"`
+	RemoteServers      map[string][]string `json:"remoteservers"`
+	Logging            map[string]string   `json:"logging"`
+	Key                string              `json:"keyfile"`
+	Certificate        string              `json:"certfile"`
 }
 
 func main() {
@@ -46,7 +64,18 @@ func main() {
 	logging.SetLevel(logging.DEBUG, "")
 	configFile := flag.String("c", "config.json", "A configuration file in json format")
 	cpuprofile := flag.String("cpuprofile", "", "Write cpu profile to file")
+	genkey := flag.Bool("genkey", false, "Generate a new server key for federation and exit")
+	gc := flag.Bool("gc", false, "Remove unreferenced attachments from the database and exit")
 	flag.Parse()
+	if *genkey {
+		public, private, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			lg.Fatalf("Failed to generate server key: %s", err)
+		}
+		fmt.Printf("Server key (store in the serverkey file): %s\n", base64.StdEncoding.EncodeToString(private.Seed()))
+		fmt.Printf("Public key (give to trusted servers): %s\n", base64.StdEncoding.EncodeToString(public))
+		return
+	}
 	file, err := os.Open(*configFile)
 	if err != nil {
 		lg.Fatalf("Config file not found: %s", *configFile)
@@ -87,8 +116,69 @@ func main() {
 	}
 	lg.Debug("Configuration %v+", conf)
 
-	driver := NewPostgresqlDriver(conf.Database, conf.BasePath)
+	var driver DatabaseDriver
+	switch conf.Driver {
+	case "", "postgresql":
+		driver = NewPostgresqlDriver(conf.Database, conf.BasePath)
+	case "memory":
+		lg.Warning("Using in-memory database driver, all data will be lost on shutdown")
+		driver = NewMemoryDriver()
+	case "bolt":
+		driver = NewBoltDriver(conf.Database)
+	default:
+		lg.Fatalf("Unknown database driver %s", conf.Driver)
+	}
 	server := NewServer(driver, conf.Localdomain)
+	if *gc {
+		report, err := server.database.CollectGarbage()
+		if err != nil {
+			lg.Fatalf("Garbage collection failed: %s", err)
+		}
+		fmt.Printf("Garbage collection %s\n", report)
+		return
+	}
+	if conf.GCInterval != "" {
+		interval, err := time.ParseDuration(conf.GCInterval)
+		if err != nil || interval <= 0 {
+			lg.Fatalf("Invalid garbage collection interval %s", conf.GCInterval)
+		}
+		server.database.StartGarbageCollection(interval)
+	}
+	server.MaxMessageSize = conf.MaxMessageSize
+	server.MaxAttachmentSize = conf.MaxAttachmentSize
+	server.Quota = conf.Quota
+	server.Quotas = conf.Quotas
+	if conf.NotificationLimit != 0 {
+		server.NotificationRetention.MaxCount = conf.NotificationLimit
+	}
+	if conf.NotificationMaxAge != "" {
+		maxAge, err := time.ParseDuration(conf.NotificationMaxAge)
+		if err != nil || maxAge < 0 {
+			lg.Fatalf("Invalid notification max age %s", conf.NotificationMaxAge)
+		}
+		server.NotificationRetention.MaxAge = maxAge
+	}
+	if len(conf.SaslMechanisms) > 0 {
+		if err := server.EnableSaslMechanisms(conf.SaslMechanisms); err != nil {
+			lg.Fatalf("Invalid SASL configuration: %s", err)
+		}
+	}
+	if len(conf.RemoteServers) > 0 {
+		server.Resolver = fospws.ChainResolver{fospws.StaticResolver(conf.RemoteServers), fospws.DefaultResolver}
+	}
+	if conf.ServerKey != "" {
+		key, err := LoadServerKey(conf.ServerKey)
+		if err != nil {
+			lg.Fatalf("Failed to load server key: %s", err)
+		}
+		trusted, err := ParseTrustedServers(conf.TrustedServers)
+		if err != nil {
+			lg.Fatalf("Invalid trusted servers: %s", err)
+		}
+		server.EnableFederation(key, trusted)
+	} else {
+		lg.Warning("No server key configured, federation with other servers is disabled")
+	}
 	http.HandleFunc("/", server.RequestHandler)
 	lg.Info("Serving domain %s", conf.Localdomain)
 	ch := make(chan bool)
@@ -0,0 +1,88 @@
+// Copyright (C) 2015 Felix Maurer
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"fmt"
+	"github.com/maufl/go-fosp/fosp"
+	"sync"
+	"time"
+)
+
+// GarbageCollector is implemented by database drivers that can reconcile the stored attachment content
+// with the objects referencing it. Content that is not referenced anymore is removed, e.g. when a
+// reference count was lost during a crash or an upload was never finished.
+type GarbageCollector interface {
+	CollectGarbage() (GarbageReport, error)
+}
+
+// GarbageReport describes what a garbage collection removed.
+type GarbageReport struct {
+	// Blobs is the number of removed attachment contents, including unfinished uploads.
+	Blobs int
+	// References is the number of removed attachment references of objects that do not exist anymore.
+	References int
+	// Missing is the number of referenced attachment contents that do not exist.
+	Missing int
+	// Bytes is the space that was reclaimed.
+	Bytes int64
+}
+
+func (r GarbageReport) String() string {
+	return fmt.Sprintf("removed %d blobs and %d dangling references, reclaimed %d bytes, %d referenced blobs are missing",
+		r.Blobs, r.References, r.Bytes, r.Missing)
+}
+
+// CollectGarbage runs the garbage collection of the database driver.
+func (d *Database) CollectGarbage() (GarbageReport, error) {
+	collector, ok := d.driver.(GarbageCollector)
+	if !ok {
+		return GarbageReport{}, NewFospError("Database driver does not support garbage collection", fosp.StatusNotImplemented)
+	}
+	report, err := collector.CollectGarbage()
+	if err != nil {
+		dbLog.Error("Garbage collection failed :: %s", err)
+		return report, err
+	}
+	if report.Missing > 0 {
+		dbLog.Error("Garbage collection found %d missing attachments", report.Missing)
+	}
+	dbLog.Info("Garbage collection %s", report)
+	return report, nil
+}
+
+// StartGarbageCollection runs CollectGarbage every interval until the returned function is called.
+func (d *Database) StartGarbageCollection(interval time.Duration) (stop func()) {
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				d.CollectGarbage()
+			case <-done:
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			ticker.Stop()
+			close(done)
+		})
+	}
+}
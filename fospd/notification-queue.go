@@ -0,0 +1,176 @@
+// Copyright (C) 2015 Felix Maurer
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"encoding/json"
+	"github.com/maufl/go-fosp/fosp"
+	"io/ioutil"
+	"net/url"
+	"path"
+	"strconv"
+	"time"
+)
+
+// notificationsPath is the path of the pseudo object in the root of every user through which the notification queue is read.
+// Every notification for a local user is queued with a sequence number, which is sent in the Sequence header.
+// The queued notifications are replayed after the user authenticates, until the user acknowledges them.
+//
+//	GET    alice@example.com/.notifications          returns the queued notifications, after the number in the Since header if present
+//	DELETE alice@example.com/.notifications/<seq>    acknowledges all notifications up to and including seq
+const notificationsPath = "/.notifications"
+
+// NotificationRetention limits the notification queue of every user.
+type NotificationRetention struct {
+	// MaxCount is the number of notifications that are kept, older ones are dropped. 0 means unlimited.
+	MaxCount int
+	// MaxAge is the time after which notifications are dropped. 0 means unlimited.
+	MaxAge time.Duration
+}
+
+// DefaultNotificationRetention is the retention of the notification queue used by new Servers.
+var DefaultNotificationRetention = NotificationRetention{MaxCount: 1000, MaxAge: 30 * 24 * time.Hour}
+
+// expired returns whether the record is dropped from a queue whose latest record has the sequence number last.
+func (r NotificationRetention) expired(record *fosp.NotificationRecord, last uint64) bool {
+	if r.MaxCount > 0 && record.Seq+uint64(r.MaxCount) <= last {
+		return true
+	}
+	return r.MaxAge > 0 && record.Time.Before(time.Now().Add(-r.MaxAge))
+}
+
+// queueNotification adds the notification to the queue of the local user and returns the queued record.
+func (d *Database) queueNotification(user string, notf *fosp.Notification) (*fosp.NotificationRecord, error) {
+	record := &fosp.NotificationRecord{
+		Event:    notf.Event,
+		URL:      notf.URL.String(),
+		ETag:     notf.Header.Get(fosp.ETagHeader),
+		BaseETag: notf.Header.Get(fosp.BaseETagHeader),
+		Time:     time.Now().UTC(),
+	}
+	if notf.Body != nil {
+		body, err := ioutil.ReadAll(notf.Body)
+		if err != nil {
+			return nil, err
+		}
+		if json.Valid(body) {
+			record.Object = body
+		}
+	}
+	if err := d.driver.QueueNotification(user, record, d.server.NotificationRetention); err != nil {
+		return record, err
+	}
+	return record, nil
+}
+
+// Notifications returns the queued notifications of the user after since that are not expired.
+func (d *Database) Notifications(user string, since uint64) ([]*fosp.NotificationRecord, error) {
+	records, err := d.driver.ListNotifications(user, since)
+	if err != nil {
+		return nil, err
+	}
+	retention := NotificationRetention{MaxAge: d.server.NotificationRetention.MaxAge}
+	current := make([]*fosp.NotificationRecord, 0, len(records))
+	for _, record := range records {
+		if !retention.expired(record, 0) {
+			current = append(current, record)
+		}
+	}
+	return current, nil
+}
+
+// deliverLocally queues a notification for a local user and sends it on all connections of the user.
+// When the notification can not be queued, it is still sent but without a sequence number.
+func (s *Server) deliverLocally(user string, notf *fosp.Notification) {
+	unlock := s.queueLocks.LockKey(user)
+	defer unlock()
+	record, err := s.database.queueNotification(user, notf)
+	if err != nil {
+		srvLog.Error("Could not queue notification for %s :: %s", user, err)
+		if record == nil {
+			return
+		}
+		record.Seq = 0
+	}
+	s.connectionsLock.RLock()
+	connections := append([]*ServerConnection{}, s.connections[user]...)
+	s.connectionsLock.RUnlock()
+	for _, connection := range connections {
+		// Every connection gets its own notification as sending consumes the body.
+		if queued, err := record.Notification(); err == nil {
+			connection.Send(queued)
+		}
+	}
+}
+
+// registerUser registers the connection of an authenticated user and replays the queued notifications of the user.
+// The queue of the user is locked meanwhile, so that new notifications are sent after the replayed ones.
+func (s *Server) registerUser(c *ServerConnection, user string) {
+	unlock := s.queueLocks.LockKey(user)
+	defer unlock()
+	s.registerConnection(c, user)
+	records, err := s.database.Notifications(user, 0)
+	if err != nil {
+		srvLog.Error("Could not read notification queue of %s :: %s", user, err)
+		return
+	}
+	for _, record := range records {
+		notf, err := record.Notification()
+		if err != nil {
+			srvLog.Warning("Dropping queued notification with invalid URL %s :: %s", record.URL, err)
+			continue
+		}
+		c.Send(notf)
+	}
+}
+
+// isNotificationsURL returns whether u points to the notifications pseudo object or one of its children.
+func isNotificationsURL(u *url.URL) bool {
+	return u != nil && (u.Path == notificationsPath || path.Dir(u.Path) == notificationsPath)
+}
+
+func (c *ServerConnection) handleNotifications(user string, req *fosp.Request) *fosp.Response {
+	if user == "" || rootOwner(req.URL) != user {
+		return fosp.NewResponse(fosp.FAILED, fosp.StatusForbidden)
+	}
+	db := c.server.database
+	switch {
+	case req.Method == fosp.GET && req.URL.Path == notificationsPath:
+		var since uint64
+		if header := req.Header.Get(fosp.SinceHeader); header != "" {
+			var err error
+			if since, err = strconv.ParseUint(header, 10, 64); err != nil {
+				return fosp.NewResponse(fosp.FAILED, fosp.StatusBadRequest)
+			}
+		}
+		records, err := db.Notifications(user, since)
+		if err != nil {
+			return failedResponse(err)
+		}
+		return jsonResponse(fosp.StatusOK, records)
+	case req.Method == fosp.DELETE && req.URL.Path != notificationsPath:
+		seq, err := strconv.ParseUint(path.Base(req.URL.Path), 10, 64)
+		if err != nil {
+			return fosp.NewResponse(fosp.FAILED, fosp.StatusNotFound)
+		}
+		if err := db.driver.AckNotifications(user, seq); err != nil {
+			return failedResponse(err)
+		}
+		return fosp.NewResponse(fosp.SUCCEEDED, fosp.StatusNoContent)
+	default:
+		return fosp.NewResponse(fosp.FAILED, fosp.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,150 @@
+// Copyright (C) 2015 Felix Maurer
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"context"
+	"github.com/maufl/go-fosp/fosp"
+	"github.com/maufl/go-fosp/fosp/fospclient"
+	"sort"
+	"testing"
+	"time"
+)
+
+// receiveSequences waits for count notifications and returns their sorted sequence numbers.
+func receiveSequences(t *testing.T, notifications <-chan *fosp.Notification, count int) []uint64 {
+	seqs := make([]uint64, 0, count)
+	for len(seqs) < count {
+		select {
+		case ntf := <-notifications:
+			seq, ok := ntf.Sequence()
+			if !ok {
+				t.Errorf("Notification %s has no sequence number", ntf)
+			}
+			seqs = append(seqs, seq)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Received only %d of %d notifications", len(seqs), count)
+		}
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	return seqs
+}
+
+// waitForQueue waits until the notification queue of the user holds count notifications, they are queued asynchronously.
+func waitForQueue(t *testing.T, db *Database, user string, count int) {
+	for deadline := time.Now().Add(2 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if records, err := db.Notifications(user, 0); err == nil && len(records) == count {
+			return
+		} else if time.Now().After(deadline) {
+			t.Fatalf("Queue of %s holds %d notifications instead of %d", user, len(records), count)
+		}
+	}
+}
+
+func TestNotificationQueue(t *testing.T) {
+	srv, connection, closer := dialTestServer(t)
+	defer closer()
+	notifications := make(notificationCollector, 10)
+	connection.RegisterMessageHandler(notifications)
+	client := fospclient.New(connection)
+	srv.NotificationRetention = NotificationRetention{MaxCount: 2}
+	db := srv.database
+	db.Register("alice@example.com", "secret")
+	db.Register("bob@example.com", "secret")
+
+	notes := mustParseURL(t, "fosp://alice@example.com/notes")
+	object := fosp.NewObject()
+	object.Subscriptions["alice@example.com"] = &fosp.SubscriptionEntry{Events: []string{fosp.UPDATED}}
+	if _, err := db.Create(context.Background(), "alice@example.com", notes, object); err != nil {
+		t.Fatalf("Creating %s failed: %s", notes, err)
+	}
+	// alice is offline, the notifications are queued.
+	db.Patch(context.Background(), "alice@example.com", notes, Preconditions{}, fosp.PatchObject{"data": "first"})
+	db.Patch(context.Background(), "alice@example.com", notes, Preconditions{}, fosp.PatchObject{"data": "second"})
+	waitForQueue(t, db, "alice@example.com", 2)
+
+	if err := client.Authenticate("alice@example.com", "secret"); err != nil {
+		t.Fatalf("Authenticate failed: %s", err)
+	}
+	if seqs := receiveSequences(t, notifications, 2); seqs[0] != 1 || seqs[1] != 2 {
+		t.Errorf("Replayed notifications have the sequence numbers %v", seqs)
+	}
+	db.Patch(context.Background(), "alice@example.com", notes, Preconditions{}, fosp.PatchObject{"data": "third"})
+	if seqs := receiveSequences(t, notifications, 1); seqs[0] != 3 {
+		t.Errorf("Live notification has the sequence number %v", seqs)
+	}
+
+	records, err := client.Notifications("alice@example.com", 1)
+	if err != nil || len(records) != 2 || records[0].Seq != 2 || records[1].Seq != 3 {
+		t.Fatalf("Notifications since 1 are %v, %v", records, err)
+	}
+	if records[1].Event != fosp.UPDATED || records[1].URL != notes.String() || len(records[1].Object) == 0 {
+		t.Errorf("Queued notification is %+v", records[1])
+	}
+	if err := client.Acknowledge("alice@example.com", 2); err != nil {
+		t.Errorf("Acknowledge failed: %s", err)
+	}
+	if records, err := client.Notifications("alice@example.com", 0); err != nil || len(records) != 1 || records[0].Seq != 3 {
+		t.Errorf("Notifications after acknowledging 2 are %v, %v", records, err)
+	}
+	if _, err := client.Notifications("bob@example.com", 0); !fospclient.IsForbidden(err) {
+		t.Errorf("Reading the notifications of another user returned %v", err)
+	}
+
+	// The queue keeps only two notifications, so the third one was already dropped.
+	db.Patch(context.Background(), "alice@example.com", notes, Preconditions{}, fosp.PatchObject{"data": "fourth"})
+	db.Patch(context.Background(), "alice@example.com", notes, Preconditions{}, fosp.PatchObject{"data": "fifth"})
+	receiveSequences(t, notifications, 2)
+	if records, err := client.Notifications("alice@example.com", 0); err != nil || len(records) != 2 || records[0].Seq != 4 {
+		t.Errorf("Notifications after dropping the oldest are %v, %v", records, err)
+	}
+}
+
+// waitForConnections waits until count connections are registered with the server for remote.
+func waitForConnections(t *testing.T, srv *Server, remote string, count int) {
+	for deadline := time.Now().Add(2 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		srv.connectionsLock.RLock()
+		registered := len(srv.connections[remote])
+		srv.connectionsLock.RUnlock()
+		if registered == count {
+			return
+		} else if time.Now().After(deadline) {
+			t.Fatalf("%d connections are registered for %s instead of %d", registered, remote, count)
+		}
+	}
+}
+
+func TestReauthenticationMovesRegistration(t *testing.T) {
+	srv, connection, closer := dialTestServer(t)
+	defer closer()
+	srv.database.Register("alice@example.com", "secret")
+	srv.database.Register("bob@example.com", "secret")
+	client := fospclient.New(connection)
+
+	if err := client.Authenticate("alice@example.com", "secret"); err != nil {
+		t.Fatalf("Authenticate failed: %s", err)
+	}
+	waitForConnections(t, srv, "alice@example.com", 1)
+	// The connection now belongs to bob, alice must not get notifications on it anymore.
+	if err := client.Authenticate("bob@example.com", "secret"); err != nil {
+		t.Fatalf("Authenticate failed: %s", err)
+	}
+	waitForConnections(t, srv, "bob@example.com", 1)
+	waitForConnections(t, srv, "alice@example.com", 0)
+
+	connection.Close()
+	waitForConnections(t, srv, "bob@example.com", 0)
+}
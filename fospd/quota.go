@@ -0,0 +1,186 @@
+// Copyright (C) 2015 Felix Maurer
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"encoding/json"
+	"github.com/maufl/go-fosp/fosp"
+	"io"
+	"net/url"
+)
+
+// quotaPath is the path of the pseudo object in the root of every user that reports the storage usage and limits.
+//
+//	GET alice@example.com/.quota    returns {"usage": {...}, "limit": {...}}
+const quotaPath = "/.quota"
+
+// Quota limits the storage of the objects under the root of a user, zero values mean unlimited.
+type Quota struct {
+	// AttachmentBytes is the maximum size of all attachments together.
+	AttachmentBytes int64 `json:"attachmentbytes,omitempty"`
+	// Objects is the maximum number of objects, including the root object.
+	Objects int64 `json:"objects,omitempty"`
+	// ObjectSize is the maximum size of a single object encoded as JSON.
+	ObjectSize int64 `json:"objectsize,omitempty"`
+}
+
+// Usage is the storage that is used by the objects under the root of a user.
+type Usage struct {
+	AttachmentBytes int64 `json:"attachmentbytes"`
+	Objects         int64 `json:"objects"`
+}
+
+// objectUsage returns the storage that is used by the object o.
+func objectUsage(o *fosp.Object) Usage {
+	usage := Usage{Objects: 1}
+	if o.Attachment != nil {
+		usage.AttachmentBytes = int64(o.Attachment.Size)
+	}
+	return usage
+}
+
+// storedUsage returns the storage that is used by the object that is encoded as JSON in content.
+func storedUsage(content []byte) (Usage, error) {
+	object := struct {
+		Attachment *fosp.Attachment `json:"attachment"`
+	}{}
+	if err := json.Unmarshal(content, &object); err != nil {
+		return Usage{}, err
+	}
+	return objectUsage(&fosp.Object{Attachment: object.Attachment}), nil
+}
+
+// plus returns the sum of u and other.
+func (u Usage) plus(other Usage) Usage {
+	return Usage{AttachmentBytes: u.AttachmentBytes + other.AttachmentBytes, Objects: u.Objects + other.Objects}
+}
+
+// minus returns the difference of u and other.
+func (u Usage) minus(other Usage) Usage {
+	return Usage{AttachmentBytes: u.AttachmentBytes - other.AttachmentBytes, Objects: u.Objects - other.Objects}
+}
+
+// quotaOf returns the quota of the root of user, which is either configured for the user or the default quota.
+func (s *Server) quotaOf(user string) Quota {
+	if quota, ok := s.Quotas[user]; ok {
+		return quota
+	}
+	return s.Quota
+}
+
+// Usage returns the storage used under the root of user and the quota that applies to it.
+func (d *Database) Usage(user string) (Usage, Quota, error) {
+	usage, err := usageOf(d.driver, user)
+	return usage, d.server.quotaOf(user), err
+}
+
+// usageOf returns the storage used under the root of user as it is seen by store.
+func usageOf(store ObjectStore, user string) (Usage, error) {
+	root, err := url.Parse("fosp://" + user + "/")
+	if err != nil {
+		return Usage{}, BadRequest
+	}
+	return store.Usage(root)
+}
+
+// checkObjectQuota fails with QuotaExceeded if the object at u is larger than the quota allows.
+// If the object is new, the quota for the number of objects is checked as well.
+func (d *Database) checkObjectQuota(store ObjectStore, u *url.URL, o *fosp.Object, isNew bool) error {
+	quota := d.server.quotaOf(rootOwner(u))
+	if quota.ObjectSize > 0 {
+		encoded, err := json.Marshal(o)
+		if err != nil {
+			return InternalServerError
+		}
+		if int64(len(encoded)) > quota.ObjectSize {
+			return QuotaExceeded
+		}
+	}
+	if isNew && quota.Objects > 0 {
+		usage, err := usageOf(store, rootOwner(u))
+		if err != nil {
+			return err
+		}
+		if usage.Objects >= quota.Objects {
+			return QuotaExceeded
+		}
+	}
+	return nil
+}
+
+// limitAttachmentQuota limits data so that the attachments under the root of the object at u stay within the quota
+// when data is written at offset into the attachment of object.
+func (d *Database) limitAttachmentQuota(u *url.URL, object *fosp.Object, offset int64, data io.Reader) (io.Reader, error) {
+	quota := d.server.quotaOf(rootOwner(u))
+	if quota.AttachmentBytes <= 0 {
+		return data, nil
+	}
+	usage, _, err := d.Usage(rootOwner(u))
+	if err != nil {
+		return nil, err
+	}
+	if object.Attachment != nil {
+		usage.AttachmentBytes -= int64(object.Attachment.Size)
+	}
+	remaining := quota.AttachmentBytes - usage.AttachmentBytes - offset
+	if remaining < 0 {
+		return nil, QuotaExceeded
+	}
+	return &maxSizeReader{reader: data, remaining: remaining, err: QuotaExceeded}, nil
+}
+
+// checkAttachmentQuota fails with QuotaExceeded if the attachments under the root of the object at u exceed the quota
+// when the attachment of object is replaced by one of the given size. limitAttachmentQuota checks the same while the
+// data is received, this check catches attachments that were written concurrently under the same root.
+func (d *Database) checkAttachmentQuota(store ObjectStore, u *url.URL, object *fosp.Object, size int64) error {
+	quota := d.server.quotaOf(rootOwner(u))
+	if quota.AttachmentBytes <= 0 {
+		return nil
+	}
+	usage, err := usageOf(store, rootOwner(u))
+	if err != nil {
+		return err
+	}
+	if object.Attachment != nil {
+		usage.AttachmentBytes -= int64(object.Attachment.Size)
+	}
+	if usage.AttachmentBytes+size > quota.AttachmentBytes {
+		return QuotaExceeded
+	}
+	return nil
+}
+
+// isQuotaURL returns whether u points to the quota pseudo object.
+func isQuotaURL(u *url.URL) bool {
+	return u != nil && u.Path == quotaPath
+}
+
+func (c *ServerConnection) handleQuota(user string, req *fosp.Request) *fosp.Response {
+	if user == "" || rootOwner(req.URL) != user {
+		return fosp.NewResponse(fosp.FAILED, fosp.StatusForbidden)
+	}
+	if req.Method != fosp.GET {
+		return fosp.NewResponse(fosp.FAILED, fosp.StatusMethodNotAllowed)
+	}
+	usage, quota, err := c.server.database.Usage(user)
+	if err != nil {
+		return failedResponse(err)
+	}
+	return jsonResponse(fosp.StatusOK, struct {
+		Usage Usage `json:"usage"`
+		Limit Quota `json:"limit"`
+	}{usage, quota})
+}
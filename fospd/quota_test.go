@@ -0,0 +1,105 @@
+// Copyright (C) 2015 Felix Maurer
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/maufl/go-fosp/fosp"
+	"github.com/maufl/go-fosp/fosp/fospclient"
+	"strings"
+	"testing"
+)
+
+func expectQuotaExceeded(t *testing.T, operation string, err error) {
+	if fe, ok := err.(FospError); !ok || fe.Code != fosp.StatusRequestEntityTooLarge {
+		t.Errorf("Expected %s to exceed the quota but got %v", operation, err)
+	}
+}
+
+func TestDatabaseEnforcesQuota(t *testing.T) {
+	db := newTestDatabase(t)
+	db.server.Quota = Quota{AttachmentBytes: 10, Objects: 3, ObjectSize: 300}
+	db.server.Quotas = map[string]Quota{"bob@example.com": {}}
+	first := mustParseURL(t, "fosp://alice@example.com/first")
+	second := mustParseURL(t, "fosp://alice@example.com/second")
+
+	for _, u := range []string{"fosp://alice@example.com/first", "fosp://alice@example.com/second"} {
+		if _, err := db.Create(context.Background(), "alice@example.com", mustParseURL(t, u), fosp.NewObject()); err != nil {
+			t.Fatalf("Creating %s failed: %s", u, err)
+		}
+	}
+	_, err := db.Create(context.Background(), "alice@example.com", mustParseURL(t, "fosp://alice@example.com/third"), fosp.NewObject())
+	expectQuotaExceeded(t, "CREATE", err)
+	if _, err := db.Create(context.Background(), "bob@example.com", mustParseURL(t, "fosp://bob@example.com/third"), fosp.NewObject()); err != nil {
+		t.Errorf("Quota override of bob was not applied: %s", err)
+	}
+
+	_, err = db.Patch(context.Background(), "alice@example.com", first, Preconditions{}, fosp.PatchObject{"data": strings.Repeat("x", 300)})
+	expectQuotaExceeded(t, "PATCH", err)
+
+	if _, err := db.Write(context.Background(), "alice@example.com", first, Preconditions{}, bytes.NewBufferString("12345678")); err != nil {
+		t.Fatalf("Writing within the quota failed: %s", err)
+	}
+	// Replacing an attachment only counts the new size.
+	if _, err := db.Write(context.Background(), "alice@example.com", first, Preconditions{}, bytes.NewBufferString("1234567890")); err != nil {
+		t.Errorf("Replacing an attachment within the quota failed: %s", err)
+	}
+	_, err = db.Write(context.Background(), "alice@example.com", second, Preconditions{}, bytes.NewBufferString("1"))
+	expectQuotaExceeded(t, "WRITE", err)
+	_, _, err = db.WriteAt(context.Background(), "alice@example.com", first, 10, "", Preconditions{}, bytes.NewBufferString("1"))
+	expectQuotaExceeded(t, "WRITE at offset", err)
+
+	usage, quota, err := db.Usage("alice@example.com")
+	if err != nil || usage.Objects != 3 || usage.AttachmentBytes != 10 || quota.Objects != 3 {
+		t.Errorf("Unexpected usage %+v and quota %+v, %v", usage, quota, err)
+	}
+}
+
+func TestQuotaPseudoObject(t *testing.T) {
+	srv, connection, closer := dialTestServer(t)
+	defer closer()
+	srv.Quota = Quota{AttachmentBytes: 1024}
+	srv.database.Register("alice@example.com", "secret")
+	srv.database.Register("bob@example.com", "secret")
+	client := fospclient.New(connection)
+	if err := client.Authenticate("alice@example.com", "secret"); err != nil {
+		t.Fatalf("Authentication failed: %s", err)
+	}
+	notes := mustParseURL(t, "fosp://alice@example.com/notes")
+	client.Create(notes, fosp.NewObject())
+	client.Write(notes, bytes.NewBufferString("Hello"))
+
+	resp, err := connection.SendRequest(fosp.NewRequest(fosp.GET, mustParseURL(t, "fosp://alice@example.com/.quota")))
+	if err != nil || resp.Status != fosp.SUCCEEDED {
+		t.Fatalf("Reading the quota failed: %v, %v", resp, err)
+	}
+	result := struct {
+		Usage Usage `json:"usage"`
+		Limit Quota `json:"limit"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatalf("Could not decode quota: %s", err)
+	}
+	if result.Usage.Objects != 2 || result.Usage.AttachmentBytes != 5 || result.Limit.AttachmentBytes != 1024 {
+		t.Errorf("Unexpected quota %+v", result)
+	}
+	resp, err = connection.SendRequest(fosp.NewRequest(fosp.GET, mustParseURL(t, "fosp://bob@example.com/.quota")))
+	if err != nil || resp.Code != fosp.StatusForbidden {
+		t.Errorf("Expected quota of other user to be forbidden but got %v, %v", resp, err)
+	}
+}
@@ -0,0 +1,139 @@
+// Copyright (C) 2015 Felix Maurer
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"bytes"
+	"github.com/maufl/go-fosp/fosp"
+	"github.com/maufl/go-fosp/fosp/fospclient"
+	"math/rand"
+	"testing"
+)
+
+func TestRangedReads(t *testing.T) {
+	srv, connection, closer := dialTestServer(t)
+	defer closer()
+	srv.database.Register("alice@example.com", "secret")
+	client := fospclient.New(connection)
+	if err := client.Authenticate("alice@example.com", "secret"); err != nil {
+		t.Fatalf("Authentication failed: %s", err)
+	}
+	file := mustParseURL(t, "fosp://alice@example.com/file")
+	client.Create(file, fosp.NewObject())
+	content := []byte("0123456789")
+	if err := client.Write(file, bytes.NewReader(content)); err != nil {
+		t.Fatalf("Write failed: %s", err)
+	}
+	if data, err := client.ReadRange(file, 2, 3); err != nil || string(data) != "234" {
+		t.Errorf("Expected 234 but read %q, %v", data, err)
+	}
+	if data, err := client.ReadRange(file, 7, -1); err != nil || string(data) != "789" {
+		t.Errorf("Expected 789 but read %q, %v", data, err)
+	}
+	if data, err := client.ReadRange(file, 8, 100); err != nil || string(data) != "89" {
+		t.Errorf("Expected range to be cut at the end but read %q, %v", data, err)
+	}
+	_, err := client.ReadRange(file, 10, 1)
+	if fospclient.StatusCode(err) != fosp.StatusRangeNotSatisfiable {
+		t.Fatalf("Expected range behind the end to fail but got %v", err)
+	}
+	if contentRange := err.(*fospclient.StatusError).Header.Get(fosp.ContentRangeHeader); contentRange != "bytes */10" {
+		t.Errorf("Expected size in Content-Range but got %q", contentRange)
+	}
+}
+
+func TestParseRange(t *testing.T) {
+	tests := []struct {
+		value       string
+		first, last int64
+		valid       bool
+	}{
+		{"bytes=0-4", 0, 4, true},
+		{"bytes=5-", 5, 9, true},
+		{"bytes=-3", 7, 9, true},
+		{"bytes=-30", 0, 9, true},
+		{"bytes=4-2", 0, 0, false},
+		{"bytes=10-", 0, 0, false},
+		{"bytes=-", 0, 0, false},
+		{"lines=0-4", 0, 0, false},
+	}
+	for _, test := range tests {
+		first, last, err := fosp.ParseRange(test.value, 10)
+		if (err == nil) != test.valid || first != test.first || last != test.last {
+			t.Errorf("ParseRange(%q) = %d, %d, %v", test.value, first, last, err)
+		}
+	}
+}
+
+func TestResumableUpload(t *testing.T) {
+	srv, connection, closer := dialTestServer(t)
+	defer closer()
+	srv.MaxAttachmentSize = 1 << 20
+	srv.database.Register("alice@example.com", "secret")
+	client := fospclient.New(connection)
+	if err := client.Authenticate("alice@example.com", "secret"); err != nil {
+		t.Fatalf("Authentication failed: %s", err)
+	}
+	file := mustParseURL(t, "fosp://alice@example.com/large")
+	client.Create(file, fosp.NewObject())
+	content := make([]byte, 3*32*1024+17)
+	rand.Read(content)
+
+	upload, err := fospclient.NewUpload(file)
+	if err != nil {
+		t.Fatalf("NewUpload failed: %s", err)
+	}
+	// The first attempt only gets half of the data to the server.
+	half := int64(len(content) / 2)
+	if err := client.Upload(upload, bytes.NewReader(content[:half])); err != nil || upload.Offset != half {
+		t.Fatalf("Partial upload failed: %v, offset %d", err, upload.Offset)
+	}
+	if obj, err := client.Get(file); err != nil || obj.Attachment.Size != uint(half) || obj.Attachment.Upload != upload.ID {
+		t.Errorf("Partial upload was not recorded: %v, %v", obj, err)
+	}
+
+	// The client lost track of the progress, the server tells it where to continue.
+	upload.Offset = 0
+	if err := client.Upload(upload, bytes.NewReader(content)); err != nil || upload.Offset != int64(len(content)) {
+		t.Fatalf("Resumed upload failed: %v, offset %d", err, upload.Offset)
+	}
+	if data, err := client.Read(file); err != nil || !bytes.Equal(data, content) {
+		t.Errorf("Resumed upload produced %d bytes (%v) instead of %d", len(data), err, len(content))
+	}
+
+	// A different upload can not continue in the middle of the attachment, it has to start from the beginning.
+	other, _ := fospclient.NewUpload(file)
+	other.Offset = 10
+	if err := client.Upload(other, bytes.NewReader(content)); err != nil || other.Offset != int64(len(content)) {
+		t.Errorf("Expected foreign upload to restart: %v, offset %d", err, other.Offset)
+	}
+
+	// Plain offset writes truncate the attachment behind the written data.
+	if size, err := client.WriteAt(file, 4, bytes.NewReader([]byte("tail"))); err != nil || size != 8 {
+		t.Errorf("WriteAt returned %d, %v", size, err)
+	}
+	if size, err := client.WriteAt(file, 100, bytes.NewReader([]byte("gap"))); fospclient.StatusCode(err) != fosp.StatusRangeNotSatisfiable {
+		t.Errorf("Expected write behind the end to fail but got %d, %v", size, err)
+	}
+	obj, err := client.Get(file)
+	data, readErr := client.Read(file)
+	if err != nil || readErr != nil || obj.Attachment.Size != uint(len(data)) || obj.Attachment.Upload != "" {
+		t.Errorf("Size %v does not match %d stored bytes: %v, %v", obj.Attachment, len(data), err, readErr)
+	}
+	if !bytes.Equal(data, append(append([]byte{}, content[:4]...), "tail"...)) {
+		t.Errorf("Unexpected content after offset write: %q", data)
+	}
+}
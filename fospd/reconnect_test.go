@@ -0,0 +1,94 @@
+// Copyright (C) 2015 Felix Maurer
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"github.com/maufl/go-fosp/fosp"
+	"github.com/maufl/go-fosp/fosp/fospws"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func expectState(t *testing.T, events <-chan fospws.StateEvent, state fospws.ConnectionState) {
+	for {
+		select {
+		case event := <-events:
+			if event.State == state {
+				return
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Client did not reach state %s", state)
+		}
+	}
+}
+
+func TestClientReconnects(t *testing.T) {
+	srv := NewServer(NewMemoryDriver(), "example.com")
+	srv.database.Register("alice@example.com", "secret")
+	var (
+		conns     []net.Conn
+		connsLock sync.Mutex
+	)
+	httpServer := httptest.NewUnstartedServer(http.HandlerFunc(srv.RequestHandler))
+	httpServer.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateHijacked {
+			connsLock.Lock()
+			conns = append(conns, conn)
+			connsLock.Unlock()
+		}
+	}
+	httpServer.Start()
+	defer httpServer.Close()
+
+	client := fospws.NewClient("example.com")
+	client.SetResolver(fospws.StaticResolver{"example.com": {"ws" + strings.TrimPrefix(httpServer.URL, "http")}})
+	client.MinBackoff = 10 * time.Millisecond
+	client.SetAuthenticator(func(c *fospws.Connection) error {
+		return c.AuthenticateScram("alice@example.com", "secret")
+	})
+	events := client.Subscribe()
+	if err := client.Connect(); err != nil {
+		t.Fatalf("Could not connect: %s", err)
+	}
+	defer client.Close()
+	expectState(t, events, fospws.Connected)
+
+	get := fosp.NewRequest(fosp.GET, mustParseURL(t, "fosp://alice@example.com/"))
+	if resp, err := client.SendRequest(get); err != nil || resp.Code != fosp.StatusOK {
+		t.Fatalf("Request failed: %v, %v", resp, err)
+	}
+
+	connsLock.Lock()
+	for _, conn := range conns {
+		conn.Close()
+	}
+	connsLock.Unlock()
+	expectState(t, events, fospws.Disconnected)
+	expectState(t, events, fospws.Connected)
+	if resp, err := client.SendRequest(get); err != nil || resp.Code != fosp.StatusOK {
+		t.Errorf("Request after reconnect failed, authentication was not replayed: %v, %v", resp, err)
+	}
+
+	client.Close()
+	if _, err := client.SendRequest(get); err != fospws.ErrClientClosed {
+		t.Errorf("Expected ErrClientClosed but got %v", err)
+	}
+}
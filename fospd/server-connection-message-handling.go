@@ -16,28 +16,57 @@
 package main
 
 import (
+	"context"
 	"github.com/maufl/go-fosp/fosp"
 	"github.com/maufl/go-fosp/fosp/fospws"
+	"io"
 )
 
 func (c *ServerConnection) HandleMessage(inMsg *fospws.NumberedMessage) {
 	msg := inMsg.Message
 	if req, ok := msg.(*fosp.Request); ok {
-		resp := c.handleRequest(req)
+		ctx, cancel := c.requestContext(req)
+		resp := c.handleRequest(ctx, req)
+		cancel()
+		// Discard the rest of a streamed body that the handler did not read.
+		if closer, ok := req.Body.(io.Closer); ok {
+			closer.Close()
+		}
 		if req.Method == fosp.READ {
 			c.SendNumberedMessage(&fospws.NumberedMessage{Message: resp, Seq: inMsg.Seq, BinaryBody: true})
 		} else {
 			c.Send(resp, inMsg.Seq)
 		}
+		// Queued notifications are replayed after the response, so that the client knows it is authenticated.
+		if req.Method == fosp.AUTH && resp.Status == fosp.SUCCEEDED && resp.Code == fosp.StatusOK && c.User != "" {
+			c.registerAs(c.User)
+		}
 	}
 	if ntf, ok := msg.(*fosp.Notification); ok {
 		c.handleNotification(ntf)
 	}
 }
 
+// requestContext derives the context of a request from the context of the connection.
+// If the sender announced a timeout, the context expires with it. Group definitions are cached for the request.
+func (c *ServerConnection) requestContext(req *fosp.Request) (context.Context, context.CancelFunc) {
+	ctx := withGroupCache(c.ctx)
+	if timeout, ok := req.Timeout(); ok {
+		return context.WithTimeout(ctx, timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// handleNotification delivers a notification that a remote server sent for one of our users.
+// Notifications are only accepted from authenticated servers, for local users and about resources of the sending server.
 func (c *ServerConnection) handleNotification(ntf *fosp.Notification) {
-	// TODO This is not correct yet, user has to be local!
-	if user := ntf.Header.Get("To"); user != "" {
-		c.server.routeNotification(user, ntf)
+	user := ntf.Header.Get("To")
+	if user == "" {
+		return
+	}
+	if c.RemoteDomain == "" || ntf.URL == nil || ntf.URL.Host != c.RemoteDomain || userDomain(user) != c.server.Domain() {
+		servConnLog.Warning("Dropping notification for %s on connection of server %q", user, c.RemoteDomain)
+		return
 	}
+	c.server.routeNotification(user, ntf)
 }
@@ -17,27 +17,37 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"github.com/maufl/go-fosp/fosp"
+	"github.com/maufl/go-fosp/fosp/fospws"
+	"io"
+	"strconv"
 	"time"
 )
 
-// BUG: Seems like we are forwarding requests for other servers ...
-func (c *ServerConnection) handleRequest(req *fosp.Request) *fosp.Response {
+// handleRequest processes a request and returns the response.
+// The context is cancelled when the connection closes or the deadline announced by the sender passes.
+func (c *ServerConnection) handleRequest(ctx context.Context, req *fosp.Request) *fosp.Response {
 	servConnLog.Debug("Handeling request %#v", req)
 	servConnLog.Debug("URL is %s", req.URL)
 	if req.URL != nil && req.URL.Host != c.server.Domain() {
 		if c.User != "" {
 			servConnLog.Info("Try to forward request for user " + c.User)
-			if resp, err := c.server.forwardRequest(c.User, req); err == nil {
+			resp, err := c.server.forwardRequest(ctx, c.User, req)
+			if err == nil {
 				servConnLog.Debug("Response is %v+", resp)
 				return resp
 			}
+			if err == context.DeadlineExceeded {
+				return fosp.NewResponse(fosp.FAILED, fosp.StatusGatewayTimeout)
+			}
 			return fosp.NewResponse(fosp.FAILED, fosp.StatusBadGateway)
 		}
-		servConnLog.Fatal("Cannot forward request for non user")
+		servConnLog.Warning("Refusing to forward request for %s without authenticated user", req.URL)
+		return fosp.NewResponse(fosp.FAILED, fosp.StatusForbidden)
 	}
-	if req.URL == nil && req.Method != fosp.AUTH {
+	if req.URL == nil && req.Method != fosp.AUTH && req.Method != fosp.OPTIONS {
 		return fosp.NewResponse(fosp.FAILED, fosp.StatusBadRequest)
 	}
 
@@ -45,30 +55,53 @@ func (c *ServerConnection) handleRequest(req *fosp.Request) *fosp.Response {
 	if c.User != "" {
 		user = c.User
 	} else if reqUser := req.Header.Get("From"); reqUser != "" {
+		// Only an authenticated server may act on behalf of its own users.
+		if c.RemoteDomain == "" || userDomain(reqUser) != c.RemoteDomain {
+			servConnLog.Warning("Rejecting request from %s on connection of server %q", reqUser, c.RemoteDomain)
+			return fosp.NewResponse(fosp.FAILED, fosp.StatusForbidden)
+		}
 		user = reqUser
 	}
 
-	if user == "" && req.Method == fosp.CREATE && req.URL.Path == "/" {
+	if isTokensURL(req.URL) {
+		return c.handleTokens(c.User, req)
+	}
+	if isQuotaURL(req.URL) {
+		return c.handleQuota(c.User, req)
+	}
+	if isNotificationsURL(req.URL) {
+		return c.handleNotifications(c.User, req)
+	}
+
+	if user == "" && c.RemoteDomain == "" && req.Method == fosp.CREATE && req.URL.Path == "/" {
 		return c.handleRegister(req)
 	}
 
 	switch req.Method {
+	case fosp.OPTIONS:
+		return c.handleOptions(req)
 	case fosp.AUTH:
 		return c.handleAuth(req)
 	case fosp.GET:
-		return c.handleGet(user, req)
+		return c.handleGet(ctx, user, req)
 	case fosp.CREATE:
-		return c.handleCreate(user, req)
+		return c.handleCreate(ctx, user, req)
 	case fosp.PATCH:
-		return c.handlePatch(user, req)
+		return c.handlePatch(ctx, user, req)
 	case fosp.LIST:
-		return c.handleList(user, req)
+		return c.handleList(ctx, user, req)
 	case fosp.DELETE:
-		return c.handleDelete(user, req)
+		return c.handleDelete(ctx, user, req)
 	case fosp.READ:
-		return c.handleRead(user, req)
+		return c.handleRead(ctx, user, req)
 	case fosp.WRITE:
-		return c.handleWrite(user, req)
+		return c.handleWrite(ctx, user, req)
+	case fosp.SUBSCRIBE:
+		return c.handleSubscribe(ctx, req)
+	case fosp.UNSUBSCRIBE:
+		return c.handleUnsubscribe(req)
+	case fosp.CHANGES:
+		return c.handleChanges(ctx, user, req)
 	default:
 		return fosp.NewResponse(fosp.FAILED, fosp.StatusBadRequest)
 	}
@@ -102,70 +135,85 @@ func (c *ServerConnection) handleRegister(req *fosp.Request) *fosp.Response {
 	return fosp.NewResponse(fosp.SUCCEEDED, fosp.StatusCreated)
 }
 
-func (c *ServerConnection) handleGet(user string, req *fosp.Request) *fosp.Response {
-	defer timeTrack(time.Now(), "select request")
-	object, err := c.server.database.Get(user, req.URL)
+func (c *ServerConnection) handleOptions(req *fosp.Request) *fosp.Response {
+	body, err := json.Marshal(c.server.Capabilities())
 	if err != nil {
-		if fe, ok := err.(FospError); ok {
-			return fosp.NewResponse(fosp.FAILED, fe.Code)
-		}
 		return fosp.NewResponse(fosp.FAILED, fosp.StatusInternalServerError)
 	}
+	resp := fosp.NewResponse(fosp.SUCCEEDED, fosp.StatusOK)
+	resp.Body = bytes.NewBuffer(body)
+	return resp
+}
+
+func (c *ServerConnection) handleGet(ctx context.Context, user string, req *fosp.Request) *fosp.Response {
+	defer timeTrack(time.Now(), "select request")
+	object, err := c.server.database.Get(ctx, user, req.URL)
+	if err != nil {
+		return failedResponse(err)
+	}
+	if ifNoneMatch := req.Header.Get(fosp.IfNoneMatchHeader); ifNoneMatch != "" && fosp.MatchETag(ifNoneMatch, object.ETag) {
+		resp := fosp.NewResponse(fosp.SUCCEEDED, fosp.StatusNotModified)
+		resp.Header.Set(fosp.ETagHeader, object.ETag)
+		return resp
+	}
 	body, err := json.Marshal(object)
 	if err != nil {
 		return fosp.NewResponse(fosp.FAILED, fosp.StatusInternalServerError)
 	}
 	resp := fosp.NewResponse(fosp.SUCCEEDED, fosp.StatusOK)
+	resp.Header.Set(fosp.ETagHeader, object.ETag)
 	resp.Body = bytes.NewBuffer(body)
 	return resp
 }
 
-func (c *ServerConnection) handleCreate(user string, req *fosp.Request) *fosp.Response {
+func (c *ServerConnection) handleCreate(ctx context.Context, user string, req *fosp.Request) *fosp.Response {
 	defer timeTrack(time.Now(), "create request")
 	obj := fosp.NewObject()
 	if err := json.NewDecoder(req.Body).Decode(obj); err != nil {
 		servConnLog.Warning("Unable to decode CREATE body :: %s", err)
 		return fosp.NewResponse(fosp.FAILED, fosp.StatusBadRequest)
 	}
-	object, err := c.server.database.Create(user, req.URL, obj)
+	object, err := c.server.database.Create(ctx, user, req.URL, obj)
 	if err != nil {
-		return fosp.NewResponse(fosp.FAILED, fosp.StatusInternalServerError)
+		return failedResponse(err)
 	}
 	body, err := json.Marshal(object)
 	if err != nil {
 		return fosp.NewResponse(fosp.FAILED, fosp.StatusInternalServerError)
 	}
 	resp := fosp.NewResponse(fosp.SUCCEEDED, fosp.StatusCreated)
+	resp.Header.Set(fosp.ETagHeader, object.ETag)
 	resp.Body = bytes.NewBuffer(body)
 	return resp
 }
 
-func (c *ServerConnection) handlePatch(user string, req *fosp.Request) *fosp.Response {
+func (c *ServerConnection) handlePatch(ctx context.Context, user string, req *fosp.Request) *fosp.Response {
 	defer timeTrack(time.Now(), "update request")
 	var obj fosp.PatchObject
 	if err := json.NewDecoder(req.Body).Decode(&obj); err != nil {
 		servConnLog.Warning("Unable to decode PATCH body :: %s", err)
 		return fosp.NewResponse(fosp.FAILED, fosp.StatusBadRequest)
 	}
-	object, err := c.server.database.Patch(user, req.URL, obj)
+	object, err := c.server.database.Patch(ctx, user, req.URL, preconditionsOf(req), obj)
 	if err != nil {
 		servConnLog.Warning("Unable to update object %s :: %s", req.URL, err)
-		return fosp.NewResponse(fosp.FAILED, fosp.StatusInternalServerError)
+		return failedResponse(err)
 	}
 	body, err := json.Marshal(object)
 	if err != nil {
 		return fosp.NewResponse(fosp.FAILED, fosp.StatusInternalServerError)
 	}
 	resp := fosp.NewResponse(fosp.SUCCEEDED, fosp.StatusOK)
+	resp.Header.Set(fosp.ETagHeader, object.ETag)
 	resp.Body = bytes.NewBuffer(body)
 	return resp
 }
 
-func (c *ServerConnection) handleList(user string, req *fosp.Request) *fosp.Response {
+func (c *ServerConnection) handleList(ctx context.Context, user string, req *fosp.Request) *fosp.Response {
 	defer timeTrack(time.Now(), "list request")
-	list, err := c.server.database.List(user, req.URL)
+	list, err := c.server.database.List(ctx, user, req.URL)
 	if err != nil {
-		return fosp.NewResponse(fosp.FAILED, fosp.StatusInternalServerError)
+		return failedResponse(err)
 	}
 	if body, err := json.Marshal(list); err == nil {
 		resp := fosp.NewResponse(fosp.SUCCEEDED, fosp.StatusOK)
@@ -175,30 +223,118 @@ func (c *ServerConnection) handleList(user string, req *fosp.Request) *fosp.Resp
 	return fosp.NewResponse(fosp.FAILED, fosp.StatusInternalServerError)
 }
 
-func (c *ServerConnection) handleDelete(user string, req *fosp.Request) *fosp.Response {
+func (c *ServerConnection) handleDelete(ctx context.Context, user string, req *fosp.Request) *fosp.Response {
 	defer timeTrack(time.Now(), "delete request")
-	if err := c.server.database.Delete(user, req.URL); err != nil {
-		return fosp.NewResponse(fosp.FAILED, fosp.StatusInternalServerError)
+	if err := c.server.database.Delete(ctx, user, req.URL, preconditionsOf(req)); err != nil {
+		return failedResponse(err)
 	}
 	return fosp.NewResponse(fosp.SUCCEEDED, fosp.StatusNoContent)
 }
 
-func (c *ServerConnection) handleRead(user string, req *fosp.Request) *fosp.Response {
+func (c *ServerConnection) handleRead(ctx context.Context, user string, req *fosp.Request) *fosp.Response {
 	defer timeTrack(time.Now(), "read request")
-	data, err := c.server.database.Read(user, req.URL)
+	attachment, digest, err := c.server.database.Read(ctx, user, req.URL)
 	if err != nil {
+		return failedResponse(err)
+	}
+	rangeHeader := req.Header.Get(fosp.RangeHeader)
+	if rangeHeader == "" {
+		resp := fosp.NewResponse(fosp.SUCCEEDED, fosp.StatusOK)
+		resp.Header.Set(fosp.DigestHeader, digest)
+		// The attachment is streamed to the client and closed when it was sent completely.
+		resp.Body = attachment
+		return resp
+	}
+	size, err := attachment.Seek(0, io.SeekEnd)
+	if err != nil {
+		attachment.Close()
 		return fosp.NewResponse(fosp.FAILED, fosp.StatusInternalServerError)
 	}
-	resp := fosp.NewResponse(fosp.SUCCEEDED, fosp.StatusOK)
-	resp.Body = bytes.NewBuffer(data)
+	first, last, err := fosp.ParseRange(rangeHeader, size)
+	if err == nil {
+		_, err = attachment.Seek(first, io.SeekStart)
+	}
+	if err != nil {
+		attachment.Close()
+		resp := fosp.NewResponse(fosp.FAILED, fosp.StatusRangeNotSatisfiable)
+		resp.Header.Set(fosp.ContentRangeHeader, "bytes */"+strconv.FormatInt(size, 10))
+		return resp
+	}
+	resp := fosp.NewResponse(fosp.SUCCEEDED, fosp.StatusPartialContent)
+	resp.Header.Set(fosp.ContentRangeHeader, fosp.FormatContentRange(first, last, size))
+	resp.Header.Set(fosp.DigestHeader, digest)
+	resp.Body = &readCloser{Reader: io.LimitReader(attachment, last-first+1), Closer: attachment}
 	return resp
 }
 
-func (c *ServerConnection) handleWrite(user string, req *fosp.Request) *fosp.Response {
+func (c *ServerConnection) handleWrite(ctx context.Context, user string, req *fosp.Request) *fosp.Response {
 	defer timeTrack(time.Now(), "write request")
-	if err := c.server.database.Write(user, req.URL, req.Body); err != nil {
+	if req.Body == nil {
+		return fosp.NewResponse(fosp.FAILED, fosp.StatusBadRequest)
+	}
+	offsetHeader, upload := req.Header.Get(fosp.OffsetHeader), req.Header.Get(fosp.UploadHeader)
+	if offsetHeader != "" || upload != "" {
+		return c.handleWriteAt(ctx, user, req, offsetHeader, upload)
+	}
+	body := req.Body
+	if max := c.server.MaxAttachmentSize; max > 0 {
+		body = &maxSizeReader{reader: req.Body, remaining: max, err: AttachmentTooLarge}
+	}
+	etag, err := c.server.database.Write(ctx, user, req.URL, preconditionsOf(req), body)
+	if err != nil {
 		servConnLog.Warning("Write request failed: " + err.Error())
-		return fosp.NewResponse(fosp.FAILED, fosp.StatusInternalServerError)
+		return failedResponse(err)
 	}
-	return fosp.NewResponse(fosp.SUCCEEDED, fosp.StatusNoContent)
+	resp := fosp.NewResponse(fosp.SUCCEEDED, fosp.StatusNoContent)
+	resp.Header.Set(fosp.ETagHeader, etag)
+	return resp
+}
+
+// handleWriteAt handles WRITE requests that write at an offset or continue a resumable upload.
+// Both successful and conflicting responses carry the size of the attachment in the Offset header.
+func (c *ServerConnection) handleWriteAt(ctx context.Context, user string, req *fosp.Request, offsetHeader, upload string) *fosp.Response {
+	offset := int64(0)
+	if offsetHeader != "" {
+		var err error
+		if offset, err = strconv.ParseInt(offsetHeader, 10, 64); err != nil || offset < 0 {
+			return fosp.NewResponse(fosp.FAILED, fosp.StatusBadRequest)
+		}
+	}
+	body := req.Body
+	if max := c.server.MaxAttachmentSize; max > 0 {
+		if offset >= max {
+			return fosp.NewResponse(fosp.FAILED, fosp.StatusRequestEntityTooLarge)
+		}
+		body = &maxSizeReader{reader: req.Body, remaining: max - offset, err: AttachmentTooLarge}
+	}
+	size, etag, err := c.server.database.WriteAt(ctx, user, req.URL, offset, upload, preconditionsOf(req), body)
+	var resp *fosp.Response
+	if err != nil {
+		servConnLog.Warning("Write request failed: " + err.Error())
+		resp = failedResponse(err)
+	} else {
+		resp = fosp.NewResponse(fosp.SUCCEEDED, fosp.StatusNoContent)
+		resp.Header.Set(fosp.ETagHeader, etag)
+	}
+	if size >= 0 {
+		resp.Header.Set(fosp.OffsetHeader, strconv.FormatInt(size, 10))
+	}
+	return resp
+}
+
+// failedResponse creates a FAILED response carrying the status code of err.
+// A request that was abandoned because its context ended is reported as timed out, like a forwarded request.
+// Other errors that are not a FospError are reported as internal server errors.
+func failedResponse(err error) *fosp.Response {
+	if fe, ok := err.(FospError); ok {
+		return fosp.NewResponse(fosp.FAILED, fe.Code)
+	}
+	if err == context.DeadlineExceeded || err == context.Canceled {
+		return fosp.NewResponse(fosp.FAILED, fosp.StatusGatewayTimeout)
+	}
+	// The body was received faster than it could be stored, e.g. while the object was locked by another write.
+	if err == fospws.ErrStreamOverflow {
+		return fosp.NewResponse(fosp.FAILED, fosp.StatusServiceUnavailable)
+	}
+	return fosp.NewResponse(fosp.FAILED, fosp.StatusInternalServerError)
 }
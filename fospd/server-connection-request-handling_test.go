@@ -0,0 +1,40 @@
+// Copyright (C) 2015 Felix Maurer
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/maufl/go-fosp/fosp"
+	"testing"
+)
+
+func TestHandleOptions(t *testing.T) {
+	srv := NewServer(NewMemoryDriver(), "example.com")
+	srv.MaxAttachmentSize = 1024
+	c := &ServerConnection{server: srv}
+	resp := c.handleRequest(context.Background(), fosp.NewRequest(fosp.OPTIONS, nil))
+	if resp.Status != fosp.SUCCEEDED || resp.Code != fosp.StatusOK {
+		t.Fatalf("Expected OPTIONS to succeed but got %s", resp)
+	}
+	caps := fosp.NewCapabilities()
+	if err := json.NewDecoder(resp.Body).Decode(caps); err != nil {
+		t.Fatalf("Could not decode capabilities: %s", err)
+	}
+	if caps.Version != fosp.ProtocolVersion || caps.MaxAttachmentSize != 1024 || !contains(caps.SaslMechanisms, "PLAIN") || !contains(caps.Methods, fosp.OPTIONS) {
+		t.Errorf("Capabilities are not as expected: %#v", caps)
+	}
+}
@@ -16,10 +16,12 @@
 package main
 
 import (
+	"context"
 	"github.com/gorilla/websocket"
+	"github.com/maufl/go-fosp/fosp"
 	"github.com/maufl/go-fosp/fosp/fospws"
 	"github.com/op/go-logging"
-	"net/http"
+	"sync"
 )
 
 var servConnLog = logging.MustGetLogger("go-fosp/fosp/server-connection")
@@ -28,8 +30,20 @@ var servConnLog = logging.MustGetLogger("go-fosp/fosp/server-connection")
 type ServerConnection struct {
 	*fospws.Connection
 	server *Server
+	ctx    context.Context
 
-	SaslMechanism string
+	sasl SaslSession
+
+	// subscriptions are the subscriptions of this connection by the URL of the subscribed object.
+	subscriptions     map[string]*fosp.SubscriptionEntry
+	subscriptionsLock sync.Mutex
+	// subscriptionsDropped is set when the connection closes, later subscriptions are refused.
+	subscriptionsDropped bool
+	// registeredUser is the user for whom the connection is registered with the server, it changes with every
+	// successful authentication of a user. registrationClosed is set when the connection closes.
+	registeredUser     string
+	registrationClosed bool
+	registrationLock   sync.Mutex
 
 	User         string
 	RemoteDomain string
@@ -40,36 +54,85 @@ func NewServerConnection(ws *websocket.Conn, srv *Server) *ServerConnection {
 	if ws == nil || srv == nil {
 		panic("Cannot initialize fosp connection without websocket or server")
 	}
-	con := &ServerConnection{Connection: fospws.NewConnection(ws), server: srv, User: "", RemoteDomain: ""}
+	ctx, cancel := context.WithCancel(context.Background())
+	con := &ServerConnection{Connection: fospws.NewConnection(ws), server: srv, ctx: ctx, User: "", RemoteDomain: ""}
 	con.RegisterMessageHandler(con)
+	go func() {
+		<-con.Closed()
+		cancel()
+		con.Close()
+	}()
 	return con
 }
 
 // OpenServerConnection opens a new ServerConnection to the remoteDomain.
-// It first opens a WebSocket connection to the remoteDomain.
+// It first opens a WebSocket connection to an endpoint of the remoteDomain that is found by the Resolver of the Server.
 // Then it negotiates the connection parameters and authenticates.
-// If any of the steps fail, nil and an error is returned.
-func OpenServerConnection(srv *Server, remoteDomain string) (*ServerConnection, error) {
-	url := "ws://" + remoteDomain + ":1337"
-	srvLog.Info("Opening new connection to %s", url)
-	ws, _, err := websocket.DefaultDialer.Dial(url, http.Header{})
+// If any of the steps fail or ctx ends before the connection is authenticated, nil and an error is returned.
+func OpenServerConnection(ctx context.Context, srv *Server, remoteDomain string) (*ServerConnection, error) {
+	remoteKey, ok := srv.trustedKey(remoteDomain)
+	if srv.serverKey == nil {
+		return nil, ErrFederationDisabled
+	} else if !ok {
+		return nil, ErrUntrustedServer
+	}
+	ws, err := fospws.DialWebSocketContext(ctx, srv.Resolver, remoteDomain)
 	if err != nil {
-		srvLog.Error("Error when opening new WebSocket connection " + err.Error())
+		srvLog.Error("Error when opening new WebSocket connection to %s :: %s", remoteDomain, err)
 		return nil, err
 	}
 	connection := NewServerConnection(ws, srv)
+	// Closing the connection aborts the authentication when ctx ends.
+	authenticated := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			connection.Connection.Close()
+		case <-authenticated:
+		}
+	}()
+	err = connection.AuthenticateServer(srv.Domain(), remoteDomain, srv.serverKey, remoteKey)
+	close(authenticated)
+	if ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		srvLog.Error("Could not authenticate with server %s :: %s", remoteDomain, err)
+		connection.Connection.Close()
+		return nil, err
+	}
 	connection.RemoteDomain = remoteDomain
 	srv.registerConnection(connection, "@"+remoteDomain)
 	return connection, nil
 }
 
-// Close this connection and clean up
+// Close this connection and clean up, it is also called when the remote side closed the connection.
 // TODO: Websocket should send close message before tearing down the connection
 func (c *ServerConnection) Close() {
-	if c.User != "" {
-		c.server.Unregister(c, c.User+"@")
-	} else if c.RemoteDomain != "" {
+	c.dropSubscriptions()
+	c.registrationLock.Lock()
+	c.registrationClosed = true
+	if c.registeredUser != "" {
+		c.server.Unregister(c, c.registeredUser)
+	}
+	c.registrationLock.Unlock()
+	if c.RemoteDomain != "" {
 		c.server.Unregister(c, "@"+c.RemoteDomain)
 	}
 	c.Connection.Close()
 }
+
+// registerAs registers the connection with the server for user after the user authenticated on it.
+// A user that authenticated on the connection before is unregistered, so that it gets no notifications of user.
+func (c *ServerConnection) registerAs(user string) {
+	c.registrationLock.Lock()
+	defer c.registrationLock.Unlock()
+	if c.registrationClosed {
+		return
+	}
+	if c.registeredUser != "" {
+		c.server.Unregister(c, c.registeredUser)
+	}
+	c.registeredUser = user
+	c.server.registerUser(c, user)
+}
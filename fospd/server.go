@@ -16,16 +16,23 @@
 package main
 
 import (
+	"context"
+	"crypto/ed25519"
 	"github.com/gorilla/websocket"
 	"github.com/maufl/go-fosp/fosp"
+	"github.com/maufl/go-fosp/fosp/fospws"
 	"github.com/op/go-logging"
 	"net/http"
 	"strings"
 	"sync"
+	"time"
 )
 
 var srvLog = logging.MustGetLogger("go-fosp/fosp/server")
 
+// forwardTimeout is how long a forwarded request that has no deadline may take.
+const forwardTimeout = 15 * time.Second
+
 // Server represents a FOSP server.
 // It is responsible for a single domain, uses a database to store the data
 // and manages the Connections.
@@ -33,7 +40,27 @@ type Server struct {
 	database        *Database
 	connections     map[string][]*ServerConnection
 	connectionsLock sync.RWMutex
+	subscribers     map[*ServerConnection]bool
+	subscribersLock sync.RWMutex
+	queueLocks      objectLocks
 	domain          string
+	saslMechanisms  []string
+	scramSecret     []byte
+	serverKey       ed25519.PrivateKey
+	trustedServers  map[string]ed25519.PublicKey
+
+	// MaxMessageSize is the maximum size in bytes of a message the Server accepts, 0 means unlimited.
+	MaxMessageSize int64
+	// MaxAttachmentSize is the maximum size in bytes of an attachment the Server stores, 0 means unlimited.
+	MaxAttachmentSize int64
+	// Quota limits the storage of every user that has no entry in Quotas.
+	Quota Quota
+	// Quotas overrides the default Quota for single users.
+	Quotas map[string]Quota
+	// NotificationRetention limits the notification queue of every user.
+	NotificationRetention NotificationRetention
+	// Resolver finds the endpoints of remote servers, fospws.DefaultResolver is used by default.
+	Resolver fospws.Resolver
 }
 
 // NewServer initializes a new server struct and returns it.
@@ -48,6 +75,15 @@ func NewServer(dbDriver DatabaseDriver, domain string) *Server {
 	s.database = NewDatabase(dbDriver, s)
 	s.domain = domain
 	s.connections = make(map[string][]*ServerConnection)
+	s.saslMechanisms = defaultSaslMechanisms
+	// The secret is persisted, so that the made up SCRAM salts of unknown users stay the same across restarts.
+	secret, err := dbDriver.ServerSecret("scram")
+	if err != nil {
+		panic("Cannot initialize server without SCRAM secret")
+	}
+	s.scramSecret = secret
+	s.NotificationRetention = DefaultNotificationRetention
+	s.Resolver = fospws.DefaultResolver
 	return s
 }
 
@@ -65,6 +101,9 @@ func (s *Server) RequestHandler(res http.ResponseWriter, req *http.Request) {
 		return
 	}
 	srvLog.Notice("Successfully accepted new connection")
+	if s.MaxMessageSize > 0 {
+		ws.SetReadLimit(s.MaxMessageSize)
+	}
 	NewServerConnection(ws, s)
 }
 
@@ -91,20 +130,13 @@ func (s *Server) Unregister(c *ServerConnection, remote string) {
 
 // routeNotification routes a notification to a user.
 // It first determins if the user belongs to the domain of the Server.
-// If that's the case, it searches it's known connection for a connection to this user and sends the notification.
+// If that's the case, the notification is queued for the user and sent on all connections of the user.
 // Else it routes the notification to a remote server, opening a new connection if necessary.
 func (s *Server) routeNotification(user string, notf *fosp.Notification) {
 	srvLog.Info("Sending notification %v to user %s", notf, user)
 	if strings.HasSuffix(user, "@"+s.domain) {
-		userName := strings.TrimSuffix(user, s.domain)
-		srvLog.Debug("Is local user %s", userName)
-		s.connectionsLock.RLock()
-		srvLog.Debug("Connections are %v", s.connections[userName])
-		for _, connection := range s.connections[userName] {
-			srvLog.Debug("Sending notification on local connection")
-			connection.Send(notf)
-		}
-		s.connectionsLock.RUnlock()
+		srvLog.Debug("Is local user %s", user)
+		s.deliverLocally(user, notf)
 	} else if notf.URL.Host == s.domain {
 		parts := strings.Split(user, "@")
 		if len(parts) != 2 {
@@ -112,7 +144,7 @@ func (s *Server) routeNotification(user string, notf *fosp.Notification) {
 		}
 		remoteDomain := parts[1]
 		srvLog.Debug("Is local notification that will be routed to remote server")
-		remoteConnection, err := s.getOrOpenRemoteConnection(remoteDomain)
+		remoteConnection, err := s.getOrOpenRemoteConnection(context.Background(), remoteDomain)
 		if err == nil {
 			notf.Header.Set("To", user)
 			remoteConnection.Send(notf)
@@ -122,13 +154,20 @@ func (s *Server) routeNotification(user string, notf *fosp.Notification) {
 
 // forwardRequest sends a request to a remote Server and returns the response or an error.
 // It is used to forward a request from a local user for a non local resources to remote servers.
-func (s *Server) forwardRequest(user string, req *fosp.Request) (*fosp.Response, error) {
+// The connection to the remote server has to be opened and the remote server has to answer before the deadline
+// of the context, which is the deadline of the original request or forwardTimeout if it has none.
+func (s *Server) forwardRequest(ctx context.Context, user string, req *fosp.Request) (*fosp.Response, error) {
 	req.Header.Set("From", user)
-	remoteConnection, err := s.getOrOpenRemoteConnection(req.URL.Host)
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, forwardTimeout)
+		defer cancel()
+	}
+	remoteConnection, err := s.getOrOpenRemoteConnection(ctx, req.URL.Host)
 	if err != nil {
 		return nil, err
 	}
-	resp, err := remoteConnection.SendRequest(req)
+	resp, err := remoteConnection.SendRequestContext(ctx, req)
 	srvLog.Info("Recieved response from forwarded request")
 	if err != nil {
 		srvLog.Warning("Error occured while forwarding " + err.Error())
@@ -141,8 +180,8 @@ func (s *Server) forwardRequest(user string, req *fosp.Request) (*fosp.Response,
 // getOrOpenRemoteConnection returns a connection to the remoteDomain.
 // If such a connection already exists and is known to the Server, it is reused.
 // Otherwise a new connection is opened.
-// If a new connection is opened, the call will be blocked until the new connection is authenticated or failed.
-func (s *Server) getOrOpenRemoteConnection(remoteDomain string) (*ServerConnection, error) {
+// If a new connection is opened, the call will be blocked until the new connection is authenticated, failed or ctx ended.
+func (s *Server) getOrOpenRemoteConnection(ctx context.Context, remoteDomain string) (*ServerConnection, error) {
 	s.connectionsLock.RLock()
 	if connections, ok := s.connections["@"+remoteDomain]; ok {
 		for _, connection := range connections {
@@ -151,7 +190,7 @@ func (s *Server) getOrOpenRemoteConnection(remoteDomain string) (*ServerConnecti
 		}
 	}
 	s.connectionsLock.RUnlock()
-	return OpenServerConnection(s, remoteDomain)
+	return OpenServerConnection(ctx, s, remoteDomain)
 }
 
 // Domain returns the domain this Server handles.
@@ -161,3 +200,12 @@ func (s *Server) Domain() string {
 	}
 	return s.domain
 }
+
+// Capabilities returns the description of the features of this Server that is sent in response to OPTIONS requests.
+func (s *Server) Capabilities() *fosp.Capabilities {
+	caps := fosp.NewCapabilities()
+	caps.SaslMechanisms = append(caps.SaslMechanisms, s.saslMechanisms...)
+	caps.MaxMessageSize = s.MaxMessageSize
+	caps.MaxAttachmentSize = s.MaxAttachmentSize
+	return caps
+}
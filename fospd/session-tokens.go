@@ -0,0 +1,190 @@
+// Copyright (C) 2015 Felix Maurer
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"github.com/maufl/go-fosp/fosp"
+	"io"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+// TokenMechanism is the name of the SASL mechanism that authenticates with a session token.
+// The response of the client is the user name and the token separated by a NUL byte.
+const TokenMechanism = "TOKEN"
+
+// tokensPath is the path of the pseudo object in the root of every user through which session tokens are managed.
+//
+//	CREATE alice@example.com/.tokens         issues a new token, the body may contain {"label": "..."}
+//	LIST   alice@example.com/.tokens         returns the IDs of all tokens
+//	GET    alice@example.com/.tokens/<id>    returns the label and creation date of a token
+//	DELETE alice@example.com/.tokens/<id>    revokes a token
+const tokensPath = "/.tokens"
+
+// SessionToken is a revocable credential that is issued to an authenticated user.
+// Only a hash of the secret part of the token is stored.
+type SessionToken struct {
+	ID      string    `json:"id"`
+	User    string    `json:"user"`
+	Hash    []byte    `json:"hash,omitempty"`
+	Label   string    `json:"label,omitempty"`
+	Created time.Time `json:"created"`
+}
+
+func init() {
+	RegisterSaslMechanism(tokenMechanism{})
+}
+
+// IssueToken creates a new session token for user and returns it in the form "<id>.<secret>".
+func (d *Database) IssueToken(user, label string) (string, *SessionToken, error) {
+	id, err := randomString(9)
+	if err != nil {
+		return "", nil, InternalServerError
+	}
+	secret, err := randomString(32)
+	if err != nil {
+		return "", nil, InternalServerError
+	}
+	hash := sha256.Sum256([]byte(secret))
+	token := &SessionToken{ID: id, User: user, Hash: hash[:], Label: label, Created: time.Now().UTC()}
+	if err := d.driver.CreateToken(token); err != nil {
+		return "", nil, err
+	}
+	return id + "." + secret, token, nil
+}
+
+// AuthenticateToken determines whether token is a valid session token of user.
+func (d *Database) AuthenticateToken(user, token string) bool {
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) != 2 {
+		return false
+	}
+	stored, err := d.driver.GetToken(parts[0])
+	if err != nil || stored.User != user {
+		return false
+	}
+	hash := sha256.Sum256([]byte(parts[1]))
+	return subtle.ConstantTimeCompare(hash[:], stored.Hash) == 1
+}
+
+// tokenMechanism implements the TOKEN SASL mechanism.
+type tokenMechanism struct{}
+
+func (tokenMechanism) Name() string {
+	return TokenMechanism
+}
+
+func (tokenMechanism) NewSession(db *Database) SaslSession {
+	return &tokenSession{database: db}
+}
+
+type tokenSession struct {
+	database *Database
+}
+
+func (s *tokenSession) Step(response *string) SaslResult {
+	if response == nil {
+		return SaslContinue("Please provide your user name and session token")
+	}
+	parts := strings.Split(*response, "\x00")
+	if len(parts) != 2 {
+		return SaslFailure(fosp.StatusBadRequest, "")
+	}
+	if s.database.AuthenticateToken(parts[0], parts[1]) {
+		return SaslSuccess(parts[0], nil)
+	}
+	return SaslFailure(fosp.StatusUnauthorized, "")
+}
+
+// isTokensURL returns whether u points to the tokens pseudo object or one of its children.
+func isTokensURL(u *url.URL) bool {
+	return u != nil && (u.Path == tokensPath || path.Dir(u.Path) == tokensPath)
+}
+
+func (c *ServerConnection) handleTokens(user string, req *fosp.Request) *fosp.Response {
+	if user == "" || rootOwner(req.URL) != user {
+		return fosp.NewResponse(fosp.FAILED, fosp.StatusForbidden)
+	}
+	db := c.server.database
+	id := ""
+	if req.URL.Path != tokensPath {
+		id = path.Base(req.URL.Path)
+	}
+	switch {
+	case req.Method == fosp.CREATE && id == "":
+		options := struct {
+			Label string `json:"label"`
+		}{}
+		if req.Body != nil {
+			if err := json.NewDecoder(req.Body).Decode(&options); err != nil && err != io.EOF {
+				return fosp.NewResponse(fosp.FAILED, fosp.StatusBadRequest)
+			}
+		}
+		secret, token, err := db.IssueToken(user, options.Label)
+		if err != nil {
+			return failedResponse(err)
+		}
+		return jsonResponse(fosp.StatusCreated, struct {
+			Token string `json:"token"`
+			*SessionToken
+		}{secret, withoutHash(token)})
+	case req.Method == fosp.LIST && id == "":
+		tokens, err := db.driver.ListTokens(user)
+		if err != nil {
+			return failedResponse(err)
+		}
+		ids := make([]string, len(tokens))
+		for i, token := range tokens {
+			ids[i] = token.ID
+		}
+		return jsonResponse(fosp.StatusOK, ids)
+	case req.Method == fosp.GET && id != "":
+		token, err := db.driver.GetToken(id)
+		if err != nil || token.User != user {
+			return fosp.NewResponse(fosp.FAILED, fosp.StatusNotFound)
+		}
+		return jsonResponse(fosp.StatusOK, withoutHash(token))
+	case req.Method == fosp.DELETE && id != "":
+		if err := db.driver.DeleteToken(user, id); err != nil {
+			return failedResponse(err)
+		}
+		return fosp.NewResponse(fosp.SUCCEEDED, fosp.StatusNoContent)
+	default:
+		return fosp.NewResponse(fosp.FAILED, fosp.StatusMethodNotAllowed)
+	}
+}
+
+func withoutHash(token *SessionToken) *SessionToken {
+	result := *token
+	result.Hash = nil
+	return &result
+}
+
+func jsonResponse(code uint, content interface{}) *fosp.Response {
+	body, err := json.Marshal(content)
+	if err != nil {
+		return fosp.NewResponse(fosp.FAILED, fosp.StatusInternalServerError)
+	}
+	resp := fosp.NewResponse(fosp.SUCCEEDED, code)
+	resp.Body = bytes.NewBuffer(body)
+	return resp
+}
@@ -0,0 +1,223 @@
+// Copyright (C) 2015 Felix Maurer
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"github.com/maufl/go-fosp/fosp"
+	"github.com/maufl/go-fosp/fosp/fospclient"
+	"github.com/maufl/go-fosp/fosp/fospws"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestStreamingAttachments(t *testing.T) {
+	srv, connection, closer := dialTestServer(t)
+	defer closer()
+	srv.MaxAttachmentSize = 1 << 20
+	srv.database.Register("alice@example.com", "secret")
+	client := fospclient.New(connection)
+	if err := client.Authenticate("alice@example.com", "secret"); err != nil {
+		t.Fatalf("Authentication failed: %s", err)
+	}
+	video := mustParseURL(t, "fosp://alice@example.com/video")
+	if _, err := client.Create(video, fosp.NewObject()); err != nil {
+		t.Fatalf("Create failed: %s", err)
+	}
+
+	// The attachment spans many chunk frames.
+	content := make([]byte, 10*32*1024+123)
+	rand.Read(content)
+	if err := client.Write(video, bytes.NewReader(content)); err != nil {
+		t.Fatalf("Write failed: %s", err)
+	}
+	stream, err := client.ReadStream(video)
+	if err != nil {
+		t.Fatalf("Read failed: %s", err)
+	}
+	data, err := ioutil.ReadAll(stream)
+	stream.Close()
+	if err != nil || !bytes.Equal(data, content) {
+		t.Errorf("Read %d bytes (%v) but wrote %d", len(data), err, len(content))
+	}
+	if obj, err := client.Get(video); err != nil || obj.Attachment == nil || obj.Attachment.Size != uint(len(content)) {
+		t.Errorf("Attachment size was not recorded: %v, %v", obj, err)
+	}
+
+	// Requests are answered while the body of a read is not consumed yet.
+	unread, err := client.ReadStream(video)
+	if err != nil {
+		t.Fatalf("Read failed: %s", err)
+	}
+	if _, err := client.Get(video); err != nil {
+		t.Errorf("Request failed while an attachment was not read: %s", err)
+	}
+	if data, err := ioutil.ReadAll(unread); err != nil || !bytes.Equal(data, content) {
+		t.Errorf("Read %d bytes (%v) of the buffered attachment but wrote %d", len(data), err, len(content))
+	}
+	unread.Close()
+
+	tooLarge := make([]byte, srv.MaxAttachmentSize+1)
+	if err := client.Write(video, bytes.NewReader(tooLarge)); fospclient.StatusCode(err) != fosp.StatusRequestEntityTooLarge {
+		t.Errorf("Expected too large attachment to be rejected but got %v", err)
+	}
+	if data, err := client.Read(video); err != nil || !bytes.Equal(data, content) {
+		t.Errorf("Rejected write changed the attachment: %d bytes, %v", len(data), err)
+	}
+
+	// A request on the same connection still works after a rejected stream was discarded.
+	if _, err := client.Get(video); err != nil {
+		t.Errorf("Connection is unusable after rejected stream: %s", err)
+	}
+}
+
+// slowReader returns chunks of data with a delay and counts how often it was read.
+type slowReader struct {
+	chunks int
+	reads  int32
+}
+
+func (r *slowReader) Read(p []byte) (int, error) {
+	if r.chunks == 0 {
+		return 0, io.EOF
+	}
+	time.Sleep(100 * time.Millisecond)
+	atomic.AddInt32(&r.reads, 1)
+	r.chunks--
+	return copy(p, "chunk"), nil
+}
+
+func TestSlowUploads(t *testing.T) {
+	srv, connection, closer := dialTestServer(t)
+	defer closer()
+	srv.database.Register("alice@example.com", "secret")
+	client := fospclient.New(connection)
+	if err := client.Authenticate("alice@example.com", "secret"); err != nil {
+		t.Fatalf("Authentication failed: %s", err)
+	}
+	video := mustParseURL(t, "fosp://alice@example.com/video")
+	client.Create(video, fosp.NewObject())
+
+	// The timeout only starts when the whole attachment was sent.
+	connection.RequestTimeout = 300 * time.Millisecond
+	if err := client.Write(video, &slowReader{chunks: 10}); err != nil {
+		t.Fatalf("Upload that took longer than the request timeout failed: %s", err)
+	}
+	if data, err := client.Read(video); err != nil || len(data) != 50 {
+		t.Errorf("Expected 50 bytes but read %d, %v", len(data), err)
+	}
+
+	// An abandoned upload is aborted.
+	ctx, cancel := context.WithTimeout(context.Background(), 250*time.Millisecond)
+	defer cancel()
+	endless := &slowReader{chunks: -1}
+	req := fosp.NewRequest(fosp.WRITE, video)
+	req.Body = endless
+	if _, err := connection.SendRequestContext(ctx, req); err != context.DeadlineExceeded {
+		t.Errorf("Expected upload to be abandoned at the deadline but got %v", err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	reads := atomic.LoadInt32(&endless.reads)
+	time.Sleep(300 * time.Millisecond)
+	if atomic.LoadInt32(&endless.reads) != reads {
+		t.Errorf("Body of the abandoned upload is still sent")
+	}
+	if data, err := client.Read(video); err != nil || len(data) != 50 {
+		t.Errorf("Abandoned upload changed the attachment: %d bytes, %v", len(data), err)
+	}
+}
+
+func TestAttachmentDigests(t *testing.T) {
+	srv, connection, closer := dialTestServer(t)
+	defer closer()
+	srv.database.Register("alice@example.com", "secret")
+	client := fospclient.New(connection)
+	if err := client.Authenticate("alice@example.com", "secret"); err != nil {
+		t.Fatalf("Authentication failed: %s", err)
+	}
+	first := mustParseURL(t, "fosp://alice@example.com/first")
+	second := mustParseURL(t, "fosp://alice@example.com/second")
+	client.Create(first, fosp.NewObject())
+	client.Create(second, fosp.NewObject())
+	content := []byte("The same content twice")
+	digest := fosp.Digest(content)
+
+	if err := client.WriteIfNoneMatch(first, "*", bytes.NewReader(content)); err != nil {
+		t.Fatalf("Conditional write of a new attachment failed: %s", err)
+	}
+	if err := client.WriteIfNoneMatch(first, digest, bytes.NewReader(content)); !fospclient.IsPreconditionFailed(err) {
+		t.Errorf("Expected write of unchanged content to fail the precondition but got %v", err)
+	}
+	if err := client.Write(second, bytes.NewReader(content)); err != nil {
+		t.Fatalf("Write failed: %s", err)
+	}
+	for _, u := range []string{"fosp://alice@example.com/first", "fosp://alice@example.com/second"} {
+		if obj, err := client.Get(mustParseURL(t, u)); err != nil || obj.Attachment == nil || obj.Attachment.Digest != digest {
+			t.Errorf("Expected digest %s for %s but got %v, %v", digest, u, obj, err)
+		}
+	}
+
+	// Deleting one object must not remove the content that is shared with the other one.
+	if err := client.Delete(first); err != nil {
+		t.Fatalf("Delete failed: %s", err)
+	}
+	if data, err := client.Read(second); err != nil || !bytes.Equal(data, content) {
+		t.Errorf("Shared attachment is broken after delete: %q, %v", data, err)
+	}
+}
+
+func TestStreamBufferOverflow(t *testing.T) {
+	srv, connection, closer := dialTestServer(t)
+	defer closer()
+	srv.database.Register("alice@example.com", "secret")
+	client := fospclient.New(connection)
+	if err := client.Authenticate("alice@example.com", "secret"); err != nil {
+		t.Fatalf("Authentication failed: %s", err)
+	}
+	video := mustParseURL(t, "fosp://alice@example.com/video")
+	client.Create(video, fosp.NewObject())
+	content := make([]byte, fospws.StreamBufferSize+10*fospws.StreamChunkSize)
+	rand.Read(content)
+	if err := client.Write(video, bytes.NewReader(content)); err != nil {
+		t.Fatalf("Write failed: %s", err)
+	}
+
+	// The body of the response is never read, so the connection stops buffering it at StreamBufferSize.
+	resp, err := connection.SendRequest(fosp.NewRequest(fosp.READ, video))
+	if err != nil || resp.Status != fosp.SUCCEEDED {
+		t.Fatalf("Read failed: %v, %v", resp, err)
+	}
+	// Reading nothing waits for the next chunk without consuming the buffered ones.
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if _, err := resp.Body.Read(nil); err == fospws.ErrStreamOverflow {
+			break
+		} else if err != nil {
+			t.Fatalf("Expected the unread stream to overflow but got %s", err)
+		} else if time.Now().After(deadline) {
+			t.Fatalf("Unread stream did not overflow")
+		}
+	}
+
+	// The discarded chunks do not count against the buffer of the following streams.
+	if data, err := client.Read(video); err != nil || !bytes.Equal(data, content) {
+		t.Errorf("Read %d bytes (%v) after an overflow but wrote %d", len(data), err, len(content))
+	}
+}
@@ -0,0 +1,185 @@
+// Copyright (C) 2015 Felix Maurer
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/maufl/go-fosp/fosp"
+	"io"
+	"net/url"
+	"strings"
+)
+
+// Subscriptions that are sent with SUBSCRIBE are kept by the connection they were sent on instead of being stored
+// in the object. They end with UNSUBSCRIBE or when the connection closes. The body filters the events like the
+// entries of the subscriptions field of an object, without a body all events on the object itself are subscribed.
+//
+//	SUBSCRIBE alice@example.com/notes 1 {"depth": -1, "events": ["CREATED", "DELETED"]}
+//	UNSUBSCRIBE alice@example.com/notes 2
+//
+// A connection has at most one subscription per object, subscribing again replaces the filter.
+// Subscribing requires permission to write the subscriptions of the object. Like for subscriptions that are stored
+// in objects, the permissions are checked again for every notification, which only contains the readable fields.
+// With "delta": true, UPDATED notifications that were caused by a PATCH carry the applied patch instead of the object,
+// together with the entity tags of the object before and after the patch.
+
+// subscriptionEvents are the events that can be subscribed.
+var subscriptionEvents = []string{fosp.CREATED, fosp.UPDATED, fosp.DELETED}
+
+func (c *ServerConnection) handleSubscribe(ctx context.Context, req *fosp.Request) *fosp.Response {
+	if c.RemoteDomain != "" {
+		return subscriptionRefused()
+	}
+	entry := fosp.SubscriptionEntry{Events: subscriptionEvents}
+	if req.Body != nil {
+		if err := json.NewDecoder(req.Body).Decode(&entry); err != nil && err != io.EOF {
+			servConnLog.Warning("Unable to decode SUBSCRIBE body :: %s", err)
+			return fosp.NewResponse(fosp.FAILED, fosp.StatusBadRequest)
+		}
+	}
+	if entry.Depth < -1 || len(entry.Events) == 0 {
+		return fosp.NewResponse(fosp.FAILED, fosp.StatusBadRequest)
+	}
+	for i, event := range entry.Events {
+		if entry.Events[i] = strings.ToUpper(event); !contains(subscriptionEvents, entry.Events[i]) {
+			return fosp.NewResponse(fosp.FAILED, fosp.StatusBadRequest)
+		}
+	}
+	if err := c.server.database.checkSubscribe(ctx, c.User, req.URL); err != nil {
+		return failedResponse(err)
+	}
+	if !c.subscribe(req.URL, &entry) {
+		return fosp.NewResponse(fosp.FAILED, fosp.StatusServiceUnavailable)
+	}
+	return fosp.NewResponse(fosp.SUCCEEDED, fosp.StatusNoContent)
+}
+
+func (c *ServerConnection) handleUnsubscribe(req *fosp.Request) *fosp.Response {
+	if c.RemoteDomain != "" {
+		return subscriptionRefused()
+	}
+	if !c.unsubscribe(req.URL) {
+		return fosp.NewResponse(fosp.FAILED, fosp.StatusNotFound)
+	}
+	return fosp.NewResponse(fosp.SUCCEEDED, fosp.StatusNoContent)
+}
+
+// subscriptionRefused answers subscription requests that a remote server forwarded for one of its users.
+// Subscriptions are not supported across servers, because notifications are routed to users and not to connections.
+func subscriptionRefused() *fosp.Response {
+	return fosp.NewResponse(fosp.FAILED, fosp.StatusNotImplemented)
+}
+
+// checkSubscribe fails if user may not subscribe to the object at url, which requires permission to write its subscriptions.
+func (d *Database) checkSubscribe(ctx context.Context, user string, url *url.URL) error {
+	object, err := d.driver.GetObjectWithParents(url)
+	if err != nil {
+		return err
+	}
+	if !object.PermissionsForSubscriptions(user, d.groupsOf(ctx, user, url)...).Contain(fosp.PermissionWrite) {
+		return Forbidden
+	}
+	return nil
+}
+
+// subscribe adds or replaces the subscription of the connection to the object at u.
+// It returns false if the connection was closed in the meantime, which would never remove the subscription again.
+func (c *ServerConnection) subscribe(u *url.URL, entry *fosp.SubscriptionEntry) bool {
+	c.subscriptionsLock.Lock()
+	defer c.subscriptionsLock.Unlock()
+	if c.subscriptionsDropped {
+		return false
+	}
+	if c.subscriptions == nil {
+		c.subscriptions = make(map[string]*fosp.SubscriptionEntry)
+	}
+	c.subscriptions[u.String()] = entry
+	c.server.addSubscriber(c)
+	return true
+}
+
+// unsubscribe removes the subscription of the connection to the object at u and returns whether there was one.
+func (c *ServerConnection) unsubscribe(u *url.URL) bool {
+	c.subscriptionsLock.Lock()
+	defer c.subscriptionsLock.Unlock()
+	if _, ok := c.subscriptions[u.String()]; !ok {
+		return false
+	}
+	delete(c.subscriptions, u.String())
+	if len(c.subscriptions) == 0 {
+		c.server.removeSubscriber(c)
+	}
+	return true
+}
+
+// dropSubscriptions removes all subscriptions of the connection and refuses new ones.
+func (c *ServerConnection) dropSubscriptions() {
+	c.subscriptionsLock.Lock()
+	defer c.subscriptionsLock.Unlock()
+	c.subscriptionsDropped = true
+	c.subscriptions = nil
+	c.server.removeSubscriber(c)
+}
+
+// subscriptionFor returns the subscription of the connection to event on object, directly or on one of its parents,
+// or nil if there is none. The subscription closest to the object wins.
+func (c *ServerConnection) subscriptionFor(event string, object *fosp.Object) *fosp.SubscriptionEntry {
+	c.subscriptionsLock.Lock()
+	defer c.subscriptionsLock.Unlock()
+	for obj, depth := object, 0; obj != nil && obj.URL != nil; obj, depth = obj.Parent, depth+1 {
+		if entry, ok := c.subscriptions[obj.URL.String()]; ok && entry.Matches(event, depth) {
+			return entry
+		}
+	}
+	return nil
+}
+
+func (s *Server) addSubscriber(c *ServerConnection) {
+	s.subscribersLock.Lock()
+	if s.subscribers == nil {
+		s.subscribers = make(map[*ServerConnection]bool)
+	}
+	s.subscribers[c] = true
+	s.subscribersLock.Unlock()
+}
+
+func (s *Server) removeSubscriber(c *ServerConnection) {
+	s.subscribersLock.Lock()
+	delete(s.subscribers, c)
+	s.subscribersLock.Unlock()
+}
+
+// notifySubscribers sends a notification about event on object to every connection that subscribed to it.
+// etag is the entity tag of the object and delta the patch that caused an UPDATED event, or nil.
+func (s *Server) notifySubscribers(ctx context.Context, event string, object *fosp.Object, etag string, delta *patchDelta) {
+	s.subscribersLock.RLock()
+	connections := make([]*ServerConnection, 0, len(s.subscribers))
+	for c := range s.subscribers {
+		connections = append(connections, c)
+	}
+	s.subscribersLock.RUnlock()
+	for _, c := range connections {
+		entry := c.subscriptionFor(event, object)
+		if entry == nil {
+			continue
+		}
+		if notification, ok := s.database.notificationFor(ctx, c.User, event, object, etag, deltaFor(entry, delta)); ok {
+			srvLog.Debug("Sending notification %s %s to subscribed connection of %s", event, object.URL, c.User)
+			c.Send(notification)
+		}
+	}
+}
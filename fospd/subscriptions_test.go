@@ -0,0 +1,267 @@
+// Copyright (C) 2015 Felix Maurer
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/maufl/go-fosp/fosp"
+	"github.com/maufl/go-fosp/fosp/fospclient"
+	"github.com/maufl/go-fosp/fosp/fospws"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// notificationCollector is a message handler that passes the received notifications on to a channel.
+type notificationCollector chan *fosp.Notification
+
+func (n notificationCollector) HandleMessage(msg *fospws.NumberedMessage) {
+	if ntf, ok := msg.Message.(*fosp.Notification); ok {
+		n <- ntf
+	}
+}
+
+func expectNotification(t *testing.T, notifications <-chan *fosp.Notification, event, rawurl string) {
+	select {
+	case ntf := <-notifications:
+		if ntf.Event != event || ntf.URL.String() != rawurl {
+			t.Errorf("Expected notification %s %s but got %s", event, rawurl, ntf)
+		}
+	case <-time.After(2 * time.Second):
+		t.Errorf("Notification %s %s was not received", event, rawurl)
+	}
+}
+
+func TestConnectionSubscriptions(t *testing.T) {
+	srv, connection, closer := dialTestServer(t)
+	defer closer()
+	notifications := make(notificationCollector, 10)
+	connection.RegisterMessageHandler(notifications)
+	client := fospclient.New(connection)
+	if err := client.Register("alice@example.com", "secret"); err != nil {
+		t.Fatalf("Register failed: %s", err)
+	}
+	if err := client.Authenticate("alice@example.com", "secret"); err != nil {
+		t.Fatalf("Authenticate failed: %s", err)
+	}
+	notes := mustParseURL(t, "fosp://alice@example.com/notes")
+	other := mustParseURL(t, "fosp://alice@example.com/other")
+	db := srv.database
+	for _, u := range []string{"fosp://alice@example.com/notes", "fosp://alice@example.com/other"} {
+		if _, err := db.Create(context.Background(), "alice@example.com", mustParseURL(t, u), fosp.NewObject()); err != nil {
+			t.Fatalf("Creating %s failed: %s", u, err)
+		}
+	}
+
+	if err := client.Subscribe(mustParseURL(t, "fosp://alice@example.com/missing"), 0); !fospclient.IsNotFound(err) {
+		t.Errorf("Subscribing to a missing object returned %v", err)
+	}
+	if err := client.Subscribe(notes, 0, fosp.UPDATED); err != nil {
+		t.Fatalf("Subscribe failed: %s", err)
+	}
+	db.Create(context.Background(), "alice@example.com", mustParseURL(t, "fosp://alice@example.com/notes/a"), fosp.NewObject())
+	db.Patch(context.Background(), "alice@example.com", notes, Preconditions{}, fosp.PatchObject{"data": "changed"})
+	expectNotification(t, notifications, fosp.UPDATED, "fosp://alice@example.com/notes")
+
+	// Subscribing again replaces the filter.
+	if err := client.Subscribe(notes, -1); err != nil {
+		t.Fatalf("Subscribe failed: %s", err)
+	}
+	db.Create(context.Background(), "alice@example.com", mustParseURL(t, "fosp://alice@example.com/notes/a/b"), fosp.NewObject())
+	expectNotification(t, notifications, fosp.CREATED, "fosp://alice@example.com/notes/a/b")
+
+	if err := client.Unsubscribe(notes); err != nil {
+		t.Errorf("Unsubscribe failed: %s", err)
+	}
+	if err := client.Unsubscribe(notes); !fospclient.IsNotFound(err) {
+		t.Errorf("Unsubscribing twice returned %v", err)
+	}
+	db.Patch(context.Background(), "alice@example.com", notes, Preconditions{}, fosp.PatchObject{"data": "unnoticed"})
+	if err := client.Subscribe(other, 0); err != nil {
+		t.Fatalf("Subscribe failed: %s", err)
+	}
+	db.Delete(context.Background(), "alice@example.com", other, Preconditions{})
+	// Notifications are sent in order, so the change of notes would have arrived first.
+	expectNotification(t, notifications, fosp.DELETED, "fosp://alice@example.com/other")
+
+	if object, err := db.Get(context.Background(), "alice@example.com", notes); err != nil || len(object.Subscriptions) != 0 {
+		t.Errorf("Subscriptions of the connection were stored in the object: %v, %v", object.Subscriptions, err)
+	}
+
+	client.Subscribe(notes, 0)
+	connection.Close()
+	for deadline := time.Now().Add(2 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		srv.subscribersLock.RLock()
+		remaining := len(srv.subscribers)
+		srv.subscribersLock.RUnlock()
+		if remaining == 0 {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatalf("Subscriptions of a closed connection were not removed")
+		}
+	}
+}
+
+func TestSubscribeAfterClose(t *testing.T) {
+	srv := NewServer(NewMemoryDriver(), "example.com")
+	c := &ServerConnection{server: srv}
+	// A SUBSCRIBE that is still handled when the connection closes must not register the connection again.
+	c.dropSubscriptions()
+	if c.subscribe(mustParseURL(t, "fosp://alice@example.com/notes"), &fosp.SubscriptionEntry{Events: subscriptionEvents}) {
+		t.Errorf("Subscribing on a closed connection succeeded")
+	}
+	if len(srv.subscribers) != 0 {
+		t.Errorf("Closed connection was registered as subscriber")
+	}
+}
+
+func TestNotificationPermissions(t *testing.T) {
+	srv := NewServer(NewMemoryDriver(), "example.com")
+	db := srv.database
+	for _, user := range []string{"alice@example.com", "bob@example.com", "carol@example.com"} {
+		db.Register(user, "secret")
+	}
+	shared := mustParseURL(t, "fosp://alice@example.com/shared")
+	secret := mustParseURL(t, "fosp://alice@example.com/shared/secret")
+	object := fosp.NewObject()
+	object.Data = "visible"
+	object.Acl = fosp.NewAccessControlList()
+	bob := fosp.NewAccessControlEntry()
+	bob.Data = fosp.NewPermissionSet(fosp.PermissionRead)
+	bob.Subscriptions = fosp.NewPermissionSet(fosp.PermissionWrite)
+	object.Acl.Users["bob@example.com"] = bob
+	for _, user := range []string{"bob@example.com", "carol@example.com"} {
+		object.Subscriptions[user] = &fosp.SubscriptionEntry{Depth: -1, Events: []string{fosp.UPDATED}}
+	}
+	db.Create(context.Background(), "alice@example.com", shared, object)
+	hidden := fosp.NewObject()
+	hidden.Acl = fosp.NewAccessControlList()
+	hidden.Acl.Users["bob@example.com"] = &fosp.AccessControlEntry{Data: fosp.NewPermissionSet(fosp.PermissionNotRead)}
+	db.Create(context.Background(), "alice@example.com", secret, hidden)
+
+	// Notify synchronously, so that the queues can be checked right away.
+	notify := func(u *url.URL) {
+		object, err := db.driver.GetObjectWithParents(u)
+		if err != nil {
+			t.Fatalf("Getting %s failed: %s", u, err)
+		}
+		db.notify(fosp.UPDATED, &object, nil)
+	}
+	notify(shared)
+	records, _ := db.Notifications("bob@example.com", 0)
+	if len(records) != 1 {
+		t.Fatalf("bob got %d notifications about shared", len(records))
+	}
+	if body := string(records[0].Object); !strings.Contains(body, "visible") || strings.Contains(body, "acl") || strings.Contains(body, "subscriptions") {
+		t.Errorf("Notification contains fields that bob may not read: %s", body)
+	}
+	if records, _ := db.Notifications("carol@example.com", 0); len(records) != 0 {
+		t.Errorf("carol got notifications without permission to subscribe: %v", records)
+	}
+	notify(secret)
+	if records, _ := db.Notifications("bob@example.com", 0); len(records) != 1 {
+		t.Errorf("bob got a notification about an object bob may not read")
+	}
+
+	if err := db.checkSubscribe(context.Background(), "carol@example.com", shared); err != Forbidden {
+		t.Errorf("Subscribing without permission returned %v", err)
+	}
+	if err := db.checkSubscribe(context.Background(), "bob@example.com", shared); err != nil {
+		t.Errorf("Subscribing with permission failed: %s", err)
+	}
+	// Revoking the permission drops the stored subscription on delivery.
+	stored, _ := db.driver.GetObjectWithParents(shared)
+	stored.Acl.Users["bob@example.com"].Subscriptions = fosp.NewPermissionSet()
+	db.driver.UpdateObject(shared, &stored)
+	notify(shared)
+	if records, _ := db.Notifications("bob@example.com", 0); len(records) != 1 {
+		t.Errorf("bob got a notification after losing the permission to subscribe")
+	}
+}
+
+func TestDeltaNotifications(t *testing.T) {
+	srv, connection, closer := dialTestServer(t)
+	defer closer()
+	notifications := make(notificationCollector, 10)
+	connection.RegisterMessageHandler(notifications)
+	client := fospclient.New(connection)
+	db := srv.database
+	db.Register("alice@example.com", "secret")
+	if err := client.Authenticate("alice@example.com", "secret"); err != nil {
+		t.Fatalf("Authenticate failed: %s", err)
+	}
+	doc := mustParseURL(t, "fosp://alice@example.com/doc")
+	object := fosp.NewObject()
+	object.Data = map[string]interface{}{"a": 1, "b": 2}
+	client.Create(doc, object)
+	base, err := client.Get(doc)
+	if err != nil {
+		t.Fatalf("Get failed: %s", err)
+	}
+	if err := client.SubscribeDeltas(doc, 0, fosp.UPDATED); err != nil {
+		t.Fatalf("SubscribeDeltas failed: %s", err)
+	}
+	etag, err := client.PatchIfMatch(doc, base.ETag, fosp.PatchObject{"data": map[string]interface{}{"a": 3}})
+	if err != nil {
+		t.Fatalf("PatchIfMatch failed: %s", err)
+	}
+	select {
+	case ntf := <-notifications:
+		if !ntf.IsDelta() || ntf.Header.Get(fosp.BaseETagHeader) != base.ETag || ntf.Header.Get(fosp.ETagHeader) != etag {
+			t.Errorf("Notification is not a delta from %s to %s: %v", base.ETag, etag, ntf.Header)
+		}
+		patch := fosp.PatchObject{}
+		if err := json.NewDecoder(ntf.Body).Decode(&patch); err != nil || len(patch) != 1 {
+			t.Errorf("Body of the delta is %v, %v", patch, err)
+		} else if data, ok := patch["data"].(map[string]interface{}); !ok || data["a"] != 3.0 || len(data) != 1 {
+			t.Errorf("Delta contains the data %v", patch["data"])
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Delta notification was not received")
+	}
+}
+
+func TestDeltaNotificationPermissions(t *testing.T) {
+	srv := NewServer(NewMemoryDriver(), "example.com")
+	db := srv.database
+	db.Register("alice@example.com", "secret")
+	db.Register("bob@example.com", "secret")
+	doc := mustParseURL(t, "fosp://alice@example.com/doc")
+	object := fosp.NewObject()
+	object.Acl = fosp.NewAccessControlList()
+	bob := fosp.NewAccessControlEntry()
+	bob.Acl = fosp.NewPermissionSet(fosp.PermissionRead)
+	bob.Subscriptions = fosp.NewPermissionSet(fosp.PermissionWrite)
+	object.Acl.Users["bob@example.com"] = bob
+	object.Subscriptions["bob@example.com"] = &fosp.SubscriptionEntry{Events: []string{fosp.UPDATED}, Delta: true}
+	db.Create(context.Background(), "alice@example.com", doc, object)
+
+	stored, _ := db.driver.GetObjectWithParents(doc)
+	patch := fosp.PatchObject{"data": "hidden", "acl": map[string]interface{}{}}
+	db.notify(fosp.UPDATED, &stored, &patchDelta{patch: patch, base: "sha256-base"})
+	records, _ := db.Notifications("bob@example.com", 0)
+	if len(records) != 1 {
+		t.Fatalf("bob got %d notifications", len(records))
+	}
+	if record := records[0]; record.BaseETag != "sha256-base" || record.ETag == "" || string(record.Object) != `{"acl":{}}` {
+		t.Errorf("Queued delta is %+v with body %s", record, record.Object)
+	}
+	if ntf, err := records[0].Notification(); err != nil || !ntf.IsDelta() {
+		t.Errorf("Replayed notification is not a delta: %v, %v", ntf, err)
+	}
+}
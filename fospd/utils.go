@@ -16,10 +16,17 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/url"
 	"path"
+	"strings"
 	"time"
 )
 
@@ -73,3 +80,104 @@ func urlFamily(u *url.URL) (urls []*url.URL) {
 	}
 	return append(urls, &baseUrl)
 }
+
+// childPrefix returns the common prefix of the URLs of all descendants of u.
+func childPrefix(u *url.URL) string {
+	return strings.TrimSuffix(u.String(), "/") + "/"
+}
+
+// rootOwner returns the user whose root contains the object at u, e.g. alice@example.com for fosp://alice@example.com/notes.
+func rootOwner(u *url.URL) string {
+	return u.User.Username() + "@" + u.Host
+}
+
+// userDomain returns the domain part of a user identifier like alice@example.com.
+func userDomain(user string) string {
+	if i := strings.LastIndex(user, "@"); i >= 0 {
+		return user[i+1:]
+	}
+	return ""
+}
+
+// nopSeekCloser adds a Close method that does nothing to a bytes.Reader.
+type nopSeekCloser struct {
+	*bytes.Reader
+}
+
+func (nopSeekCloser) Close() error {
+	return nil
+}
+
+// readCloser combines a reader with the Close method of another value, e.g. a limited view of a file.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// maxSizeReader reads at most remaining bytes from reader and fails with err if reader contains more.
+type maxSizeReader struct {
+	reader    io.Reader
+	remaining int64
+	err       error
+}
+
+func (r *maxSizeReader) Read(p []byte) (int, error) {
+	if r.remaining <= 0 {
+		var probe [1]byte
+		n, err := r.reader.Read(probe[:])
+		if n > 0 {
+			return 0, r.err
+		}
+		return 0, err
+	}
+	if int64(len(p)) > r.remaining {
+		p = p[:r.remaining]
+	}
+	n, err := r.reader.Read(p)
+	r.remaining -= int64(n)
+	return n, err
+}
+
+// contextReader reads from reader until ctx ends, then it fails with the error of ctx.
+type contextReader struct {
+	ctx    context.Context
+	reader io.Reader
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.reader.Read(p)
+}
+
+// randomString returns a URL safe string that encodes length random bytes.
+func randomString(length int) (string, error) {
+	raw := make([]byte, length)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+// newSecret returns a new random secret for ServerSecret.
+func newSecret() ([]byte, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	return secret, nil
+}
+
+// isHexDigest reports whether name is the hex encoded part of an attachment digest.
+func isHexDigest(name string) bool {
+	if len(name) != 2*sha256.Size {
+		return false
+	}
+	for _, c := range name {
+		if !strings.ContainsRune("0123456789abcdef", c) {
+			return false
+		}
+	}
+	return true
+}